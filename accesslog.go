@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ===== ACCESS LOG =====
+
+// openAccessLog opens an AccessLog path for appending. It is the hook for
+// rotation: point it at something like a lumberjack.Logger and the guard
+// writes through that without knowing how files are rotated. It is not
+// used for "stdout".
+var openAccessLog = func(path string) (io.WriteCloser, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+}
+
+var (
+	accessLock   sync.Mutex
+	accessPath   string
+	accessOut    io.WriteCloser
+	accessLogger *slog.Logger // nil while the access log is off
+)
+
+// configureAccessLog follows AccessLog across reloads, reopening only when
+// the path changes. A path that can't be opened leaves the access log off
+// until a later reload fixes it.
+func configureAccessLog(cfg Config) {
+	accessLock.Lock()
+	defer accessLock.Unlock()
+	if cfg.AccessLog == accessPath && (accessLogger != nil || cfg.AccessLog == "") {
+		return
+	}
+	closeAccessLog()
+	accessPath = cfg.AccessLog
+	if err := openAccessLogLocked(); err != nil {
+		log.Printf("⚠️ Access log disabled, can't open %s: %v", accessPath, err)
+	}
+}
+
+// reopenAccessLog closes and reopens the access log file, so an external
+// rotator (logrotate and friends) only has to move the file and send SIGHUP.
+func reopenAccessLog() {
+	accessLock.Lock()
+	defer accessLock.Unlock()
+	if accessPath == "" || accessPath == "stdout" {
+		return
+	}
+	closeAccessLog()
+	if err := openAccessLogLocked(); err != nil {
+		log.Printf("⚠️ Access log disabled, can't reopen %s: %v", accessPath, err)
+	}
+}
+
+func openAccessLogLocked() error {
+	switch accessPath {
+	case "":
+		return nil
+	case "stdout":
+		accessOut = nopWriteCloser{os.Stdout}
+	default:
+		out, err := openAccessLog(accessPath)
+		if err != nil {
+			return err
+		}
+		accessOut = out
+	}
+	accessLogger = slog.New(slog.NewJSONHandler(accessOut, nil))
+	return nil
+}
+
+func closeAccessLog() {
+	if accessOut != nil {
+		accessOut.Close()
+	}
+	accessOut, accessLogger = nil, nil
+}
+
+func getAccessLogger() *slog.Logger {
+	accessLock.Lock()
+	defer accessLock.Unlock()
+	return accessLogger
+}
+
+// reopenOnHangup reopens the access log on every SIGHUP until ctx is done.
+func reopenOnHangup(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			reopenAccessLog()
+		}
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+type accessKey struct{}
+
+// accessRecord collects what the access log line of one HTTP request
+// reports. The exchange fills in the caller and the decisions; a batch
+// is logged as method "batch", with decision "mixed" when its calls
+// weren't all decided alike and the first rejection's reason.
+type accessRecord struct {
+	http.ResponseWriter
+	status   int
+	ip       string
+	reqID    string
+	method   string
+	decision string
+	reason   string
+	calls    int
+}
+
+func (a *accessRecord) WriteHeader(code int) {
+	if a.status == 0 {
+		a.status = code
+	}
+	a.ResponseWriter.WriteHeader(code)
+}
+
+func (a *accessRecord) Write(b []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	return a.ResponseWriter.Write(b)
+}
+
+// Hijack lets WebSocket upgrades through the recorder.
+func (a *accessRecord) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	a.status = http.StatusSwitchingProtocols
+	return http.NewResponseController(a.ResponseWriter).Hijack()
+}
+
+func (a *accessRecord) Unwrap() http.ResponseWriter { return a.ResponseWriter }
+
+// note records one call's decision; a nil record (access log off) ignores it.
+func (a *accessRecord) note(method, decision, reason string) {
+	if a == nil {
+		return
+	}
+	a.calls++
+	if a.calls == 1 {
+		a.method, a.decision, a.reason = method, decision, reason
+		return
+	}
+	a.method = "batch"
+	if decision != a.decision {
+		a.decision = "mixed"
+	}
+	if a.reason == "" {
+		a.reason = reason
+	}
+}
+
+// withAccessLog writes one line per request to the access log, when one is
+// configured: time, request ID, client IP, method, decision, reason, HTTP
+// status and duration.
+func withAccessLog(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := getAccessLogger()
+		if logger == nil {
+			next(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &accessRecord{ResponseWriter: w}
+		next(rec, r.WithContext(context.WithValue(r.Context(), accessKey{}, rec)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		logger.Info("access",
+			slog.String("request_id", rec.reqID),
+			slog.String("ip", rec.ip),
+			slog.String("method", rec.method),
+			slog.String("decision", rec.decision),
+			slog.String("reason", rec.reason),
+			slog.Int("status", rec.status),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+		)
+	}
+}
+
+// accessRecordFor returns the request's access record, or nil while the
+// access log is off.
+func accessRecordFor(r *http.Request) *accessRecord {
+	rec, _ := r.Context().Value(accessKey{}).(*accessRecord)
+	return rec
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ===== ADMIN API =====
+
+const adminTokenHeader = "X-Admin-Token"
+
+// requireAdmin wraps an admin handler with the AdminToken check and, when
+// AdminHMACSecret is set, a request signature check; with both set both must
+// pass. Without either the admin API does not exist.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := getConfig()
+		token, secret := cfg.AdminToken, cfg.AdminHMACSecret
+		if token == "" && secret == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(adminTokenHeader)), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if secret != "" {
+			if err := checkAdminSignature(r, secret, time.Now()); err != nil {
+				http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+type limiterState struct {
+	Key      string    `json:"key"`
+	Tokens   float64   `json:"tokens"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// handleAdminLimiters serves GET /admin/limiters (snapshot of every per-IP
+// bucket) and DELETE /admin/limiters/{key} (reset one bucket).
+func handleAdminLimiters(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/limiters"), "/")
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		writeJSON(w, http.StatusOK, snapshotLimiters())
+	case r.Method == http.MethodDelete && key != "":
+		if !resetLimiter(key) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// configSummary is what POST /admin/reload reports about the config it
+// applied. It only counts settings, so no secret or upstream URL leaks.
+type configSummary struct {
+	Path             string `json:"path"`
+	Upstreams        int    `json:"upstreams"`
+	MethodRoutes     int    `json:"method_routes"`
+	RateLimits       int    `json:"rate_limits"`
+	GlobalRateLimits int    `json:"global_rate_limits"`
+	Tiers            int    `json:"tiers"`
+	APIKeys          int    `json:"api_keys"`
+	ShadowMode       bool   `json:"shadow_mode"`
+}
+
+// handleAdminReload serves POST /admin/reload: the config file is re-read
+// and validated on the spot, through the same path as the file watcher.
+// A config that fails leaves the running one in place and answers 400.
+func handleAdminReload(path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		c, err := applyConfigFile(path)
+		if err != nil {
+			log.Printf("⚠️ Admin reload failed, keeping previous config: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("🔄 Config reloaded from %s via admin API", path)
+		writeJSON(w, http.StatusOK, configSummary{
+			Path:             path,
+			Upstreams:        len(upstreamURLs(c)),
+			MethodRoutes:     len(c.MethodRoutes),
+			RateLimits:       len(c.RateLimits),
+			GlobalRateLimits: len(c.GlobalRateLimits),
+			Tiers:            len(c.Tiers),
+			APIKeys:          len(c.APIKeys),
+			ShadowMode:       c.ShadowMode,
+		})
+	}
+}
+
+// snapshotLimiters only copies the map under limiterLock and reads each
+// bucket afterwards, so request serving is blocked for as short as possible.
+func snapshotLimiters() []limiterState {
+	limiterLock.Lock()
+	keys := make([]string, 0, len(ipLimiters))
+	lims := make([]limiter, 0, len(ipLimiters))
+	for k, lim := range ipLimiters {
+		keys = append(keys, k)
+		lims = append(lims, lim)
+	}
+	limiterLock.Unlock()
+
+	out := make([]limiterState, len(lims))
+	for i, lim := range lims {
+		out[i] = limiterState{Key: keys[i], Tokens: lim.remaining(), LastSeen: lim.lastUsed()}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// resetLimiter drops a bucket; the next request recreates it at full burst.
+func resetLimiter(key string) bool {
+	limiterLock.Lock()
+	defer limiterLock.Unlock()
+	if _, ok := ipLimiters[key]; !ok {
+		return false
+	}
+	dropLimiter(key)
+	return true
+}
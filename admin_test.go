@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// adminCall sends an admin request through requireAdmin with token.
+func adminCall(handler http.HandlerFunc, method, target, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set(adminTokenHeader, token)
+	}
+	rec := httptest.NewRecorder()
+	requireAdmin(handler)(rec, req)
+	return rec
+}
+
+func TestAdminLimiters(t *testing.T) {
+	resetLimiters(t)
+	cfg := testConfig("http://127.0.0.1:1")
+	cfg.AdminToken = "t0ken"
+	useConfig(t, cfg)
+	getLimiter(cfg, "192.0.2.1", "eth_call", RateLimitConfig{RatePerSec: 1, Burst: 5}).allowN(2)
+
+	for _, token := range []string{"", "wrong"} {
+		if rec := adminCall(handleAdminLimiters, http.MethodGet, "/admin/limiters", token); rec.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: %d %s", token, rec.Code, rec.Body)
+		}
+	}
+	if rec := adminCall(handleAdminLimiters, http.MethodDelete, "/admin/limiters/192.0.2.1:eth_call", "wrong"); rec.Code != http.StatusUnauthorized || len(limiterKeys()) != 1 {
+		t.Errorf("unauthorized reset: %d, %d buckets left", rec.Code, len(limiterKeys()))
+	}
+
+	rec := adminCall(handleAdminLimiters, http.MethodGet, "/admin/limiters", "t0ken")
+	var got []limiterState
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("snapshot: %d %q %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+	if len(got) != 1 || got[0].Key != "192.0.2.1:eth_call" || got[0].Tokens < 2.9 || got[0].Tokens > 3.1 {
+		t.Errorf("snapshot %+v, want one bucket with 3 tokens", got)
+	}
+	if rec := adminCall(handleAdminLimiters, http.MethodDelete, "/admin/limiters/192.0.2.1:eth_call", "t0ken"); rec.Code != http.StatusNoContent || len(limiterKeys()) != 0 {
+		t.Errorf("reset: %d, %d buckets left", rec.Code, len(limiterKeys()))
+	}
+
+	// Without a token or secret configured there is no admin API.
+	cfg.AdminToken = ""
+	useConfig(t, cfg)
+	if rec := adminCall(handleAdminLimiters, http.MethodGet, "/admin/limiters", "t0ken"); rec.Code != http.StatusNotFound {
+		t.Errorf("admin API unconfigured: %d", rec.Code)
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	path := t.TempDir() + "/config.json"
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := testConfig("http://127.0.0.1:8545")
+	cfg.AdminToken = "t0ken"
+	useConfig(t, cfg)
+	write(`{"geth_rpc":"http://127.0.0.1:8545","log_block_range_limit":7,"admin_token":"t0ken","shadow_mode":true,
+		"rate_limits":{"eth_call":{"rate_per_sec":1,"burst":1}}}`)
+
+	if rec := adminCall(handleAdminReload(path), http.MethodPost, "/admin/reload", "wrong"); rec.Code != http.StatusUnauthorized || getConfig().LogBlockRangeLimit != 100 {
+		t.Fatalf("unauthorized reload: %d, limit now %d", rec.Code, getConfig().LogBlockRangeLimit)
+	}
+
+	rec := adminCall(handleAdminReload(path), http.MethodPost, "/admin/reload", "t0ken")
+	var sum configSummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &sum); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("reload: %d %s", rec.Code, rec.Body)
+	}
+	if sum.Path != path || sum.Upstreams != 1 || sum.RateLimits != 1 || !sum.ShadowMode {
+		t.Errorf("summary %+v", sum)
+	}
+	if getConfig().LogBlockRangeLimit != 7 {
+		t.Errorf("reloaded config not applied: %+v", getConfig())
+	}
+
+	// A broken file is reported and the running config stays.
+	write(`{"geth_rpc":"not a url","log_block_range_limit":5,"admin_token":"t0ken"}`)
+	if rec := adminCall(handleAdminReload(path), http.MethodPost, "/admin/reload", "t0ken"); rec.Code != http.StatusBadRequest || getConfig().LogBlockRangeLimit != 7 {
+		t.Errorf("invalid reload: %d, limit now %d", rec.Code, getConfig().LogBlockRangeLimit)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetSeenSignatures starts the test with no remembered signatures.
+func resetSeenSignatures(t *testing.T) {
+	reset := func() {
+		seenSigLock.Lock()
+		seenSignatures = make(map[string]time.Time)
+		seenSigLock.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestCheckAdminSignature(t *testing.T) {
+	const secret = "s3cret"
+	now := time.Unix(1_700_000_000, 0)
+	body := []byte(`{"key":"192.0.2.1:eth_call"}`)
+	sign := func(secret string, ts time.Time, uri string, body []byte) string {
+		return signAdminRequest(secret, ts.Unix(), http.MethodPost, uri, body)
+	}
+	cases := []struct {
+		name    string
+		ts, sig string // headers; "-" leaves one out
+		uri     string
+		body    []byte
+		wantErr string
+	}{
+		{"valid", strconv.FormatInt(now.Unix(), 10), sign(secret, now, "/admin/reload?x=1", body), "/admin/reload?x=1", body, ""},
+		{"tampered body", strconv.FormatInt(now.Unix(), 10), sign(secret, now, "/admin/reload?x=1", body), "/admin/reload?x=1", []byte(`{"key":"192.0.2.2:eth_call"}`), "bad signature"},
+		{"tampered uri", strconv.FormatInt(now.Unix(), 10), sign(secret, now, "/admin/reload?x=1", body), "/admin/reload?x=2", body, "bad signature"},
+		{"wrong secret", strconv.FormatInt(now.Unix(), 10), sign("guess", now, "/admin/reload?x=1", body), "/admin/reload?x=1", body, "bad signature"},
+		{"stale timestamp", strconv.FormatInt(now.Add(-6*time.Minute).Unix(), 10), sign(secret, now.Add(-6*time.Minute), "/admin/reload", body), "/admin/reload", body, "stale timestamp"},
+		{"future timestamp", strconv.FormatInt(now.Add(6*time.Minute).Unix(), 10), sign(secret, now.Add(6*time.Minute), "/admin/reload", body), "/admin/reload", body, "stale timestamp"},
+		{"missing timestamp", "-", sign(secret, now, "/admin/reload", body), "/admin/reload", body, "missing or malformed"},
+		{"missing signature", strconv.FormatInt(now.Unix(), 10), "-", "/admin/reload", body, "bad signature"},
+		{"malformed timestamp", "yesterday", sign(secret, now, "/admin/reload", body), "/admin/reload", body, "missing or malformed"},
+		{"malformed signature", strconv.FormatInt(now.Unix(), 10), "not-hex", "/admin/reload", body, "bad signature"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resetSeenSignatures(t)
+			r := httptest.NewRequest(http.MethodPost, c.uri, bytes.NewReader(c.body))
+			if c.ts != "-" {
+				r.Header.Set(adminTimestampHeader, c.ts)
+			}
+			if c.sig != "-" {
+				r.Header.Set(adminSignatureHeader, c.sig)
+			}
+			err := checkAdminSignature(r, secret, now)
+			switch {
+			case c.wantErr == "" && err != nil:
+				t.Fatalf("refused: %v", err)
+			case c.wantErr != "" && (err == nil || !strings.Contains(err.Error(), c.wantErr)):
+				t.Fatalf("got %v, want %q", err, c.wantErr)
+			}
+			if err == nil {
+				// The next handler still gets to read the body.
+				if rest, _ := io.ReadAll(r.Body); !bytes.Equal(rest, c.body) {
+					t.Errorf("body left for the handler: %q", rest)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckAdminSignatureRefusesReplay(t *testing.T) {
+	resetSeenSignatures(t)
+	now := time.Now()
+	send := func() error {
+		r := httptest.NewRequest(http.MethodDelete, "/admin/limiters/192.0.2.1:eth_call", nil)
+		r.Header.Set(adminTimestampHeader, strconv.FormatInt(now.Unix(), 10))
+		r.Header.Set(adminSignatureHeader, signAdminRequest("s3cret", now.Unix(), http.MethodDelete, "/admin/limiters/192.0.2.1:eth_call", nil))
+		return checkAdminSignature(r, "s3cret", now)
+	}
+	if err := send(); err != nil {
+		t.Fatalf("first request refused: %v", err)
+	}
+	if err := send(); err == nil || !strings.Contains(err.Error(), "replayed") {
+		t.Errorf("replay got %v", err)
+	}
+}
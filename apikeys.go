@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// ===== API KEY TIERS =====
+
+const apiKeyHeader = "X-API-Key"
+
+// identify resolves the caller's API key. A known key moves rate limiting
+// from the client IP onto the key and selects its tier, so partners behind
+// a shared NAT don't share one bucket. Missing or unknown keys fall back to
+// anonymous IP-based limits unless RequireAPIKey is set (allowlisted
+// callers are exempt). Without a key, a client certificate named in
+// ClientCertTiers selects the tier instead, and is limited on its own.
+func (ex *exchange) identify(r *http.Request) *rejection {
+	key := r.Header.Get(apiKeyHeader)
+	if tier, ok := ex.cfg.APIKeys[key]; ok && key != "" {
+		ex.tier = tier
+		ex.subject = "key:" + keyFingerprint(key)
+		return nil
+	}
+	for _, name := range ex.certNames {
+		if tier, ok := ex.cfg.ClientCertTiers[name]; ok {
+			ex.tier = tier
+			ex.subject = "cert:" + name
+			return nil
+		}
+	}
+	if ex.cfg.RequireAPIKey && !ex.allowlisted {
+		return &rejection{"invalid_api_key", "Missing or unknown API key"}
+	}
+	return nil
+}
+
+// keyFingerprint stands in for the raw key wherever it might be exposed,
+// such as limiter keys listed by the admin API.
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// tierLabel is the bounded metric/log label for the caller's tier.
+func (ex *exchange) tierLabel() string {
+	if ex.tier == "" {
+		return "anonymous"
+	}
+	return ex.tier
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ===== BATCH REQUESTS =====
+
+// isBatch reports whether the body is a JSON-RPC batch (a top-level array).
+func isBatch(body []byte) bool {
+	trimmed := bytes.TrimLeft(body, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// handleBatch guards every element of a batch individually. Allowed elements
+// are forwarded upstream as a smaller batch, and rejected ones get a
+// synthesized error, so the reply keeps the client's order and ids. Elements
+// with different MethodRoutes go out as one sub-batch per upstream.
+func handleBatch(w http.ResponseWriter, ex *exchange, body []byte) {
+	cfg := ex.cfg
+	var raws []json.RawMessage
+	if err := json.Unmarshal(body, &raws); err != nil || len(raws) == 0 {
+		http.Error(w, "invalid JSON-RPC", 400)
+		return
+	}
+	requestBytes.WithLabelValues("batch").Observe(float64(len(body)))
+	methodsInFlight.WithLabelValues("batch").Inc()
+	defer methodsInFlight.WithLabelValues("batch").Dec()
+
+	reqs := make([]RPCRequest, len(raws))
+	replies := make([]interface{}, len(raws))
+	var forwardIdx []int
+	routes := map[string][]int{}
+	var routeOrder []string
+
+	for i, raw := range raws {
+		if err := json.Unmarshal(raw, &reqs[i]); err != nil {
+			ex.logDecision("", "reject", "invalid_json", 0, nil)
+			replies[i] = RPCResponse{
+				JSONRPC: "2.0",
+				Error:   &RPCError{Code: -32600, Message: "Invalid request"},
+			}
+			continue
+		}
+		req := &reqs[i]
+		if rej := checkRequest(ex, req, raw); rej != nil {
+			ex.logDecision(req.Method, "reject", rej.reason, 0, nil)
+			reply := ex.rejectResponse(req.ID, req.Method, rej)
+			if !req.isNotification() {
+				replies[i] = reply
+			}
+			continue
+		}
+		forwardIdx = append(forwardIdx, i)
+		route := methodRoute(cfg, req.Method)
+		if _, ok := routes[route]; !ok {
+			routeOrder = append(routeOrder, route)
+		}
+		routes[route] = append(routes[route], i)
+	}
+
+	ex.setQuotaHeaders(w)
+
+	// Nothing rejected or split: pass the original batch and upstream reply through.
+	if len(forwardIdx) == len(raws) && len(routeOrder) == 1 {
+		start := time.Now()
+		resp, err := forwardOrFallback(ex.ctx, withRoute(cfg, routeOrder[0]), batchMethods(reqs, forwardIdx), body, ex.header)
+		ex.recordBatchForward(reqs, forwardIdx, time.Since(start), err)
+		if isClientCancel(err) {
+			return
+		}
+		if errors.Is(err, errUpstreamBusy) {
+			ex.rejectBusy(reqs, forwardIdx, replies)
+			writeBatchReplies(w, replies)
+			return
+		}
+		if err != nil {
+			if answeredInBand(err) {
+				for i := range reqs {
+					if !reqs[i].isNotification() {
+						replies[i] = upstreamErrorResponse(reqs[i].ID, err)
+					}
+				}
+				writeBatchReplies(w, replies)
+				return
+			}
+			http.Error(w, "upstream RPC failed", 502)
+			return
+		}
+		defer resp.Body.Close()
+		if err := relayUpstream(w, resp, cfg, "batch"); err != nil {
+			for i := range reqs {
+				if !reqs[i].isNotification() {
+					replies[i] = upstreamErrorResponse(reqs[i].ID, err)
+				}
+			}
+			writeBatchReplies(w, replies)
+		}
+		return
+	}
+
+	for _, route := range routeOrder {
+		idx := routes[route]
+		forward := make([]json.RawMessage, len(idx))
+		for k, i := range idx {
+			forward[k] = raws[i]
+		}
+		start := time.Now()
+		upstream, err := forwardBatch(ex.ctx, withRoute(cfg, route), batchMethods(reqs, idx), forward, ex.header)
+		ex.recordBatchForward(reqs, idx, time.Since(start), err)
+		if isClientCancel(err) {
+			return
+		}
+		if errors.Is(err, errUpstreamBusy) {
+			ex.rejectBusy(reqs, idx, replies)
+			continue
+		}
+		for _, i := range idx {
+			if reqs[i].isNotification() {
+				continue
+			}
+			if err != nil {
+				replies[i] = upstreamErrorResponse(reqs[i].ID, err)
+				continue
+			}
+			if reply, ok := upstream.take(reqs[i].ID); ok {
+				replies[i] = reply
+				if cfg.CountUpstreamErrors {
+					countRPCErrors(methodLabel(cfg, reqs[i].Method), reply)
+				}
+			}
+		}
+	}
+
+	writeBatchReplies(w, replies)
+}
+
+// writeBatchReplies writes the non-nil replies in order. A batch made up
+// only of notifications gets no body at all, as JSON-RPC requires.
+func writeBatchReplies(w http.ResponseWriter, replies []interface{}) {
+	out := make([]interface{}, 0, len(replies))
+	for _, reply := range replies {
+		// Notifications stay absent, as do calls upstream didn't answer.
+		if reply != nil {
+			out = append(out, reply)
+		}
+	}
+	if len(out) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (ex *exchange) recordBatchForward(reqs []RPCRequest, idx []int, latency time.Duration, err error) {
+	if isClientCancel(err) {
+		for _, i := range idx {
+			ex.countCancel(reqs[i].Method, latency)
+		}
+		return
+	}
+	if errors.Is(err, errUpstreamBusy) {
+		return // counted as rejections by rejectBusy
+	}
+	upstreamDuration.WithLabelValues("batch").Observe(latency.Seconds())
+	for _, i := range idx {
+		ex.countAccept(reqs[i].Method)
+		ex.logDecision(reqs[i].Method, "accept", "", latency, err)
+	}
+}
+
+// rejectBusy turns the calls at idx into upstream_busy rejections, since the
+// sub-batch carrying them never got an upstream slot.
+func (ex *exchange) rejectBusy(reqs []RPCRequest, idx []int, replies []interface{}) {
+	for _, i := range idx {
+		ex.logDecision(reqs[i].Method, "reject", errBusyRejection.reason, 0, nil)
+		reply := ex.rejectResponse(reqs[i].ID, reqs[i].Method, errBusyRejection)
+		if !reqs[i].isNotification() {
+			replies[i] = reply
+		}
+	}
+}
+
+// batchMethods lists the methods of the calls at idx.
+func batchMethods(reqs []RPCRequest, idx []int) []string {
+	methods := make([]string, len(idx))
+	for k, i := range idx {
+		methods[k] = reqs[i].Method
+	}
+	return methods
+}
+
+// batchReplies indexes upstream batch responses by their encoded id so they
+// can be matched back to the originating requests regardless of order.
+type batchReplies map[string][]json.RawMessage
+
+func (b batchReplies) take(id json.RawMessage) (json.RawMessage, bool) {
+	key := idKey(id)
+	queue := b[key]
+	if len(queue) == 0 {
+		return nil, false
+	}
+	b[key] = queue[1:]
+	return queue[0], true
+}
+
+func forwardBatch(ctx context.Context, cfg Config, methods []string, forward []json.RawMessage, header http.Header) (batchReplies, error) {
+	payload, err := json.Marshal(forward)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := forwardOrFallback(ctx, cfg, methods, payload, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := decodeUpstream(resp); err != nil {
+		return nil, err
+	}
+
+	body := &countingReader{r: resp.Body}
+	var src io.Reader = body
+	if cfg.MaxResponseBytes > 0 {
+		src = io.LimitReader(body, cfg.MaxResponseBytes+1)
+	}
+	var raws []json.RawMessage
+	err = json.NewDecoder(src).Decode(&raws)
+	responseBytes.WithLabelValues("batch").Observe(float64(body.n))
+	if cfg.MaxResponseBytes > 0 && body.n > cfg.MaxResponseBytes {
+		responsesTooLarge.WithLabelValues("batch").Inc()
+		return nil, errResponseTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+	return indexReplies(raws), nil
+}
+
+// indexReplies files the replies of an upstream batch under their ids.
+func indexReplies(raws []json.RawMessage) batchReplies {
+	replies := make(batchReplies, len(raws))
+	for _, raw := range raws {
+		var head struct {
+			ID json.RawMessage `json:"id"`
+		}
+		if err := json.Unmarshal(raw, &head); err != nil {
+			continue
+		}
+		key := idKey(head.ID)
+		replies[key] = append(replies[key], raw)
+	}
+	return replies
+}
+
+// idKey compacts an id so whitespace differences between the request and
+// the upstream's echo don't matter; the id bytes themselves are compared.
+func idKey(id json.RawMessage) string {
+	var buf bytes.Buffer
+	if json.Compact(&buf, id) != nil {
+		return string(id)
+	}
+	return buf.String()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBatchMixesAcceptedAndRejected(t *testing.T) {
+	resetLimiters(t)
+	var forwarded atomic.Int32
+	srv := rpcUpstream(t, func(method string, _ json.RawMessage) interface{} {
+		forwarded.Add(1)
+		return method
+	})
+	cfg := testConfig(srv.URL)
+	cfg.RateLimits = map[string]RateLimitConfig{"eth_blockNumber": {RatePerSec: 0.001, Burst: 1}}
+	cfg.BlockedMethods = []string{"admin_peers"}
+	useConfig(t, cfg)
+
+	rec := postRPC(handleRPC, `[
+		{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"},
+		{"jsonrpc":"2.0","id":"two","method":"eth_blockNumber"},
+		{"jsonrpc":"2.0","id":3,"method":"eth_chainId"},
+		{"jsonrpc":"2.0","method":"eth_chainId"},
+		{"jsonrpc":"2.0","id":4,"method":"admin_peers"},
+		{"jsonrpc":"1.0","id":5,"method":"eth_chainId"},
+		42
+	]`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", rec.Code)
+	}
+	var replies []testReply
+	if err := json.Unmarshal(rec.Body.Bytes(), &replies); err != nil {
+		t.Fatalf("reply %s: %v", rec.Body, err)
+	}
+
+	want := []struct {
+		id     string
+		reason string
+		code   int
+	}{
+		{"1", "", 0},
+		{`"two"`, "rate_limited", -32005},
+		{"3", "", 0},
+		// The notification gets no reply.
+		{"4", "method_blocked", -32601},
+		{"5", "invalid_request", -32600},
+		{"null", "", -32600},
+	}
+	if len(replies) != len(want) {
+		t.Fatalf("%d replies, want %d: %s", len(replies), len(want), rec.Body)
+	}
+	for i, w := range want {
+		r := replies[i]
+		if string(r.ID) != w.id || r.reason() != w.reason {
+			t.Errorf("reply %d: id %s reason %q, want id %s reason %q", i, r.ID, r.reason(), w.id, w.reason)
+		}
+		if w.code != 0 && (r.Error == nil || r.Error.Code != w.code) {
+			t.Errorf("reply %d: error %+v, want code %d", i, r.Error, w.code)
+		}
+		if w.code == 0 && r.Error != nil {
+			t.Errorf("reply %d: unexpected error %+v", i, r.Error)
+		}
+	}
+	// Only the accepted calls went upstream: 1, 3 and the notification.
+	if n := forwarded.Load(); n != 3 {
+		t.Errorf("%d calls forwarded, want 3", n)
+	}
+}
+
+func TestBatchPassesThroughWhenAllAccepted(t *testing.T) {
+	resetLimiters(t)
+	srv := rpcUpstream(t, func(method string, _ json.RawMessage) interface{} { return method })
+	useConfig(t, testConfig(srv.URL))
+
+	rec := postRPC(handleRPC, `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"net_version"}]`)
+	var replies []testReply
+	if err := json.Unmarshal(rec.Body.Bytes(), &replies); err != nil || len(replies) != 2 {
+		t.Fatalf("reply %s: %v", rec.Body, err)
+	}
+	if string(replies[0].Result) != `"eth_chainId"` || string(replies[1].Result) != `"net_version"` {
+		t.Errorf("replies %s", rec.Body)
+	}
+}
+
+func TestBatchInvalid(t *testing.T) {
+	resetLimiters(t)
+	useConfig(t, testConfig(okUpstream(t).URL))
+	for _, body := range []string{`[]`, `[{"jsonrpc":"2.0"`} {
+		if rec := postRPC(handleRPC, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, rec.Code)
+		}
+	}
+}
+
+func TestSingleCallStillServed(t *testing.T) {
+	resetLimiters(t)
+	useConfig(t, testConfig(okUpstream(t).URL))
+	rec := postRPC(handleRPC, `{"jsonrpc":"2.0","id":7,"method":"eth_blockNumber"}`)
+	var reply testReply
+	if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("reply %s: %v", rec.Body, err)
+	}
+	if rec.Code != http.StatusOK || string(reply.ID) != "7" || string(reply.Result) != `"0x1"` {
+		t.Errorf("got %d %s", rec.Code, rec.Body)
+	}
+}
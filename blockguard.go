@@ -0,0 +1,58 @@
+package main
+
+// ===== FULL BLOCK GUARDS =====
+
+// FullBlockTxsConfig (restrict_full_block_txs) restricts eth_getBlockByNumber and eth_getBlockByHash
+// calls asking for full transaction objects, which can be many times the
+// size of the hash-only form.
+type FullBlockTxsConfig struct {
+	// RejectTiers are API-key tiers ("anonymous" for callers without a key)
+	// refused full blocks outright.
+	RejectTiers []string `json:"reject_tiers"`
+	// Cost replaces the method's MethodCosts entry for full-block calls, so
+	// they drain rate limits faster. 0 keeps the method's usual cost.
+	Cost float64 `json:"cost"`
+}
+
+var fullBlockMethods = map[string]bool{
+	"eth_getBlockByNumber": true,
+	"eth_getBlockByHash":   true,
+}
+
+// wantsFullTxs reports whether a block fetch asks for full transactions: its
+// second param is the JSON boolean true. Omitted or anything else (which the
+// node refuses anyway) counts as hashes only.
+func wantsFullTxs(req *RPCRequest) bool {
+	if !fullBlockMethods[req.Method] {
+		return false
+	}
+	params := req.positional()
+	if len(params) < 2 {
+		return false
+	}
+	full, _ := params[1].(bool)
+	return full
+}
+
+// checkFullBlock refuses full-transaction block fetches from RejectTiers.
+func (ex *exchange) checkFullBlock(req *RPCRequest) *rejection {
+	r := ex.cfg.RestrictFullBlockTxs
+	if r == nil || len(r.RejectTiers) == 0 || !wantsFullTxs(req) {
+		return nil
+	}
+	for _, tier := range r.RejectTiers {
+		if tier == ex.tierLabel() {
+			return &rejection{"full_block_denied", "Full transaction objects not allowed"}
+		}
+	}
+	return nil
+}
+
+// callCost is the rate-limit cost of one call: methodCost, or the
+// restrict_full_block_txs cost for a full-transaction block fetch.
+func callCost(cfg Config, req *RPCRequest) float64 {
+	if r := cfg.RestrictFullBlockTxs; r != nil && r.Cost > 0 && wantsFullTxs(req) {
+		return r.Cost
+	}
+	return methodCost(cfg, req.Method)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWantsFullTxs(t *testing.T) {
+	cases := []struct {
+		method string
+		params string
+		want   bool
+	}{
+		{"eth_getBlockByNumber", `["latest",true]`, true},
+		{"eth_getBlockByNumber", `["0x10",false]`, false},
+		{"eth_getBlockByNumber", `["latest"]`, false},
+		{"eth_getBlockByNumber", `["latest","true"]`, false},
+		{"eth_getBlockByNumber", `["latest",1]`, false},
+		{"eth_getBlockByNumber", `["latest",null]`, false},
+		{"eth_getBlockByHash", `["0xabc",true]`, true},
+		{"eth_getBlockByHash", `["0xabc",false]`, false},
+		// Named params carry no position to read; they are refused earlier.
+		{"eth_getBlockByNumber", `{"block":"latest","full":true}`, false},
+		{"eth_getBlockReceipts", `["latest",true]`, false},
+	}
+	for _, c := range cases {
+		req := RPCRequest{Method: c.method}
+		if err := json.Unmarshal([]byte(c.params), &req.Params); err != nil {
+			t.Fatal(err)
+		}
+		if got := wantsFullTxs(&req); got != c.want {
+			t.Errorf("%s %s: %v, want %v", c.method, c.params, got, c.want)
+		}
+	}
+}
+
+// postWithKey posts body as a caller presenting API key key ("" for none).
+func postWithKey(key, body string) testReply {
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set(apiKeyHeader, key)
+	}
+	req.RemoteAddr = "192.0.2.1:1234"
+	rec := httptest.NewRecorder()
+	handleRPC(rec, req)
+	var reply testReply
+	json.Unmarshal(rec.Body.Bytes(), &reply)
+	return reply
+}
+
+func TestRestrictFullBlockTxsByTier(t *testing.T) {
+	resetLimiters(t)
+	cfg := testConfig(okUpstream(t).URL)
+	cfg.APIKeys = map[string]string{"partner-key": "partner"}
+	cfg.RestrictFullBlockTxs = &FullBlockTxsConfig{RejectTiers: []string{"anonymous"}}
+	useConfig(t, cfg)
+
+	cases := []struct {
+		name   string
+		key    string
+		body   string
+		reason string
+	}{
+		{"anonymous, full", "", `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["latest",true]}`, "full_block_denied"},
+		{"anonymous, full by hash", "", `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByHash","params":["0xabc",true]}`, "full_block_denied"},
+		{"anonymous, hashes", "", `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["latest",false]}`, ""},
+		{"anonymous, flag omitted", "", `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["latest"]}`, ""},
+		{"anonymous, named", "", `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":{"block":"latest","full":true}}`, "named_params"},
+		{"partner, full", "partner-key", `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["latest",true]}`, ""},
+		{"partner, named", "partner-key", `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":{"block":"latest","full":true}}`, "named_params"},
+	}
+	for _, c := range cases {
+		if got := postWithKey(c.key, c.body).reason(); got != c.reason {
+			t.Errorf("%s: reason %q, want %q", c.name, got, c.reason)
+		}
+	}
+}
+
+func TestRestrictFullBlockTxsCost(t *testing.T) {
+	resetLimiters(t)
+	cfg := testConfig(okUpstream(t).URL)
+	cfg.DefaultRateLimit = &RateLimitConfig{RatePerSec: 0.001, Burst: 10}
+	cfg.RestrictFullBlockTxs = &FullBlockTxsConfig{Cost: 4}
+	useConfig(t, cfg)
+	const full = `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["latest",true]}`
+	const hashes = `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["latest",false]}`
+
+	// 4 + 4 + 1 + 1 fills the burst of 10 exactly.
+	for i, body := range []string{full, full, hashes, hashes} {
+		if r := postWithKey("", body).reason(); r != "" {
+			t.Fatalf("call %d refused: %s", i, r)
+		}
+	}
+	if r := postWithKey("", full).reason(); r != "rate_limited" {
+		t.Errorf("full fetch past the burst: reason %q, want rate_limited", r)
+	}
+	if r := postWithKey("", hashes).reason(); r != "rate_limited" {
+		t.Errorf("hash-only fetch past the burst: reason %q, want rate_limited", r)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ===== CIRCUIT BREAKER =====
+
+const (
+	defaultBreakerWindow   = 10 * time.Second
+	defaultBreakerCooldown = 30 * time.Second
+)
+
+const (
+	breakerClosed = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+// errCircuitOpen is returned instead of forwarding while the breaker is open.
+var errCircuitOpen = errors.New("circuit open")
+
+// circuitBreaker stops forwarding to one pool after BreakerFailures
+// consecutive failed calls within BreakerWindow. Once BreakerCooldown has passed a single probe
+// call is let through (half-open): success closes the breaker, failure opens
+// it for another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	state     int
+	failures  int
+	firstFail time.Time
+	openedAt  time.Time
+	probing   bool
+	pool      string
+}
+
+const defaultPool = "default"
+
+// breakers holds one breaker per pool: the default one and each method
+// route's upstream.
+var (
+	breakers    = make(map[string]*circuitBreaker)
+	breakerLock sync.Mutex
+)
+
+// breakerFor returns the breaker of the pool cfg forwards to.
+func breakerFor(cfg Config) *circuitBreaker {
+	pool := cfg.route
+	if pool == "" {
+		pool = defaultPool
+	}
+	breakerLock.Lock()
+	defer breakerLock.Unlock()
+	b, ok := breakers[pool]
+	if !ok {
+		b = &circuitBreaker{pool: pool}
+		breakers[pool] = b
+	}
+	return b
+}
+
+func breakerWindow(cfg Config) time.Duration {
+	if cfg.BreakerWindow > 0 {
+		return time.Duration(cfg.BreakerWindow) * time.Millisecond
+	}
+	return defaultBreakerWindow
+}
+
+func breakerCooldown(cfg Config) time.Duration {
+	if cfg.BreakerCooldown > 0 {
+		return time.Duration(cfg.BreakerCooldown) * time.Millisecond
+	}
+	return defaultBreakerCooldown
+}
+
+// allow reports whether a call may be forwarded now.
+func (b *circuitBreaker) allow(cfg Config) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if cfg.BreakerFailures <= 0 {
+		// Disabled, possibly by a reload while tripped.
+		b.setState(breakerClosed)
+		b.failures = 0
+		return true
+	}
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < breakerCooldown(cfg) {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// record feeds the outcome of a forwarded call back into the breaker.
+// Calls the client abandoned say nothing about the upstream and only free
+// the half-open probe slot.
+func (b *circuitBreaker) record(cfg Config, resp *http.Response, err error) {
+	if cfg.BreakerFailures <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	switch {
+	case isClientCancel(err):
+		b.probing = false
+	case err == nil && resp.StatusCode < 500:
+		b.setState(breakerClosed)
+		b.failures = 0
+	case b.state == breakerHalfOpen:
+		b.trip(now)
+	default:
+		if b.failures == 0 || now.Sub(b.firstFail) > breakerWindow(cfg) {
+			b.failures, b.firstFail = 0, now
+		}
+		b.failures++
+		if b.failures >= cfg.BreakerFailures {
+			b.trip(now)
+		}
+	}
+}
+
+func (b *circuitBreaker) trip(now time.Time) {
+	b.setState(breakerOpen)
+	b.openedAt = now
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *circuitBreaker) setState(s int) {
+	b.state = s
+	breakerState.WithLabelValues(b.pool).Set(float64(s))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func okUpstream(t testing.TB) *httptest.Server {
+	return rpcUpstream(t, func(string, json.RawMessage) interface{} { return "0x1" })
+}
+
+// resetBreakers closes every pool's circuit for the test.
+func resetBreakers(t *testing.T) {
+	reset := func() {
+		breakerLock.Lock()
+		breakers = make(map[string]*circuitBreaker)
+		breakerLock.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestBreakerProbeSurvivesBusyUpstream(t *testing.T) {
+	srv := okUpstream(t)
+	cfg := Config{GethRPC: srv.URL, LogBlockRangeLimit: 10, BreakerFailures: 1, BreakerCooldown: 1, UpstreamConcurrency: 1}
+	resetBreakers(t)
+	breaker := breakerFor(cfg)
+	breaker.trip(time.Now().Add(-time.Second))
+
+	// Hold the only slot so the next call is refused as busy.
+	hold, err := acquireUpstream(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := forwardUpstream(context.Background(), cfg, nil, []byte(`{}`), nil); !errors.Is(err, errUpstreamBusy) {
+		t.Fatalf("got %v, want errUpstreamBusy", err)
+	}
+	hold()
+
+	// The probe was never taken, so this call gets it and closes the breaker.
+	resp, err := forwardUpstream(context.Background(), cfg, nil, []byte(`{}`), nil)
+	if err != nil {
+		t.Fatalf("probe after busy: %v", err)
+	}
+	resp.Body.Close()
+	if breaker.state != breakerClosed {
+		t.Fatalf("breaker state %d, want closed", breaker.state)
+	}
+}
+
+func TestBreakerProbeSurvivesCancelledCaller(t *testing.T) {
+	srv := okUpstream(t)
+	cfg := Config{GethRPC: srv.URL, LogBlockRangeLimit: 10, BreakerFailures: 1, BreakerCooldown: 1, UpstreamConcurrency: 1, QueueTimeout: 1000}
+	resetBreakers(t)
+	breaker := breakerFor(cfg)
+	breaker.trip(time.Now().Add(-time.Second))
+
+	hold, err := acquireUpstream(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := forwardUpstream(ctx, cfg, nil, []byte(`{}`), nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	hold()
+
+	resp, err := forwardUpstream(context.Background(), cfg, nil, []byte(`{}`), nil)
+	if err != nil {
+		t.Fatalf("probe after cancel: %v", err)
+	}
+	resp.Body.Close()
+	if breaker.state != breakerClosed {
+		t.Fatalf("breaker state %d, want closed", breaker.state)
+	}
+}
+
+func TestBreakerPerRoute(t *testing.T) {
+	resetLimiters(t)
+	resetBreakers(t)
+	dead := okUpstream(t)
+	dead.Close()
+	cfg := testConfig(okUpstream(t).URL)
+	cfg.MethodRoutes = map[string]string{"debug_*": dead.URL}
+	cfg.BreakerFailures = 2
+	cfg.MaxRetries = 0
+	useConfig(t, cfg)
+	call := func(method string) *RPCError {
+		var reply testReply
+		json.Unmarshal(postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"`+method+`"}`).Body.Bytes(), &reply)
+		return reply.Error
+	}
+
+	for i := 0; i < 3; i++ {
+		call("debug_traceTransaction")
+	}
+	if e := call("debug_traceTransaction"); e == nil || e.Message != "upstream unavailable" {
+		t.Fatalf("routed call after repeated failures: %+v, want the circuit open", e)
+	}
+	if st := breakerFor(withRoute(cfg, dead.URL)).state; st != breakerOpen {
+		t.Errorf("route breaker state %d, want open", st)
+	}
+	// The default pool is healthy and keeps its own circuit closed.
+	if e := call("eth_chainId"); e != nil {
+		t.Errorf("default pool call refused while a route is down: %+v", e)
+	}
+	if st := breakerFor(cfg).state; st != breakerClosed {
+		t.Errorf("default breaker state %d, want closed", st)
+	}
+	if got := testutil.ToFloat64(breakerState.WithLabelValues(dead.URL)); got != breakerOpen {
+		t.Errorf("route circuit gauge %v, want %d", got, breakerOpen)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ===== RESPONSE CACHE =====
+
+const (
+	defaultCacheTTL        = 5 * time.Minute
+	maxCachedResponses     = 1000
+	maxCacheableReplyBytes = 64 << 10
+)
+
+// resultStore holds raw JSON-RPC results by cacheKey. Replies larger than
+// maxReply are relayed without being cached.
+type resultStore interface {
+	get(cfg Config, key string) (json.RawMessage, bool)
+	put(cfg Config, key string, result json.RawMessage)
+	maxReply(cfg Config) int64
+}
+
+// cacheFor picks the store a call is cached in and its key, or nil when the
+// call isn't cacheable.
+func cacheFor(cfg Config, req *RPCRequest) (resultStore, string) {
+	switch {
+	case matchesAny(cfg.CacheMethods, req.Method):
+		return immutableCache, cacheKey(req)
+	case cfg.BlockCacheEntries > 0 && isFixedBlockQuery(req):
+		return blockLRU, cacheKey(req)
+	case cfg.TxDedupWindow > 0 && req.Method == "eth_sendRawTransaction":
+		// Keyed on the tx hash, so the same signed tx dedups however it's hex-cased.
+		if hash, ok := rawTxHash(req.positional()); ok {
+			return txDedup, txDedupKey(hash)
+		}
+	}
+	return nil, ""
+}
+
+// cacheKey is the method plus its params, since e.g. the full-transactions
+// flag of eth_getBlockByNumber changes the result.
+func cacheKey(req *RPCRequest) string {
+	params, _ := json.Marshal(req.Params)
+	return req.Method + ":" + string(params)
+}
+
+// writeCachedResult answers from the cache, splicing the stored result bytes
+// in as they are and the caller's id in their place.
+func writeCachedResult(w http.ResponseWriter, id json.RawMessage, result json.RawMessage) {
+	var buf bytes.Buffer
+	buf.WriteString(`{"jsonrpc":"2.0","id":`)
+	buf.Write(id)
+	buf.WriteString(`,"result":`)
+	buf.Write(result)
+	buf.WriteString("}\n")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf.Bytes())
+}
+
+// relayAndCache relays a cacheable call's reply like relayUpstream, keeping
+// the result when it is a successful JSON-RPC answer. Errors and null
+// results (e.g. a block that doesn't exist yet) are never cached.
+func relayAndCache(w http.ResponseWriter, resp *http.Response, cfg Config, method string, store resultStore, key string) error {
+	if err := decodeUpstream(resp); err != nil {
+		// Can't be inspected; relayed as it came.
+		return relayUpstream(w, resp, cfg, method)
+	}
+	limit := store.maxReply(cfg)
+	// Nothing the client couldn't receive is cached.
+	if cfg.MaxResponseBytes > 0 && cfg.MaxResponseBytes < limit {
+		limit = cfg.MaxResponseBytes
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err == nil && resp.StatusCode == http.StatusOK && int64(len(body)) <= limit {
+		var reply struct {
+			Result json.RawMessage `json:"result"`
+			Error  *RPCError       `json:"error"`
+		}
+		if json.Unmarshal(body, &reply) == nil && reply.Error == nil &&
+			len(reply.Result) > 0 && string(reply.Result) != "null" {
+			store.put(cfg, key, reply.Result)
+		}
+	}
+	// Anything past the limit is still streamed to the client.
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	return relayUpstream(w, resp, cfg, method)
+}
+
+// ----- immutable methods -----
+
+type cachedResult struct {
+	result  json.RawMessage
+	expires time.Time
+}
+
+// ttlCache keeps results for the duration ttl picks from the config. It
+// holds at most maxCachedResponses entries, which only varying params can
+// reach.
+type ttlCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedResult
+	ttl     func(Config) time.Duration
+}
+
+// immutableCache holds CacheMethods results for CacheTTL.
+var immutableCache = &ttlCache{entries: make(map[string]cachedResult), ttl: cacheTTL}
+
+// txDedup remembers the hash returned for each raw transaction for
+// TxDedupWindow, so a client resubmitting the same signed tx after a timeout
+// gets the first answer again instead of a second broadcast.
+var txDedup = &ttlCache{entries: make(map[string]cachedResult), ttl: txDedupWindow}
+
+func cacheTTL(cfg Config) time.Duration {
+	if cfg.CacheTTL > 0 {
+		return time.Duration(cfg.CacheTTL) * time.Millisecond
+	}
+	return defaultCacheTTL
+}
+
+func txDedupKey(hash common.Hash) string {
+	return "tx:" + hash.Hex()
+}
+
+// isResubmission reports whether the upstream already took tx within
+// TxDedupWindow, so its answer is waiting in txDedup.
+func isResubmission(cfg Config, hash common.Hash) bool {
+	if cfg.TxDedupWindow <= 0 {
+		return false
+	}
+	_, ok := txDedup.get(cfg, txDedupKey(hash))
+	return ok
+}
+
+func txDedupWindow(cfg Config) time.Duration {
+	return time.Duration(cfg.TxDedupWindow) * time.Millisecond
+}
+
+func (c *ttlCache) maxReply(cfg Config) int64 { return maxCacheableReplyBytes }
+
+func (c *ttlCache) get(cfg Config, key string) (json.RawMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.result, true
+}
+
+// put stores a result, first dropping expired entries once the cache is
+// full. If it is still full the result simply isn't cached.
+func (c *ttlCache) put(cfg Config, key string, result json.RawMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= maxCachedResponses {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCachedResponses {
+			return
+		}
+	}
+	c.entries[key] = cachedResult{result: result, expires: now.Add(c.ttl(cfg))}
+}
+
+// ----- blocks -----
+
+const (
+	defaultBlockCacheBytes = 64 << 20
+	defaultBlockCacheTTL   = time.Minute
+	// Full blocks with transactions run to megabytes; bigger ones aren't
+	// worth buffering.
+	maxCacheableBlockBytes = 4 << 20
+)
+
+// isFixedBlockQuery reports whether the call names one specific block: by
+// hash, or by a numeric height. Tags like "latest" move and are never cached.
+func isFixedBlockQuery(req *RPCRequest) bool {
+	params := req.positional()
+	if len(params) == 0 {
+		return false
+	}
+	switch req.Method {
+	case "eth_getBlockByHash":
+		return true
+	case "eth_getBlockByNumber":
+		tag, _ := params[0].(string)
+		return strings.HasPrefix(tag, "0x")
+	}
+	return false
+}
+
+type blockEntry struct {
+	key     string
+	result  json.RawMessage
+	expires time.Time
+}
+
+// lruCache evicts the least recently used block once BlockCacheEntries or
+// BlockCacheBytes is exceeded. Entries also expire after BlockCacheTTL, which
+// bounds how long a block replaced by a reorg can be served.
+type lruCache struct {
+	mu    sync.Mutex
+	order *list.List
+	items map[string]*list.Element
+	bytes int64
+}
+
+var blockLRU = &lruCache{order: list.New(), items: make(map[string]*list.Element)}
+
+func blockCacheBytes(cfg Config) int64 {
+	if cfg.BlockCacheBytes > 0 {
+		return cfg.BlockCacheBytes
+	}
+	return defaultBlockCacheBytes
+}
+
+func blockCacheTTL(cfg Config) time.Duration {
+	if cfg.BlockCacheTTL > 0 {
+		return time.Duration(cfg.BlockCacheTTL) * time.Millisecond
+	}
+	return defaultBlockCacheTTL
+}
+
+func (c *lruCache) maxReply(cfg Config) int64 {
+	return min(blockCacheBytes(cfg), maxCacheableBlockBytes)
+}
+
+func (c *lruCache) get(cfg Config, key string) (json.RawMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*blockEntry)
+	if time.Now().After(e.expires) {
+		c.remove(el)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return e.result, true
+}
+
+func (c *lruCache) put(cfg Config, key string, result json.RawMessage) {
+	maxBytes := blockCacheBytes(cfg)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	e := &blockEntry{key: key, result: result, expires: time.Now().Add(blockCacheTTL(cfg))}
+	c.items[key] = c.order.PushFront(e)
+	c.bytes += int64(len(result))
+	for c.order.Len() > cfg.BlockCacheEntries || c.bytes > maxBytes {
+		c.remove(c.order.Back())
+		blockCacheEvictions.Inc()
+	}
+	blockCacheSize.Set(float64(c.bytes))
+}
+
+func (c *lruCache) remove(el *list.Element) {
+	e := c.order.Remove(el).(*blockEntry)
+	delete(c.items, e.key)
+	c.bytes -= int64(len(e.result))
+	blockCacheSize.Set(float64(c.bytes))
+}
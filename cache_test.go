@@ -0,0 +1,231 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// resetCaches empties the response caches before and after the test.
+func resetCaches(t *testing.T) {
+	reset := func() {
+		for _, c := range []*ttlCache{immutableCache, txDedup} {
+			c.mu.Lock()
+			c.entries = make(map[string]cachedResult)
+			c.mu.Unlock()
+		}
+		blockLRU.mu.Lock()
+		blockLRU.order, blockLRU.items, blockLRU.bytes = list.New(), make(map[string]*list.Element), 0
+		blockLRU.mu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestCacheReadsEncodedUpstreamReplies(t *testing.T) {
+	const reply = `{"jsonrpc":"2.0","id":1,"result":"0x539"}`
+	cases := []struct {
+		encoding string
+		body     func(*testing.T, string) []byte
+	}{
+		// The transport asks for gzip and undoes it itself.
+		{"gzip", gzipped},
+		// Deflate it leaves alone, so the guard has to.
+		{"deflate", deflated},
+	}
+	for _, c := range cases {
+		t.Run(c.encoding, func(t *testing.T) {
+			resetLimiters(t)
+			resetCaches(t)
+			var hits atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Content-Encoding", c.encoding)
+				w.Write(c.body(t, reply))
+			}))
+			t.Cleanup(srv.Close)
+			cfg := testConfig(srv.URL)
+			cfg.CacheMethods = []string{"eth_chainId"}
+			useConfig(t, cfg)
+
+			for i := 0; i < 3; i++ {
+				rec := postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+				var r testReply
+				if err := json.Unmarshal(rec.Body.Bytes(), &r); err != nil || string(r.Result) != `"0x539"` {
+					t.Fatalf("call %d: %q (encoding %q)", i, rec.Body, rec.Header().Get("Content-Encoding"))
+				}
+			}
+			if n := hits.Load(); n != 1 {
+				t.Errorf("%d upstream calls, want 1 then cache hits", n)
+			}
+		})
+	}
+}
+
+func TestPassThroughKeepsUpstreamEncoding(t *testing.T) {
+	resetLimiters(t)
+	resetCaches(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "deflate")
+		w.Write(deflated(t, `{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	t.Cleanup(srv.Close)
+	useConfig(t, testConfig(srv.URL))
+
+	rec := postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`)
+	if rec.Header().Get("Content-Encoding") != "deflate" || string(rec.Body.Bytes()) != string(deflated(t, `{"jsonrpc":"2.0","id":1,"result":"0x1"}`)) {
+		t.Errorf("uncached reply not relayed as sent: %q %q", rec.Header().Get("Content-Encoding"), rec.Body)
+	}
+}
+
+func TestTxDedupRetry(t *testing.T) {
+	resetLimiters(t)
+	resetCaches(t)
+	var sent, simulated atomic.Int32
+	cfg := testConfig(rpcUpstream(t, func(method string, _ json.RawMessage) interface{} {
+		switch method {
+		case "eth_call":
+			simulated.Add(1)
+			// Once the tx is in, replaying it reverts.
+			if sent.Load() > 0 {
+				return &RPCError{Code: revertCode, Message: "execution reverted"}
+			}
+			return "0x"
+		case "eth_sendRawTransaction":
+			sent.Add(1)
+			return "0x" + strings.Repeat("ab", 32)
+		}
+		return "0x1"
+	}).URL)
+	cfg.TxDedupWindow = 60_000
+	cfg.PreflightSendRawTx = true
+	// Room for the first copy and one retry.
+	cfg.RateLimits = map[string]RateLimitConfig{"eth_sendRawTransaction": {RatePerSec: 0.001, Burst: 2}}
+	useConfig(t, cfg)
+
+	tx := signedTx(t, gweiTx(21_000, 5))
+	submit := func(id int) (*httptest.ResponseRecorder, testReply) {
+		rec := postRPC(handleRPC, fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"eth_sendRawTransaction","params":["%s"]}`, id, tx))
+		var r testReply
+		json.Unmarshal(rec.Body.Bytes(), &r)
+		return rec, r
+	}
+	var replies []string
+	for id := 1; id <= 2; id++ {
+		rec, r := submit(id)
+		if r.Error != nil || rec.Code != http.StatusOK {
+			t.Fatalf("submission %d: %d %s", id, rec.Code, rec.Body)
+		}
+		replies = append(replies, string(r.Result))
+	}
+	if replies[0] != replies[1] {
+		t.Errorf("retry answered %s, first submission %s", replies[1], replies[0])
+	}
+	// The retry skipped the preflight that would now refuse it.
+	if n, m := sent.Load(), simulated.Load(); n != 1 || m != 1 {
+		t.Errorf("%d forwards and %d preflights, want 1 of each", n, m)
+	}
+
+	// Retries still pay for tokens, so they can't be looped for free.
+	if _, r := submit(3); r.reason() != "rate_limited" {
+		t.Errorf("retry past the limit: %+v", r)
+	}
+	// A sender blocked since the first copy is refused on retry too.
+	resetLimiters(t)
+	cfg.BlockedSenders = []string{crypto.PubkeyToAddress(testKey.PublicKey).Hex()}
+	useConfig(t, cfg)
+	if _, r := submit(4); r.reason() != "blocked_sender" {
+		t.Errorf("retry from a blocked sender: %+v", r)
+	}
+}
+
+// blockKeys lists the block cache from most to least recently used.
+func blockKeys() []string {
+	blockLRU.mu.Lock()
+	defer blockLRU.mu.Unlock()
+	var keys []string
+	for el := blockLRU.order.Front(); el != nil; el = el.Next() {
+		keys = append(keys, el.Value.(*blockEntry).key)
+	}
+	return keys
+}
+
+func TestBlockCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  Config
+	}{
+		{"entries", Config{BlockCacheEntries: 2}},
+		// Room for two 4-byte results, not three.
+		{"bytes", Config{BlockCacheEntries: 10, BlockCacheBytes: 10}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resetCaches(t)
+			evicted := testutil.ToFloat64(blockCacheEvictions)
+			blockLRU.put(c.cfg, "a", json.RawMessage(`"aa"`))
+			blockLRU.put(c.cfg, "b", json.RawMessage(`"bb"`))
+			// Reading a makes b the least recently used.
+			if _, ok := blockLRU.get(c.cfg, "a"); !ok {
+				t.Fatal("a not cached")
+			}
+			blockLRU.put(c.cfg, "c", json.RawMessage(`"cc"`))
+
+			if got := fmt.Sprint(blockKeys()); got != "[c a]" {
+				t.Errorf("cache holds %s, want [c a]", got)
+			}
+			if _, ok := blockLRU.get(c.cfg, "b"); ok {
+				t.Error("evicted block still served")
+			}
+			if got := testutil.ToFloat64(blockCacheEvictions) - evicted; got != 1 {
+				t.Errorf("%v evictions counted, want 1", got)
+			}
+			if got := testutil.ToFloat64(blockCacheSize); got != 8 {
+				t.Errorf("size gauge %v, want 8", got)
+			}
+		})
+	}
+}
+
+func TestBlockCacheSkipsMovingTags(t *testing.T) {
+	resetLimiters(t)
+	resetCaches(t)
+	var hits atomic.Int32
+	cfg := testConfig(rpcUpstream(t, func(string, json.RawMessage) interface{} {
+		hits.Add(1)
+		return map[string]string{"number": "0x10"}
+	}).URL)
+	cfg.BlockCacheEntries = 10
+	useConfig(t, cfg)
+
+	for _, tag := range []string{"latest", "pending"} {
+		hits.Store(0)
+		for i := 0; i < 2; i++ {
+			postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["`+tag+`",false]}`)
+		}
+		if n := hits.Load(); n != 2 {
+			t.Errorf("%s: %d upstream calls, want every call forwarded", tag, n)
+		}
+	}
+	if keys := blockKeys(); len(keys) != 0 {
+		t.Errorf("moving tags cached: %v", keys)
+	}
+
+	hits.Store(0)
+	for i := 0; i < 2; i++ {
+		postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["0x10",false]}`)
+	}
+	if n, keys := hits.Load(), blockKeys(); n != 1 || len(keys) != 1 {
+		t.Errorf("numeric height: %d upstream calls, cached %v", n, keys)
+	}
+}
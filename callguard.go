@@ -0,0 +1,35 @@
+package main
+
+import (
+	"math/big"
+	"strings"
+)
+
+// ===== eth_call GUARDS =====
+
+// checkCall bounds the calldata size and gas of an eth_call. The optional
+// second param (block tag or number) is irrelevant here and ignored, and
+// omitted data/gas fields pass.
+func checkCall(cfg Config, params []interface{}) *rejection {
+	if len(params) == 0 {
+		return nil
+	}
+	call, _ := params[0].(map[string]interface{})
+
+	if cfg.MaxCallDataBytes > 0 {
+		// Geth accepts the calldata under either name.
+		data, _ := call["input"].(string)
+		if data == "" {
+			data, _ = call["data"].(string)
+		}
+		if size := len(strings.TrimPrefix(data, "0x")) / 2; size > cfg.MaxCallDataBytes {
+			return &rejection{"call_too_large", "Call data too large"}
+		}
+	}
+	if cfg.MaxCallGas > 0 {
+		if gas := blockNum(call["gas"]); gas != nil && gas.Cmp(new(big.Int).SetUint64(cfg.MaxCallGas)) > 0 {
+			return &rejection{"call_too_large", "Call gas too high"}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ===== CLIENT IP RESOLUTION =====
+
+// clientIP returns the address rate limits and metrics are keyed on. The
+// X-Forwarded-For header is only honoured when the direct peer is one of
+// TrustedProxies; otherwise anyone could spoof their way into a fresh bucket.
+func clientIP(r *http.Request, cfg Config) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	if len(cfg.TrustedProxies) == 0 {
+		return peer
+	}
+	trusted := cfg.trustedNets
+	if trusted == nil {
+		// A Config that never went through setConfig.
+		trusted = parseNets(cfg.TrustedProxies)
+	}
+	if !ipInNets(net.ParseIP(peer), trusted) {
+		return peer
+	}
+
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	// Walk right to left: each trusted proxy appended the peer it saw, so the
+	// first untrusted entry is the real client.
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHop(hops[i])
+		if ip == nil {
+			return peer
+		}
+		client = ip.String()
+		if !ipInNets(ip, trusted) {
+			break
+		}
+	}
+	return client
+}
+
+// parseHop parses one X-Forwarded-For entry, tolerating an optional port and
+// IPv6 brackets ("[2001:db8::1]:443").
+func parseHop(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return net.ParseIP(host)
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
+
+// parseNets turns CIDRs or bare IPs into networks, skipping invalid entries.
+func parseNets(entries []string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if !strings.Contains(e, "/") {
+			ip := net.ParseIP(e)
+			if ip == nil {
+				continue
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		if _, n, err := net.ParseCIDR(e); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+// validateNets reports each entry of a CIDR/IP list that parseNets would skip.
+func validateNets(field string, entries []string) []error {
+	var errs []error
+	for i, e := range entries {
+		if len(parseNets([]string{e})) == 0 {
+			errs = append(errs, fmt.Errorf("%s[%d]: %q is not an IP or CIDR", field, i, e))
+		}
+	}
+	return errs
+}
+
+// checkDenied refuses callers in DeniedIPs, matched on the resolved client IP.
+func (ex *exchange) checkDenied() *rejection {
+	if ipInNets(net.ParseIP(ex.ip), ex.cfg.deniedNets) {
+		return &rejection{"ip_denied", "Forbidden"}
+	}
+	return nil
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies := []string{"10.0.0.0/8", "2001:db8:ffff::/48", "192.0.2.7"}
+	cases := []struct {
+		name    string
+		trusted []string
+		remote  string
+		xff     []string
+		want    string
+	}{
+		{"no proxies configured", nil, "203.0.113.5:1000", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"untrusted peer spoofing", proxies, "203.0.113.5:1000", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"trusted peer without header", proxies, "10.1.2.3:1000", nil, "10.1.2.3"},
+		{"one hop", proxies, "10.1.2.3:1000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"bare trusted IP", proxies, "192.0.2.7:1000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"multi-hop", proxies, "10.1.2.3:1000", []string{"198.51.100.1, 10.9.9.9, 10.5.5.5"}, "198.51.100.1"},
+		{"client-supplied prefix ignored", proxies, "10.1.2.3:1000", []string{"6.6.6.6, 198.51.100.1, 10.5.5.5"}, "198.51.100.1"},
+		{"split across headers", proxies, "10.1.2.3:1000", []string{"198.51.100.1", "10.5.5.5"}, "198.51.100.1"},
+		{"hop with port", proxies, "10.1.2.3:1000", []string{"198.51.100.1:4711"}, "198.51.100.1"},
+		{"all hops trusted", proxies, "10.1.2.3:1000", []string{"10.7.7.7, 10.5.5.5"}, "10.7.7.7"},
+		{"garbage hop", proxies, "10.1.2.3:1000", []string{"198.51.100.1, not-an-ip"}, "10.1.2.3"},
+		{"IPv6 peer and client", proxies, "[2001:db8:ffff::1]:1000", []string{"2001:db8:1::42"}, "2001:db8:1::42"},
+		{"IPv6 bracketed hop", proxies, "[2001:db8:ffff::1]:1000", []string{"[2001:db8:1::42]:443"}, "2001:db8:1::42"},
+		{"IPv6 multi-hop", proxies, "[2001:db8:ffff::1]:1000", []string{"2001:db8:1::42, 2001:db8:ffff::9"}, "2001:db8:1::42"},
+		{"IPv6 untrusted peer", proxies, "[2001:db8:1::1]:1000", []string{"2001:db8:1::42"}, "2001:db8:1::1"},
+		{"mixed families", proxies, "10.1.2.3:1000", []string{"2001:db8:1::42, 10.5.5.5"}, "2001:db8:1::42"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", nil)
+			r.RemoteAddr = c.remote
+			for _, h := range c.xff {
+				r.Header.Add("X-Forwarded-For", h)
+			}
+			if got := clientIP(r, Config{TrustedProxies: c.trusted}); got != c.want {
+				t.Errorf("clientIP = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseNets(t *testing.T) {
+	nets := parseNets([]string{"10.0.0.0/8", " 192.0.2.7 ", "2001:db8::/32", "::1", "nonsense", "10.0.0.0/99"})
+	if len(nets) != 4 {
+		t.Fatalf("parsed %d networks, want 4", len(nets))
+	}
+	if errs := validateNets("trusted_proxies", []string{"10.0.0.0/8", "nonsense", "10.0.0.0/99"}); len(errs) != 2 {
+		t.Errorf("validateNets: %v, want 2 errors", errs)
+	}
+}
+
+func TestAllowlistBypassesGuards(t *testing.T) {
+	resetLimiters(t)
+	cfg := testConfig(okUpstream(t).URL)
+	cfg.AllowlistedIPs = []string{"10.0.0.0/8", "2001:db8:aaaa::/48", "192.0.2.50"}
+	cfg.TrustedProxies = []string{"172.16.0.1"}
+	cfg.RateLimits = map[string]RateLimitConfig{"eth_chainId": {RatePerSec: 0.001, Burst: 1}}
+	cfg.BlockedMethods = []string{"admin_peers"}
+	cfg.MinGasPriceGwei = 100
+	useConfig(t, cfg)
+	cheapTx := `{"jsonrpc":"2.0","id":1,"method":"eth_sendRawTransaction","params":["` + signedTx(t, gweiTx(21_000, 1)) + `"]}`
+
+	cases := []struct {
+		name   string
+		remote string
+		xff    string
+		bypass bool
+	}{
+		{"inside IPv4 range", "10.20.30.40:1", "", true},
+		{"bare IP", "192.0.2.50:1", "", true},
+		{"inside IPv6 range", "[2001:db8:aaaa::7]:1", "", true},
+		{"outside IPv4 range", "11.0.0.1:1", "", false},
+		{"outside IPv6 range", "[2001:db8:bbbb::7]:1", "", false},
+		// Judged on the resolved client, like the rate limiter.
+		{"allowlisted client behind a proxy", "172.16.0.1:1", "10.1.1.1", true},
+		{"proxy itself isn't allowlisted", "172.16.0.1:1", "11.1.1.1", false},
+		{"spoofed header from untrusted peer", "11.0.0.1:1", "10.1.1.1", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resetLimiters(t)
+			post := func(body string) testReply {
+				req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				req.RemoteAddr = c.remote
+				if c.xff != "" {
+					req.Header.Set("X-Forwarded-For", c.xff)
+				}
+				rec := httptest.NewRecorder()
+				handleRPC(rec, req)
+				var reply testReply
+				json.Unmarshal(rec.Body.Bytes(), &reply)
+				return reply
+			}
+			post(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+			results := []testReply{
+				post(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`),
+				post(`{"jsonrpc":"2.0","id":1,"method":"admin_peers"}`),
+				post(cheapTx),
+			}
+			for i, r := range results {
+				if bypassed := r.Error == nil; bypassed != c.bypass {
+					t.Errorf("call %d: reply %+v, bypass %v", i, r, c.bypass)
+				}
+			}
+		})
+	}
+	// Envelopes are still checked.
+	rec := postRPCFrom(handleRPC, "10.0.0.1:1", `{"jsonrpc":"1.0","id":1,"method":"eth_chainId"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("malformed allowlisted call: status %d, want 400", rec.Code)
+	}
+}
+
+func TestAllowlistedAcceptsLabelled(t *testing.T) {
+	resetLimiters(t)
+	cfg := testConfig(okUpstream(t).URL)
+	cfg.AllowlistedIPs = []string{"10.0.0.0/8"}
+	useConfig(t, cfg)
+	counter := func(ip, allowlisted string) float64 {
+		return testutil.ToFloat64(accepts.WithLabelValues("net_version", metricIP(cfg, ip), allowlisted))
+	}
+	inside, outside := counter("10.0.0.1", "true"), counter("192.0.2.1", "false")
+	postRPCFrom(handleRPC, "10.0.0.1:1", `{"jsonrpc":"2.0","id":1,"method":"net_version"}`)
+	postRPCFrom(handleRPC, "192.0.2.1:1", `{"jsonrpc":"2.0","id":1,"method":"net_version"}`)
+	if counter("10.0.0.1", "true")-inside != 1 || counter("192.0.2.1", "false")-outside != 1 {
+		t.Error("accepts not labelled by allowlisting")
+	}
+}
+
+func TestDenylistRejectsFirst(t *testing.T) {
+	resetLimiters(t)
+	var forwarded atomic.Int32
+	srv := rpcUpstream(t, func(string, json.RawMessage) interface{} {
+		forwarded.Add(1)
+		return "0x1"
+	})
+	cfg := testConfig(srv.URL)
+	cfg.DeniedIPs = []string{"198.51.100.0/24", "2001:db8:dead::/48", "203.0.113.9"}
+	cfg.DefaultRateLimit = &RateLimitConfig{RatePerSec: 0.001, Burst: 1}
+	useConfig(t, cfg)
+	if n := len(getConfig().deniedNets); n != 3 {
+		t.Fatalf("%d denied networks compiled on load, want 3", n)
+	}
+
+	cases := []struct {
+		remote string
+		denied bool
+	}{
+		{"198.51.100.77:1", true},
+		{"203.0.113.9:1", true},
+		{"203.0.113.10:1", false},
+		{"[2001:db8:dead::1]:1", true},
+		{"[2001:db8:beef::1]:1", false},
+	}
+	for _, c := range cases {
+		forwarded.Store(0)
+		// Not even JSON: a denied caller never gets as far as the parser.
+		rec := postRPCFrom(handleRPC, c.remote, `garbage`)
+		var reply testReply
+		json.Unmarshal(rec.Body.Bytes(), &reply)
+		if denied := rec.Code == http.StatusForbidden && reply.reason() == "ip_denied"; denied != c.denied {
+			t.Errorf("%s: %d %s, denied %v", c.remote, rec.Code, rec.Body, c.denied)
+		}
+		if !c.denied {
+			continue
+		}
+		rec = postRPCFrom(handleRPC, c.remote, `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+		if rec.Code != http.StatusForbidden || forwarded.Load() != 0 {
+			t.Errorf("%s: valid call got %d, %d forwarded", c.remote, rec.Code, forwarded.Load())
+		}
+	}
+
+	// Maintenance doesn't mask a ban: the denied caller still gets a 403 and
+	// isn't counted as turned away for maintenance.
+	cfg.MaintenanceMode = true
+	useConfig(t, cfg)
+	before := testutil.ToFloat64(maintenanceRejects)
+	rec := postRPCFrom(handleRPC, "198.51.100.77:1", `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+	var reply testReply
+	json.Unmarshal(rec.Body.Bytes(), &reply)
+	if rec.Code != http.StatusForbidden || reply.reason() != "ip_denied" || rec.Header().Get("Retry-After") != "" {
+		t.Errorf("denied during maintenance: %d %s, Retry-After %q", rec.Code, rec.Body, rec.Header().Get("Retry-After"))
+	}
+	if got := testutil.ToFloat64(maintenanceRejects) - before; got != 0 {
+		t.Errorf("denied call counted %v maintenance rejections", got)
+	}
+	cfg.MaintenanceMode = false
+
+	// Denied calls took no tokens: once undenied, the bucket is still full.
+	cfg.DeniedIPs = nil
+	useConfig(t, cfg)
+	if rec := postRPCFrom(handleRPC, "198.51.100.77:1", `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`); rec.Code != http.StatusOK {
+		t.Errorf("after lifting the ban: %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ===== COMPRESSION =====
+
+var (
+	errBodyTooLarge        = errors.New("decompressed body too large")
+	errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+)
+
+// readBody reads the request body, inflating gzip or deflate bodies so the
+// guards see the JSON. The inflated size is capped at limit as well, so a
+// small compressed body can't expand without bound. Upstream always gets
+// the plain body.
+func readBody(r *http.Request, limit int64) ([]byte, error) {
+	var body io.Reader = r.Body
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return io.ReadAll(body)
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		body = gz
+	case "deflate":
+		zr, err := zlib.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		return nil, errUnsupportedEncoding
+	}
+	b, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return b, nil
+}
+
+// decodeUpstream makes resp.Body plain JSON for callers that parse the
+// reply. The transport already undoes the gzip it asks for itself, so this
+// only acts on encodings it leaves in place, e.g. deflate from an upstream
+// (or a proxy in front of it) compressing unasked. Pass-through relays skip
+// it and forward the encoding instead.
+func decodeUpstream(resp *http.Response) error {
+	var body io.Reader
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		body = gz
+	case "deflate":
+		zr, err := zlib.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		body = zr
+	default:
+		return errUnsupportedEncoding
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	return nil
+}
+
+// withCompression gzips responses for clients that send Accept-Encoding: gzip.
+func withCompression(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsGzip(r) {
+			next(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		next(gw, r)
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			enc, q, _ := strings.Cut(strings.TrimSpace(enc), ";")
+			if strings.EqualFold(strings.TrimSpace(enc), "gzip") && strings.TrimSpace(q) != "q=0" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the body, but only once there is one:
+// bodiless replies such as 204 go out untouched, as do bodies relayed with
+// the upstream's own Content-Encoding.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+	h := g.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if h.Get("Content-Encoding") == "" && code != http.StatusNoContent && code != http.StatusNotModified && code >= 200 {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz == nil {
+		return g.ResponseWriter.Write(b)
+	}
+	return g.gz.Write(b)
+}
+
+func (g *gzipResponseWriter) Close() error {
+	if g.gz == nil {
+		return nil
+	}
+	return g.gz.Close()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(s))
+	gz.Close()
+	return buf.Bytes()
+}
+
+func deflated(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write([]byte(s))
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestCompressedRequests(t *testing.T) {
+	resetLimiters(t)
+	var seen []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		seen = append(seen, r.Header.Get("Content-Encoding")+"|"+string(body))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	t.Cleanup(srv.Close)
+	cfg := testConfig(srv.URL)
+	cfg.BlockedMethods = []string{"admin_peers"}
+	cfg.MaxRequestBytes = 1024
+	useConfig(t, cfg)
+
+	const call = `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`
+	bomb := `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":["` + strings.Repeat("0", 1<<20) + `"]}`
+	cases := []struct {
+		name     string
+		encoding string
+		body     []byte
+		status   int
+		reason   string
+	}{
+		{"gzip", "gzip", gzipped(t, call), http.StatusOK, ""},
+		{"x-gzip", "x-gzip", gzipped(t, call), http.StatusOK, ""},
+		{"deflate", "deflate", deflated(t, call), http.StatusOK, ""},
+		{"identity", "identity", []byte(call), http.StatusOK, ""},
+		// The guards see the inflated method.
+		{"gzip blocked method", "gzip", gzipped(t, `{"jsonrpc":"2.0","id":1,"method":"admin_peers"}`), http.StatusForbidden, "method_blocked"},
+		{"bomb", "gzip", gzipped(t, bomb), http.StatusRequestEntityTooLarge, "request_too_large"},
+		{"corrupt gzip", "gzip", []byte("not gzip at all"), http.StatusBadRequest, ""},
+		{"brotli", "br", []byte(call), http.StatusUnsupportedMediaType, ""},
+	}
+	for _, c := range cases {
+		seen = nil
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(c.body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", c.encoding)
+		rec := httptest.NewRecorder()
+		handleRPC(rec, req)
+		if rec.Code != c.status {
+			t.Errorf("%s: status %d, want %d (%s)", c.name, rec.Code, c.status, rec.Body)
+			continue
+		}
+		if c.reason != "" {
+			var reply testReply
+			json.Unmarshal(rec.Body.Bytes(), &reply)
+			if reply.reason() != c.reason {
+				t.Errorf("%s: reply %s, want reason %s", c.name, rec.Body, c.reason)
+			}
+		}
+		if c.status == http.StatusOK && (len(seen) != 1 || seen[0] != "|"+call) {
+			t.Errorf("%s: upstream got %q, want the plain call", c.name, seen)
+		}
+		if c.status != http.StatusOK && len(seen) != 0 {
+			t.Errorf("%s: refused call reached the upstream", c.name)
+		}
+	}
+}
+
+func TestCompressedResponses(t *testing.T) {
+	resetLimiters(t)
+	useConfig(t, testConfig(okUpstream(t).URL))
+	handler := withCompression(handleRPC)
+	post := func(acceptEncoding, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Content-Type", "application/json")
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+	const call = `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`
+
+	cases := []struct {
+		accept string
+		gzip   bool
+	}{
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"br", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		rec := post(c.accept, call)
+		if got := rec.Header().Get("Content-Encoding") == "gzip"; got != c.gzip {
+			t.Errorf("Accept-Encoding %q: gzip %v, want %v", c.accept, got, c.gzip)
+			continue
+		}
+		body := rec.Body.Bytes()
+		if c.gzip {
+			gz, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatalf("Accept-Encoding %q: %v", c.accept, err)
+			}
+			body, _ = io.ReadAll(gz)
+		}
+		var reply testReply
+		if err := json.Unmarshal(body, &reply); err != nil || string(reply.Result) != `"0x1"` {
+			t.Errorf("Accept-Encoding %q: body %q", c.accept, body)
+		}
+	}
+
+	// A notification's 204 has no body to compress.
+	rec := post("gzip", `{"jsonrpc":"2.0","method":"eth_blockNumber"}`)
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Content-Encoding") != "" || rec.Body.Len() != 0 {
+		t.Errorf("notification: %d %q %q", rec.Code, rec.Header().Get("Content-Encoding"), rec.Body)
+	}
+}
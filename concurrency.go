@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ===== PER-IP CONCURRENCY =====
+
+// inFlight counts open requests per client IP. Entries are deleted as soon
+// as their count drops to zero, so the map only holds currently active IPs.
+var (
+	inFlight     = make(map[string]int)
+	inFlightLock sync.Mutex
+)
+
+var tooManyConcurrent = &rejection{"too_many_concurrent", "Too many concurrent requests"}
+
+// acquireSlot reserves one in-flight slot for ip. It reports false when ip
+// already has max requests open; callers that get true must releaseSlot.
+func acquireSlot(ip string, max int) bool {
+	inFlightLock.Lock()
+	defer inFlightLock.Unlock()
+	if inFlight[ip] >= max {
+		return false
+	}
+	inFlight[ip]++
+	return true
+}
+
+func releaseSlot(ip string) {
+	inFlightLock.Lock()
+	defer inFlightLock.Unlock()
+	if inFlight[ip] <= 1 {
+		delete(inFlight, ip)
+		return
+	}
+	inFlight[ip]--
+}
+
+// ===== UPSTREAM CONCURRENCY =====
+
+// errUpstreamBusy is returned when UpstreamConcurrency calls are already
+// upstream and none finished within QueueTimeout.
+var errUpstreamBusy = errors.New("upstream busy")
+
+// errBusyRejection is how errUpstreamBusy reaches the client.
+var errBusyRejection = &rejection{"upstream_busy", "Upstream busy"}
+
+var (
+	upstreamSlots    chan struct{}
+	upstreamSlotsCap int
+	upstreamSlotLock sync.Mutex
+)
+
+// upstreamSemaphore returns the semaphore sized for cfg, replacing it when a
+// reload changes UpstreamConcurrency. Calls holding a slot of the old one
+// release into it, so a resize never blocks or overfills the new one.
+func upstreamSemaphore(cfg Config) chan struct{} {
+	upstreamSlotLock.Lock()
+	defer upstreamSlotLock.Unlock()
+	if upstreamSlots == nil || upstreamSlotsCap != cfg.UpstreamConcurrency {
+		upstreamSlots = make(chan struct{}, cfg.UpstreamConcurrency)
+		upstreamSlotsCap = cfg.UpstreamConcurrency
+	}
+	return upstreamSlots
+}
+
+// unslottedKey marks a context whose upstream calls skip UpstreamConcurrency.
+type unslottedKey struct{}
+
+// unslotted exempts ctx's upstream calls from UpstreamConcurrency. It is only
+// for the guard's own calls that are shared and bounded anyway (the readiness
+// probe, block tag lookups), which must not wait behind client traffic.
+func unslotted(ctx context.Context) context.Context {
+	return context.WithValue(ctx, unslottedKey{}, true)
+}
+
+// acquireUpstream takes an upstream slot, waiting up to QueueTimeout for one
+// to free up. Without a cap, or for an unslotted ctx, it never waits. The returned release must be
+// called exactly once.
+func acquireUpstream(ctx context.Context, cfg Config) (release func(), err error) {
+	var sem chan struct{}
+	if cfg.UpstreamConcurrency > 0 && ctx.Value(unslottedKey{}) == nil {
+		sem = upstreamSemaphore(cfg)
+		select {
+		case sem <- struct{}{}:
+		default:
+			if err := queueForSlot(ctx, cfg, sem); err != nil {
+				return nil, err
+			}
+		}
+	}
+	upstreamInFlight.Inc()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			upstreamInFlight.Dec()
+			if sem != nil {
+				<-sem
+			}
+		})
+	}, nil
+}
+
+func queueForSlot(ctx context.Context, cfg Config, sem chan struct{}) error {
+	if cfg.QueueTimeout <= 0 {
+		return errUpstreamBusy
+	}
+	timer := time.NewTimer(time.Duration(cfg.QueueTimeout) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errUpstreamBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releaseOnClose frees the upstream slot once the reply has been read.
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.release()
+	return err
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ===== CORS =====
+
+var defaultCORSHeaders = []string{"Content-Type", "X-API-Key"}
+
+// withCORS lets browser dApps on CORSOrigins call the guard directly. It
+// answers preflight OPTIONS requests itself and tags actual responses with
+// the caller's origin. With no origins configured it does nothing at all.
+func withCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := getConfig()
+		if len(cfg.CORSOrigins) == 0 {
+			next(w, r)
+			return
+		}
+		origin := r.Header.Get("Origin")
+		allowed := origin != "" && corsOriginAllowed(cfg, origin)
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if allowed {
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Expose-Headers", "X-Request-ID, Retry-After")
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed {
+				headers := cfg.CORSHeaders
+				if len(headers) == 0 {
+					headers = defaultCORSHeaders
+				}
+				h.Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+				h.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+				h.Set("Access-Control-Max-Age", "600")
+			}
+			// Without the headers above the browser blocks the real call.
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func corsOriginAllowed(cfg Config, origin string) bool {
+	for _, o := range cfg.CORSOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ===== ENVIRONMENT OVERLAY =====
+
+const envPrefix = "RPCGUARD_"
+
+var errUnsupportedEnv = errors.New("setting can only be set in the config file")
+
+var (
+	envWarned   = make(map[string]string)
+	envWarnLock sync.Mutex
+)
+
+// applyEnvOverlay overrides scalar and list settings from the environment,
+// e.g. RPCGUARD_GETH_RPC or RPCGUARD_MIN_GAS_PRICE_GWEI; the variable name is
+// the JSON key upper-cased. Env always wins over the file. Lists are comma
+// separated; maps and nested objects can only be set in the file. A value
+// that doesn't parse is ignored with a warning.
+func applyEnvOverlay(c *Config) {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+		name := envPrefix + strings.ToUpper(key)
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(v.Field(i), raw); err != nil {
+			warnEnvOnce(name, raw, err)
+		}
+	}
+}
+
+func setFromEnv(f reflect.Value, raw string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetUint(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	case reflect.Slice:
+		if f.Type().Elem().Kind() != reflect.String {
+			return errUnsupportedEnv
+		}
+		var items []string
+		for _, s := range strings.Split(raw, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				items = append(items, s)
+			}
+		}
+		f.Set(reflect.ValueOf(items))
+	default:
+		return errUnsupportedEnv
+	}
+	return nil
+}
+
+// warnEnvOnce logs a bad value once rather than on every reload.
+func warnEnvOnce(name, raw string, err error) {
+	envWarnLock.Lock()
+	defer envWarnLock.Unlock()
+	if prev, ok := envWarned[name]; ok && prev == raw {
+		return
+	}
+	envWarned[name] = raw
+	log.Printf("⚠️ Ignoring %s=%q: %v", name, raw, err)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// ===== READ FALLBACK =====
+
+// readOnlyMethods may be retried on FallbackGethRPC: they don't change
+// state, so asking a second node can't cause a double effect. Anything not
+// listed, eth_sendRawTransaction above all, only ever goes to the pool.
+var readOnlyMethods = map[string]bool{
+	"eth_blockNumber":                         true,
+	"eth_call":                                true,
+	"eth_chainId":                             true,
+	"eth_estimateGas":                         true,
+	"eth_feeHistory":                          true,
+	"eth_gasPrice":                            true,
+	"eth_getBalance":                          true,
+	"eth_getBlockByHash":                      true,
+	"eth_getBlockByNumber":                    true,
+	"eth_getBlockTransactionCountByHash":      true,
+	"eth_getBlockTransactionCountByNumber":    true,
+	"eth_getCode":                             true,
+	"eth_getLogs":                             true,
+	"eth_getProof":                            true,
+	"eth_getStorageAt":                        true,
+	"eth_getTransactionByBlockHashAndIndex":   true,
+	"eth_getTransactionByBlockNumberAndIndex": true,
+	"eth_getTransactionByHash":                true,
+	"eth_getTransactionCount":                 true,
+	"eth_getTransactionReceipt":               true,
+	"eth_maxPriorityFeePerGas":                true,
+	"eth_syncing":                             true,
+	"net_version":                             true,
+	"web3_clientVersion":                      true,
+}
+
+// forwardOrFallback forwards body like forwardUpstream, with the deadline
+// MethodTimeouts sets for methods. When that fails and every call in it is
+// read-only, one attempt is made on FallbackGethRPC; if that fails too, the
+// primary's error is returned. A full upstream semaphore is not a failure
+// and is never sent to the fallback.
+//
+// The fallback attempt takes an upstream slot and has its own circuit
+// breaker like a method route, so a failing primary can't pour unbounded
+// traffic onto it.
+func forwardOrFallback(ctx context.Context, cfg Config, methods []string, body []byte, header http.Header) (*http.Response, error) {
+	cfg = withMethodTimeout(cfg, methods)
+	resp, err := forwardUpstream(ctx, cfg, methods, body, header)
+	if err == nil || isClientCancel(err) || errors.Is(err, errUpstreamBusy) || cfg.FallbackGethRPC == "" || !allReadOnly(methods) {
+		return resp, err
+	}
+	label := "batch"
+	if len(methods) == 1 {
+		label = methods[0]
+	}
+	fbResp, fbErr := forwardFallback(ctx, withRoute(cfg, cfg.FallbackGethRPC), body, header)
+	if fbErr != nil {
+		fallbacks.WithLabelValues(label, "error").Inc()
+		return nil, err
+	}
+	fallbacks.WithLabelValues(label, "ok").Inc()
+	return fbResp, nil
+}
+
+// forwardFallback makes the single attempt on cfg's route, the fallback.
+func forwardFallback(ctx context.Context, cfg Config, body []byte, header http.Header) (*http.Response, error) {
+	release, err := acquireUpstream(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	breaker := breakerFor(cfg)
+	if !breaker.allow(cfg) {
+		release()
+		return nil, errCircuitOpen
+	}
+	resp, err := attemptUpstream(ctx, cfg, cfg.route, body, header)
+	if err != nil {
+		release()
+	} else {
+		resp.Body = releaseOnClose{resp.Body, release}
+	}
+	breaker.record(cfg, resp, err)
+	return resp, err
+}
+
+func allReadOnly(methods []string) bool {
+	for _, m := range methods {
+		if !readOnlyMethods[m] {
+			return false
+		}
+	}
+	return len(methods) > 0
+}
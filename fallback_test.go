@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// deadUpstream is a URL nothing listens on, so calls to it are refused.
+func deadUpstream(t *testing.T) string {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	return srv.URL
+}
+
+func TestFallbackTakesUpstreamSlot(t *testing.T) {
+	resetBreakers(t)
+	var hits atomic.Int32
+	arrived, unblock := make(chan struct{}), make(chan struct{})
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			close(arrived)
+			<-unblock
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	t.Cleanup(fallback.Close)
+	cfg := Config{GethRPC: deadUpstream(t), FallbackGethRPC: fallback.URL, LogBlockRangeLimit: 10, UpstreamConcurrency: 1}
+	body := []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`)
+
+	done := make(chan error)
+	go func() {
+		resp, err := forwardOrFallback(context.Background(), cfg, []string{"eth_blockNumber"}, body, nil)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	<-arrived
+	// The only slot is held by the call on the fallback.
+	if _, err := forwardOrFallback(context.Background(), cfg, []string{"eth_blockNumber"}, body, nil); !errors.Is(err, errUpstreamBusy) {
+		t.Errorf("second call got %v, want %v", err, errUpstreamBusy)
+	}
+	close(unblock)
+	if err := <-done; err != nil {
+		t.Errorf("fallback call: %v", err)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("fallback reached %d times, want 1", n)
+	}
+}
+
+func TestFallbackHasItsOwnBreaker(t *testing.T) {
+	resetBreakers(t)
+	var hits atomic.Int32
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	t.Cleanup(fallback.Close)
+	cfg := Config{GethRPC: deadUpstream(t), FallbackGethRPC: fallback.URL, LogBlockRangeLimit: 10, BreakerFailures: 1, BreakerCooldown: 60_000}
+	body := []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`)
+
+	for i := 0; i < 3; i++ {
+		if resp, err := forwardOrFallback(context.Background(), cfg, []string{"eth_blockNumber"}, body, nil); err == nil {
+			resp.Body.Close()
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("fallback reached %d times with its breaker open, want 1", n)
+	}
+	if got := testutil.ToFloat64(breakerState.WithLabelValues(fallback.URL)); got != breakerOpen {
+		t.Errorf("fallback breaker state %v, want open", got)
+	}
+}
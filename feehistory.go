@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math"
+	"math/big"
+)
+
+// ===== eth_feeHistory GUARDS =====
+
+// checkFeeHistory bounds the block count of an eth_feeHistory, the first
+// param. The newest block and the optional reward percentiles that follow
+// don't change the cost much and are left to the node, as is a count that
+// doesn't parse.
+func checkFeeHistory(cfg Config, params []interface{}) *rejection {
+	if cfg.MaxFeeHistoryBlocks == 0 || len(params) == 0 {
+		return nil
+	}
+	count := feeHistoryCount(params[0])
+	if count != nil && count.Cmp(new(big.Int).SetUint64(cfg.MaxFeeHistoryBlocks)) > 0 {
+		return &rejection{"fee_history_range", "Fee history block count too large"}
+	}
+	return nil
+}
+
+// feeHistoryCount reads a block count sent as a hex quantity, a decimal
+// string or a JSON number, as geth accepts all three. nil means unparseable.
+func feeHistoryCount(val interface{}) *big.Int {
+	switch v := val.(type) {
+	case string:
+		if n := blockNum(v); n != nil {
+			return n
+		}
+		n, ok := new(big.Int).SetString(v, 10)
+		if !ok {
+			return nil
+		}
+		return n
+	case float64:
+		if v < 0 || v != math.Trunc(v) {
+			return nil
+		}
+		n, _ := new(big.Float).SetFloat64(v).Int(nil)
+		return n
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCheckFeeHistory(t *testing.T) {
+	cfg := Config{MaxFeeHistoryBlocks: 1024}
+	cases := []struct {
+		name   string
+		params string
+		reason string
+	}{
+		{"hex at the limit", `["0x400","latest"]`, ""},
+		{"hex over the limit", `["0x401","latest"]`, "fee_history_range"},
+		{"uppercase hex", `["0X401","latest"]`, "fee_history_range"},
+		{"decimal at the limit", `["1024","latest"]`, ""},
+		{"decimal over the limit", `["1025","latest"]`, "fee_history_range"},
+		{"number at the limit", `[1024,"latest"]`, ""},
+		{"number over the limit", `[1025,"latest"]`, "fee_history_range"},
+		{"huge hex", `["0xffffffffffffffffffffffff","latest"]`, "fee_history_range"},
+		{"with percentiles", `["0x400","latest",[25,50,75]]`, ""},
+		{"over, with percentiles", `[2048,"0x10",[10.5,90]]`, "fee_history_range"},
+		// Counts the node would refuse anyway are left to it.
+		{"fractional", `[1025.5,"latest"]`, ""},
+		{"negative", `[-1,"latest"]`, ""},
+		{"garbage", `["lots","latest"]`, ""},
+		{"no params", `[]`, ""},
+	}
+	for _, c := range cases {
+		var params []interface{}
+		if err := json.Unmarshal([]byte(c.params), &params); err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if rej := checkFeeHistory(cfg, params); rej != nil {
+			got = rej.reason
+		}
+		if got != c.reason {
+			t.Errorf("%s: reason %q, want %q", c.name, got, c.reason)
+		}
+	}
+	if rej := checkFeeHistory(Config{}, []interface{}{"0xffffff"}); rej != nil {
+		t.Errorf("no limit configured, got %v", rej.reason)
+	}
+}
+
+func TestFeeHistoryLimitEndToEnd(t *testing.T) {
+	resetLimiters(t)
+	cfg := testConfig(okUpstream(t).URL)
+	cfg.MaxFeeHistoryBlocks = 8
+	useConfig(t, cfg)
+	for params, want := range map[string]string{
+		`["0x8","latest",[50]]`: "",
+		`[9,"latest",[50]]`:     "fee_history_range",
+	} {
+		var reply testReply
+		json.Unmarshal(postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"eth_feeHistory","params":`+params+`}`).Body.Bytes(), &reply)
+		if reply.reason() != want {
+			t.Errorf("%s: reason %q, want %q", params, reply.reason(), want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// ===== FORWARDED HEADERS =====
+
+// hopByHopHeaders apply to a single connection and are never passed on,
+// even if listed in ForwardHeaders.
+var hopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+	// Set by the guard itself for every upstream request.
+	"Content-Type", "Content-Length", "Content-Encoding", "Accept-Encoding",
+	"Host", "X-Forwarded-For", "X-Request-ID",
+}
+
+// upstreamHeaders picks the ForwardHeaders allowlist out of the client
+// request and adds X-Forwarded-For with the resolved client IP and the
+// request's X-Request-ID, so upstream logs can be matched to the guard's.
+func upstreamHeaders(r *http.Request, cfg Config, ip, reqID string) http.Header {
+	h := http.Header{}
+	dropped := map[string]bool{}
+	for _, name := range hopByHopHeaders {
+		dropped[http.CanonicalHeaderKey(name)] = true
+	}
+	// Headers named in Connection are hop-by-hop for this request too.
+	for _, v := range r.Header.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			dropped[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+	for _, name := range cfg.ForwardHeaders {
+		key := http.CanonicalHeaderKey(name)
+		if dropped[key] {
+			continue
+		}
+		for _, v := range r.Header.Values(key) {
+			h.Add(key, v)
+		}
+	}
+	if ip != "" {
+		h.Set("X-Forwarded-For", ip)
+	}
+	h.Set("X-Request-ID", reqID)
+	return h
+}
+
+// isJSONContentType reports whether a Content-Type header names a JSON-RPC
+// body; parameters such as charset are ignored.
+func isJSONContentType(ct string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	return mt == "application/json" || mt == "application/json-rpc"
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardHeaders(t *testing.T) {
+	resetLimiters(t)
+	got := make(chan http.Header, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Clone()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	t.Cleanup(srv.Close)
+	cfg := testConfig(srv.URL)
+	cfg.ForwardHeaders = []string{"authorization", "X-Tenant", "Keep-Alive", "X-Dropped-By-Connection"}
+	useConfig(t, cfg)
+
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`))
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer upstream-token")
+	req.Header.Add("X-Tenant", "a")
+	req.Header.Add("X-Tenant", "b")
+	req.Header.Set("X-Secret", "not for the upstream")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Connection", "X-Dropped-By-Connection")
+	req.Header.Set("X-Dropped-By-Connection", "1")
+	req.Header.Set("X-Forwarded-For", "6.6.6.6")
+	handleRPC(httptest.NewRecorder(), req)
+
+	h := <-got
+	cases := []struct {
+		name string
+		want []string
+	}{
+		{"Authorization", []string{"Bearer upstream-token"}},
+		{"X-Tenant", []string{"a", "b"}},
+		{"X-Secret", nil},
+		{"Keep-Alive", nil},
+		{"X-Dropped-By-Connection", nil},
+		// The resolved client, not what the client claimed.
+		{"X-Forwarded-For", []string{"192.0.2.1"}},
+	}
+	for _, c := range cases {
+		vals := h.Values(c.name)
+		if len(vals) != len(c.want) {
+			t.Errorf("%s: %q, want %q", c.name, vals, c.want)
+			continue
+		}
+		for i := range vals {
+			if vals[i] != c.want[i] {
+				t.Errorf("%s: %q, want %q", c.name, vals, c.want)
+			}
+		}
+	}
+	if h.Get("X-Request-ID") == "" {
+		t.Error("no X-Request-ID sent upstream")
+	}
+}
+
+func TestRequireJSONContentType(t *testing.T) {
+	resetLimiters(t)
+	upstream := okUpstream(t).URL
+	cases := []struct {
+		contentType string
+		strict      bool
+		status      int
+	}{
+		{"application/json", true, http.StatusOK},
+		{"application/json; charset=utf-8", true, http.StatusOK},
+		{"Application/JSON", true, http.StatusOK},
+		{"application/json-rpc", true, http.StatusOK},
+		{"", true, http.StatusUnsupportedMediaType},
+		{"application/x-www-form-urlencoded", true, http.StatusUnsupportedMediaType},
+		{"text/plain", true, http.StatusUnsupportedMediaType},
+		{"application/json;;", true, http.StatusUnsupportedMediaType},
+		// Without the flag anything parseable goes.
+		{"", false, http.StatusOK},
+		{"text/plain", false, http.StatusOK},
+	}
+	for _, c := range cases {
+		cfg := testConfig(upstream)
+		cfg.RequireJSONType = c.strict
+		useConfig(t, cfg)
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`))
+		req.RemoteAddr = "192.0.2.1:1234"
+		if c.contentType != "" {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+		rec := httptest.NewRecorder()
+		handleRPC(rec, req)
+		if rec.Code != c.status {
+			t.Errorf("Content-Type %q (strict %v): status %d, want %d", c.contentType, c.strict, rec.Code, c.status)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ===== HEALTH PROBES =====
+
+const defaultReadyCacheTTL = 2 * time.Second
+
+var (
+	readyLock    sync.Mutex
+	readyChecked time.Time
+	readyErr     error
+)
+
+// handleHealthz is the liveness probe: the process is up and serving. A
+// missing config (-allow-missing-config) is no reason to restart the process,
+// so it still answers 200 and only says so in the body; /readyz takes the
+// guard out of rotation instead.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if getConfig().unconfigured {
+		w.Write([]byte("ok, not configured\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz is the readiness probe. It reports 503 while the upstream
+// can't answer eth_blockNumber, or while there is no config.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	cfg := getConfig()
+	if cfg.unconfigured {
+		http.Error(w, "not configured", http.StatusServiceUnavailable)
+		return
+	}
+	if err := upstreamReady(cfg); err != nil {
+		http.Error(w, "upstream unavailable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// upstreamReady returns the cached result of the last upstream probe,
+// refreshing it once ReadyCacheTTL has passed. Holding the lock across the
+// probe means concurrent kubelet checks share one upstream call.
+func upstreamReady(cfg Config) error {
+	ttl := defaultReadyCacheTTL
+	if cfg.ReadyCacheTTL > 0 {
+		ttl = time.Duration(cfg.ReadyCacheTTL) * time.Millisecond
+	}
+
+	readyLock.Lock()
+	defer readyLock.Unlock()
+	if !readyChecked.IsZero() && time.Since(readyChecked) < ttl {
+		return readyErr
+	}
+	readyErr = probeUpstream(cfg)
+	readyChecked = time.Now()
+	return readyErr
+}
+
+func probeUpstream(cfg Config) error {
+	_, err := callUnslotted(cfg, "eth_blockNumber")
+	return err
+}
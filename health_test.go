@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetReady drops the cached readiness probe result.
+func resetReady(t *testing.T) {
+	readyLock.Lock()
+	readyChecked = time.Time{}
+	readyLock.Unlock()
+	t.Cleanup(func() {
+		readyLock.Lock()
+		readyChecked = time.Time{}
+		readyLock.Unlock()
+	})
+}
+
+func TestHealthProbes(t *testing.T) {
+	up := rpcUpstream(t, func(string, json.RawMessage) interface{} { return "0x1" })
+	down := rpcUpstream(t, func(string, json.RawMessage) interface{} { return nil })
+	down.Close()
+
+	cases := []struct {
+		name      string
+		cfg       Config
+		healthz   int
+		readyz    int
+		readyBody string
+	}{
+		{"serving", testConfig(up.URL), http.StatusOK, http.StatusOK, "ok"},
+		{"upstream down", testConfig(down.URL), http.StatusOK, http.StatusServiceUnavailable, "upstream unavailable"},
+		{"not configured", Config{unconfigured: true}, http.StatusOK, http.StatusServiceUnavailable, "not configured"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			useConfig(t, c.cfg)
+			resetReady(t)
+
+			rec := httptest.NewRecorder()
+			handleHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if rec.Code != c.healthz {
+				t.Errorf("/healthz: status %d, want %d", rec.Code, c.healthz)
+			}
+			if c.cfg.unconfigured && !strings.Contains(rec.Body.String(), "not configured") {
+				t.Errorf("/healthz body %q doesn't report the missing config", rec.Body.String())
+			}
+
+			rec = httptest.NewRecorder()
+			handleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != c.readyz || !strings.Contains(rec.Body.String(), c.readyBody) {
+				t.Errorf("/readyz: %d %q, want %d %q", rec.Code, rec.Body.String(), c.readyz, c.readyBody)
+			}
+		})
+	}
+}
+
+func TestReadyWhileUpstreamSlotsFull(t *testing.T) {
+	resetLimiters(t)
+	resetReady(t)
+	resetHead(t)
+	cfg := testConfig(rpcUpstream(t, func(string, json.RawMessage) interface{} { return "0x1000" }).URL)
+	cfg.UpstreamConcurrency = 2
+	useConfig(t, cfg)
+	for i := 0; i < cfg.UpstreamConcurrency; i++ {
+		release, err := acquireUpstream(context.Background(), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(release)
+	}
+
+	// Client traffic finds the pool full...
+	var reply testReply
+	json.Unmarshal(postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`).Body.Bytes(), &reply)
+	if reply.reason() != "upstream_busy" {
+		t.Fatalf("client call got %q, want upstream_busy", reply.reason())
+	}
+	// ...but the guard's own probe and head lookup still get through.
+	rec := httptest.NewRecorder()
+	handleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("/readyz: %d %q with the upstream pool full, want 200", rec.Code, rec.Body.String())
+	}
+	if _, err := headBlock(cfg); err != nil {
+		t.Errorf("head lookup with the upstream pool full: %v", err)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestRateLimiterHourOnFakeClock offers calls far faster than the limit for a
+// simulated hour and checks the bucket admitted rate*seconds+burst, give or
+// take the one token a partly refilled bucket can't hand out yet.
+func TestRateLimiterHourOnFakeClock(t *testing.T) {
+	cases := []struct {
+		name  string
+		rate  float64
+		burst int
+		step  time.Duration
+	}{
+		{"10/s every 5ms", 10, 20, 5 * time.Millisecond},
+		{"0.5/s every 13ms", 0.5, 1, 13 * time.Millisecond},
+		{"33.3/s every 7ms", 33.3, 50, 7 * time.Millisecond},
+		// Each call refills 0.1 token, and ten of those sum to just under 1.
+		{"10/s every 10ms, burst 1", 10, 1, 10 * time.Millisecond},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rl := newRateLimiter(RateLimitConfig{RatePerSec: c.rate, Burst: c.burst})
+			start := time.Unix(1_700_000_000, 0)
+			rl.last = start
+			end := start.Add(time.Hour)
+
+			admitted, last := 0, start
+			for now := start; !now.After(end); now = now.Add(c.step) {
+				if rl.allowAt(now, 1) {
+					admitted++
+				}
+				last = now
+			}
+			want := c.rate*last.Sub(start).Seconds() + float64(c.burst)
+			if got := float64(admitted); got > want+tokenSlack || got < math.Floor(want)-1 {
+				t.Errorf("admitted %d in an hour, want %.3f (at most one fewer)", admitted, want)
+			}
+		})
+	}
+}
+
+// ageLimiter makes key's bucket look last used at when.
+func ageLimiter(key string, when time.Time) {
+	limiterLock.Lock()
+	defer limiterLock.Unlock()
+	rl := ipLimiters[key].(*rateLimiter)
+	rl.mutex.Lock()
+	rl.last = when
+	rl.mutex.Unlock()
+}
+
+func limiterKeys() map[string]bool {
+	limiterLock.Lock()
+	defer limiterLock.Unlock()
+	keys := make(map[string]bool, len(ipLimiters))
+	for k := range ipLimiters {
+		keys[k] = true
+	}
+	return keys
+}
+
+func TestEvictIdleLimiters(t *testing.T) {
+	resetLimiters(t)
+	cfg := Config{}
+	conf := RateLimitConfig{RatePerSec: 1, Burst: 5}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		getLimiter(cfg, ip, "eth_call", conf)
+	}
+	now := time.Now()
+	ageLimiter("192.0.2.1:eth_call", now.Add(-time.Hour))
+	ageLimiter("192.0.2.2:eth_call", now.Add(-11*time.Minute))
+
+	if n := evictIdleLimiters(now, defaultLimiterTTL); n != 2 {
+		t.Errorf("evicted %d, want 2", n)
+	}
+	keys := limiterKeys()
+	if len(keys) != 1 || !keys["192.0.2.3:eth_call"] {
+		t.Errorf("left %v, want only the recent bucket", keys)
+	}
+	// A bucket in use again moves back out of reach of the sweep.
+	getLimiter(cfg, "192.0.2.3", "eth_call", conf).allowN(1)
+	if n := evictIdleLimiters(now, defaultLimiterTTL); n != 0 {
+		t.Errorf("evicted %d active buckets", n)
+	}
+}
+
+func TestEvictIdleLimitersKeepsRefillingBuckets(t *testing.T) {
+	resetLimiters(t)
+	// Refilling 100 tokens at 0.01/s takes far longer than the TTL.
+	lim := getLimiter(Config{}, "192.0.2.1", "eth_call", RateLimitConfig{RatePerSec: 0.01, Burst: 100})
+	for lim.allowN(1) {
+	}
+	now := time.Now()
+	ageLimiter("192.0.2.1:eth_call", now.Add(-11*time.Minute))
+	if n := evictIdleLimiters(now, defaultLimiterTTL); n != 0 {
+		t.Fatalf("evicted %d drained buckets", n)
+	}
+	// Once the bucket would have refilled, dropping it changes nothing.
+	if n := evictIdleLimiters(now.Add(3*time.Hour), defaultLimiterTTL); n != 1 {
+		t.Errorf("evicted %d refilled buckets, want 1", n)
+	}
+}
+
+func TestSweepLimitersRunsOnConfiguredInterval(t *testing.T) {
+	resetLimiters(t)
+	useConfig(t, Config{GethRPC: "http://127.0.0.1:1", LogBlockRangeLimit: 10, LimiterTTL: 1000, LimiterSweepEvery: 5})
+	getLimiter(getConfig(), "192.0.2.1", "eth_call", RateLimitConfig{RatePerSec: 1, Burst: 1})
+	getLimiter(getConfig(), "192.0.2.2", "eth_call", RateLimitConfig{RatePerSec: 1, Burst: 1})
+	ageLimiter("192.0.2.1:eth_call", time.Now().Add(-2*time.Second))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		sweepLimiters(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for limiterKeys()["192.0.2.1:eth_call"] {
+		if time.Now().After(deadline) {
+			t.Fatal("idle bucket never swept")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !limiterKeys()["192.0.2.2:eth_call"] {
+		t.Error("bucket used within the TTL was swept")
+	}
+}
+
+func TestAllowFractionalCost(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	rl := newRateLimiter(RateLimitConfig{RatePerSec: 1, Burst: 2})
+	rl.last = start
+	steps := []struct {
+		at   time.Duration
+		cost float64
+		ok   bool
+		left float64
+	}{
+		{0, 0.5, true, 1.5},
+		{0, 0.75, true, 0.75},
+		{0, 1, false, 0.75},
+		{0, 0.75, true, 0},
+		{250 * time.Millisecond, 0.3, false, 0.25},
+		{500 * time.Millisecond, 0.3, true, 0.2},
+		// More than the burst can ever hold never passes.
+		{time.Hour, 2.5, false, 2},
+		{time.Hour, 2, true, 0},
+	}
+	for i, s := range steps {
+		if ok := rl.allowAt(start.Add(s.at), s.cost); ok != s.ok {
+			t.Errorf("step %d: allowed %v, want %v", i, ok, s.ok)
+		}
+		if left := rl.remaining(); math.Abs(left-s.left) > 1e-9 {
+			t.Errorf("step %d: %.3f tokens left, want %.3f", i, left, s.left)
+		}
+	}
+}
+
+func TestMethodCostsDeductFromBucket(t *testing.T) {
+	resetLimiters(t)
+	cfg := testConfig(okUpstream(t).URL)
+	// A burst of 10 holds one cost-10 call, or twenty half-cost ones.
+	cfg.DefaultRateLimit = &RateLimitConfig{RatePerSec: 0.001, Burst: 10}
+	cfg.MethodCosts = map[string]float64{"eth_estimateGas": 10, "eth_chainId": 0.5}
+	useConfig(t, cfg)
+	call := func(method string) string {
+		var reply testReply
+		json.Unmarshal(postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"`+method+`"}`).Body.Bytes(), &reply)
+		return reply.reason()
+	}
+	if call("eth_estimateGas") != "" || call("eth_estimateGas") != "rate_limited" {
+		t.Error("a cost-10 call should take the whole burst of 10")
+	}
+
+	resetLimiters(t)
+	for i := 0; i < 20; i++ {
+		if r := call("eth_chainId"); r != "" {
+			t.Fatalf("half-cost call %d refused: %s", i, r)
+		}
+	}
+	if call("eth_chainId") != "rate_limited" {
+		t.Error("21st half-cost call allowed past a burst of 10")
+	}
+	if methodCost(cfg, "net_version") != 1 {
+		t.Error("unlisted methods should cost 1")
+	}
+}
+
+func TestReloadRetunesExistingBucket(t *testing.T) {
+	resetLimiters(t)
+	cfg := testConfig(okUpstream(t).URL)
+	call := func() bool {
+		var reply testReply
+		json.Unmarshal(postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`).Body.Bytes(), &reply)
+		return reply.reason() == ""
+	}
+	// admitted counts how many calls pass before the first refusal.
+	admitted := func() int {
+		n := 0
+		for ; n < 50 && call(); n++ {
+		}
+		return n
+	}
+	reload := func(burst int) *rateLimiter {
+		cfg.RateLimits = map[string]RateLimitConfig{"eth_chainId": {RatePerSec: 0.001, Burst: burst}}
+		useConfig(t, cfg)
+		return getLimiter(cfg, "192.0.2.1", "eth_chainId", cfg.RateLimits["eth_chainId"]).(*rateLimiter)
+	}
+
+	bucket := reload(10)
+	for i := 0; i < 2; i++ {
+		call()
+	}
+	// Tightening caps what the active client has left at the new burst.
+	if reload(3) != bucket {
+		t.Fatal("reload replaced the bucket")
+	}
+	if n := admitted(); n != 3 {
+		t.Errorf("after lowering the burst to 3, admitted %d, want 3", n)
+	}
+	// Loosening doesn't hand out a fresh bucket: it is still empty.
+	reload(20)
+	if n := admitted(); n != 0 {
+		t.Errorf("after raising the burst, admitted %d from an empty bucket, want 0", n)
+	}
+	// A faster rate applies to the refill from now on.
+	cfg.RateLimits = map[string]RateLimitConfig{"eth_chainId": {RatePerSec: 1000, Burst: 20}}
+	useConfig(t, cfg)
+	call()
+	time.Sleep(30 * time.Millisecond)
+	if n := admitted(); n < 20 {
+		t.Errorf("after raising the rate, admitted %d, want the full burst of 20", n)
+	}
+}
+
+// limiterOrder lists the bucket keys from most to least recently used.
+func limiterOrder() []string {
+	limiterLock.Lock()
+	defer limiterLock.Unlock()
+	var keys []string
+	for e := limiterLRU.Front(); e != nil; e = e.Next() {
+		keys = append(keys, e.Value.(string))
+	}
+	return keys
+}
+
+func TestMaxLimiterEntriesEvictsLeastRecentlyUsed(t *testing.T) {
+	resetLimiters(t)
+	cfg := Config{MaxLimiterEntries: 3}
+	conf := RateLimitConfig{RatePerSec: 1, Burst: 5}
+	evicted := testutil.ToFloat64(limiterEvictions)
+	use := func(ip string) { getLimiter(cfg, ip, "eth_call", conf) }
+
+	steps := []struct {
+		use  string
+		want []string
+	}{
+		{"192.0.2.1", []string{"192.0.2.1"}},
+		{"192.0.2.2", []string{"192.0.2.2", "192.0.2.1"}},
+		{"192.0.2.3", []string{"192.0.2.3", "192.0.2.2", "192.0.2.1"}},
+		// Using .1 again saves it; .2 is now the stalest.
+		{"192.0.2.1", []string{"192.0.2.1", "192.0.2.3", "192.0.2.2"}},
+		{"192.0.2.4", []string{"192.0.2.4", "192.0.2.1", "192.0.2.3"}},
+		{"192.0.2.5", []string{"192.0.2.5", "192.0.2.4", "192.0.2.1"}},
+		{"192.0.2.4", []string{"192.0.2.4", "192.0.2.5", "192.0.2.1"}},
+		{"192.0.2.2", []string{"192.0.2.2", "192.0.2.4", "192.0.2.5"}},
+	}
+	for i, s := range steps {
+		use(s.use)
+		var want []string
+		for _, ip := range s.want {
+			want = append(want, ip+":eth_call")
+		}
+		if got := limiterOrder(); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("step %d (%s): order %v, want %v", i, s.use, got, want)
+		}
+		if keys := limiterKeys(); len(keys) != len(want) {
+			t.Errorf("step %d: %d buckets for %d LRU entries", i, len(keys), len(want))
+		}
+	}
+	if got := testutil.ToFloat64(limiterEvictions) - evicted; got != 3 {
+		t.Errorf("%v evictions counted, want 3", got)
+	}
+
+	// Lowering the cap on reload trims the table on the next new bucket.
+	cfg.MaxLimiterEntries = 1
+	use("192.0.2.9")
+	if got := limiterOrder(); len(got) != 1 || got[0] != "192.0.2.9:eth_call" {
+		t.Errorf("after lowering the cap to 1: %v", got)
+	}
+	// Idle eviction keeps the LRU list in step with the table.
+	if n := evictIdleLimiters(time.Now().Add(time.Hour), time.Minute); n != 1 || len(limiterOrder()) != 0 {
+		t.Errorf("idle sweep evicted %d and left %v", n, limiterOrder())
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// ===== eth_getLogs RESULT ESTIMATE =====
+
+const (
+	logEstimateHeuristic = "heuristic"
+	logEstimateProbe     = "probe"
+
+	defaultAddressShare = 0.01
+	defaultTopicShare   = 0.1
+	defaultProbeBlocks  = 10
+)
+
+// LogEstimateConfig (log_result_estimate) refuses eth_getLogs calls expected
+// to return more than MaxResults logs. Nothing short of running the query
+// knows the real count, so this is a best-effort guess: it stops the obvious
+// firehoses and can be wrong both ways.
+type LogEstimateConfig struct {
+	MaxResults int64 `json:"max_results"`
+	// Mode is "heuristic" (the default), which guesses from the filter
+	// alone, or "probe", which runs the filter over the last ProbeBlocks
+	// blocks of the range and scales the count up.
+	Mode string `json:"mode"`
+	// LogsPerBlock is the chain's average logs per block; heuristic only.
+	LogsPerBlock float64 `json:"logs_per_block"`
+	// AddressShare is the fraction of a block's logs one address is taken
+	// to emit, unless HotAddresses gives it its own.
+	AddressShare float64            `json:"address_share"`
+	HotAddresses map[string]float64 `json:"hot_addresses"`
+	// TopicShare is the fraction of logs one topic value is taken to
+	// match at its position.
+	TopicShare  float64 `json:"topic_share"`
+	ProbeBlocks int64   `json:"probe_blocks"`
+}
+
+func validateLogEstimate(e *LogEstimateConfig) []error {
+	var errs []error
+	if e.MaxResults < 0 {
+		errs = append(errs, fmt.Errorf("log_result_estimate.max_results: must not be negative"))
+	}
+	switch e.Mode {
+	case "", logEstimateHeuristic:
+		if e.MaxResults > 0 && e.LogsPerBlock <= 0 {
+			errs = append(errs, fmt.Errorf("log_result_estimate.logs_per_block: must be positive in heuristic mode"))
+		}
+	case logEstimateProbe:
+	default:
+		errs = append(errs, fmt.Errorf("log_result_estimate.mode: %q is not %q or %q", e.Mode, logEstimateHeuristic, logEstimateProbe))
+	}
+	if e.AddressShare < 0 || e.AddressShare > 1 {
+		errs = append(errs, fmt.Errorf("log_result_estimate.address_share: must be between 0 and 1"))
+	}
+	if e.TopicShare < 0 || e.TopicShare > 1 {
+		errs = append(errs, fmt.Errorf("log_result_estimate.topic_share: must be between 0 and 1"))
+	}
+	for addr, share := range e.HotAddresses {
+		if share < 0 || share > 1 {
+			errs = append(errs, fmt.Errorf("log_result_estimate.hot_addresses[%q]: must be between 0 and 1", addr))
+		}
+	}
+	if e.ProbeBlocks < 0 {
+		errs = append(errs, fmt.Errorf("log_result_estimate.probe_blocks: must not be negative"))
+	}
+	return errs
+}
+
+// checkLogEstimate refuses filter when its estimated result count exceeds
+// MaxResults. from and to are the resolved bounds, nil for a blockHash
+// filter.
+func checkLogEstimate(cfg Config, filter map[string]interface{}, from, to *big.Int) *rejection {
+	e := cfg.LogResultEstimate
+	if e == nil || e.MaxResults == 0 {
+		return nil
+	}
+	blocks := int64(1)
+	if from != nil {
+		blocks = new(big.Int).Sub(to, from).Int64() + 1
+	}
+
+	var estimate float64
+	if e.Mode == logEstimateProbe {
+		n, ok := probeLogCount(cfg, e, filter, to, blocks)
+		if !ok {
+			return nil
+		}
+		estimate = n
+	} else {
+		estimate = float64(blocks) * e.LogsPerBlock * addressShare(e, filter["address"]) * topicShare(e, filter["topics"])
+	}
+	if estimate > float64(e.MaxResults) {
+		return &rejection{"log_result_too_large", fmt.Sprintf("Log query expected to return about %.0f logs, more than %d", estimate, e.MaxResults)}
+	}
+	return nil
+}
+
+// addressShare is the fraction of logs an address filter lets through: the
+// share of each address summed, or all of them without a filter.
+func addressShare(e *LogEstimateConfig, v interface{}) float64 {
+	var addrs []interface{}
+	switch a := v.(type) {
+	case string:
+		addrs = []interface{}{a}
+	case []interface{}:
+		addrs = a
+	}
+	if len(addrs) == 0 {
+		return 1
+	}
+	share := 0.0
+	for _, a := range addrs {
+		s, _ := a.(string)
+		if hot, ok := lookupHotAddress(e, s); ok {
+			share += hot
+		} else {
+			share += orDefault(e.AddressShare, defaultAddressShare)
+		}
+	}
+	return minF(share, 1)
+}
+
+func lookupHotAddress(e *LogEstimateConfig, addr string) (float64, bool) {
+	for hot, share := range e.HotAddresses {
+		if strings.EqualFold(hot, addr) {
+			return share, true
+		}
+	}
+	return 0, false
+}
+
+// topicShare multiplies the share each constrained topic position lets
+// through; a position with n alternatives passes n times TopicShare.
+func topicShare(e *LogEstimateConfig, v interface{}) float64 {
+	per := orDefault(e.TopicShare, defaultTopicShare)
+	positions, _ := v.([]interface{})
+	share := 1.0
+	for _, pos := range positions {
+		switch t := pos.(type) {
+		case string:
+			share *= per
+		case []interface{}:
+			if len(t) > 0 {
+				share *= minF(float64(len(t))*per, 1)
+			}
+		}
+	}
+	return share
+}
+
+// probeLogCount runs filter over the last ProbeBlocks blocks of the range
+// and scales the count to the whole range. It reports false when there is
+// nothing to gain (the range is no wider than the probe) or the probe
+// failed; the call then goes ahead unestimated.
+func probeLogCount(cfg Config, e *LogEstimateConfig, filter map[string]interface{}, to *big.Int, blocks int64) (float64, bool) {
+	probe := e.ProbeBlocks
+	if probe == 0 {
+		probe = defaultProbeBlocks
+	}
+	if filter["blockHash"] != nil || blocks <= probe {
+		return 0, false
+	}
+	sample := make(map[string]interface{}, len(filter))
+	for k, v := range filter {
+		sample[k] = v
+	}
+	sample["fromBlock"] = "0x" + new(big.Int).Sub(to, big.NewInt(probe-1)).Text(16)
+	sample["toBlock"] = "0x" + to.Text(16)
+
+	raw, err := callUpstream(cfg, "eth_getLogs", sample)
+	if err != nil {
+		return 0, false
+	}
+	var logs []json.RawMessage
+	if err := json.Unmarshal(raw, &logs); err != nil {
+		return 0, false
+	}
+	return float64(len(logs)) * float64(blocks) / float64(probe), true
+}
+
+func orDefault(v, def float64) float64 {
+	if v > 0 {
+		return v
+	}
+	return def
+}
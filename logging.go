@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ===== STRUCTURED LOGGING =====
+
+// logLevel is swapped on config reload so LogLevel changes apply live.
+var logLevel = new(slog.LevelVar)
+
+// initLogging installs a JSON slog handler as the default. The standard log
+// package is routed through it too, so every line is machine-parseable.
+func initLogging() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	err := l.UnmarshalText([]byte(s))
+	return l, err
+}
+
+const maxRequestIDLen = 128
+
+// requestID keeps the client's X-Request-ID so its own logs line up with
+// ours and the upstream's, unless it is too long or holds anything but
+// visible ASCII; then, or without one, a fresh ID is made.
+func requestID(r *http.Request) string {
+	id := r.Header.Get("X-Request-ID")
+	if id == "" || len(id) > maxRequestIDLen {
+		return newRequestID()
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return newRequestID()
+		}
+	}
+	return id
+}
+
+// newRequestID returns 128 random bits in hex, unique across replicas
+// without any coordination between them.
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// logDecision emits one line per JSON-RPC call. latency is the upstream round
+// trip and is omitted for calls that were never forwarded.
+func (ex *exchange) logDecision(method, decision, reason string, latency time.Duration, err error) {
+	attrs := []any{
+		slog.String("request_id", ex.reqID),
+		slog.String("method", method),
+		slog.String("ip", ex.ip),
+		slog.String("tier", ex.tierLabel()),
+		slog.String("decision", decision),
+	}
+	if reason != "" {
+		attrs = append(attrs, slog.String("reason", reason))
+	}
+	if latency > 0 {
+		attrs = append(attrs, slog.Float64("upstream_ms", float64(latency.Microseconds())/1000))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	slog.Info("rpc", attrs...)
+	traceDecision(ex.ctx, method, decision, reason)
+	// A shadow-mode would_reject is followed by the call's real decision.
+	if decision != "would_reject" {
+		ex.access.note(method, decision, reason)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// ===== eth_getLogs GUARDS =====
+
+func checkGetLogs(cfg Config, params []interface{}) *rejection {
+	if len(params) == 0 {
+		return nil
+	}
+	filter, _ := params[0].(map[string]interface{})
+	// A blockHash filter covers that one block and ignores the bounds.
+	var from, to *big.Int
+	if filter["blockHash"] == nil {
+		var rej *rejection
+		if from, rej = logBlock(cfg, "fromBlock", filter["fromBlock"]); rej != nil {
+			return rej
+		}
+		if to, rej = logBlock(cfg, "toBlock", filter["toBlock"]); rej != nil {
+			return rej
+		}
+		if to.Cmp(from) < 0 {
+			return &rejection{"invalid_block_range", "toBlock is before fromBlock"}
+		}
+		// Subtract into a fresh value so the resolved bounds stay intact.
+		if new(big.Int).Sub(to, from).Cmp(big.NewInt(cfg.LogBlockRangeLimit)) > 0 {
+			return &rejection{"log_range", "Log range too wide"}
+		}
+	}
+
+	if cfg.MaxLogAddresses > 0 && countAddresses(filter["address"]) > cfg.MaxLogAddresses {
+		return &rejection{"log_filter_too_complex", "Too many log filter addresses"}
+	}
+	if cfg.MaxLogTopics > 0 && countTopics(filter["topics"]) > cfg.MaxLogTopics {
+		return &rejection{"log_filter_too_complex", "Too many log filter topics"}
+	}
+	return checkLogEstimate(cfg, filter, from, to)
+}
+
+// logBlock resolves the filter bound name to a block number. Besides hex
+// numbers it accepts the named tags: "earliest" is block 0, "latest" the
+// current head, and "safe" and "finalized" the blocks the node reports for
+// them, which trail the head by tens of blocks. "pending" is the head as a
+// fromBlock and the block after it as a toBlock, so it never understates how
+// far a range reaches. An omitted bound is "latest", as in geth. A bound that
+// can't be resolved refuses the call, so the range limit can't be skipped.
+func logBlock(cfg Config, name string, val interface{}) (*big.Int, *rejection) {
+	var tag string
+	switch val {
+	case "earliest":
+		return big.NewInt(0), nil
+	case nil, "latest", "pending":
+		tag = "latest"
+	case "safe", "finalized":
+		tag = val.(string)
+	default:
+		if n := blockNum(val); n != nil {
+			return n, nil
+		}
+		return nil, &rejection{"invalid_block_range", name + " is not a block number or tag"}
+	}
+	n, err := taggedBlock(cfg, tag)
+	if err != nil {
+		return nil, &rejection{"block_range_unknown", "Block " + tag + " unavailable, can't check log range"}
+	}
+	if val == "pending" && name == "toBlock" {
+		n.Add(n, big.NewInt(1))
+	}
+	return n, nil
+}
+
+const headCacheTTL = time.Second
+
+type taggedNum struct {
+	num     *big.Int
+	checked time.Time
+}
+
+// tagBlocks caches what each tag last resolved to; tagLookups lets callers
+// that miss the cache share one upstream call.
+var (
+	headLock   sync.Mutex
+	tagBlocks  = make(map[string]taggedNum)
+	tagLookups singleflight.Group
+)
+
+// headBlock returns the upstream's eth_blockNumber.
+func headBlock(cfg Config) (*big.Int, error) {
+	return taggedBlock(cfg, "latest")
+}
+
+// taggedBlock resolves tag ("latest", "safe" or "finalized") on the upstream,
+// reused for headCacheTTL so a burst of tagged filters costs one lookup. The
+// lookup runs outside headLock, so a slow upstream only holds up the callers
+// waiting for that tag.
+func taggedBlock(cfg Config, tag string) (*big.Int, error) {
+	headLock.Lock()
+	cached, ok := tagBlocks[tag]
+	headLock.Unlock()
+	if ok && time.Since(cached.checked) < headCacheTTL {
+		return new(big.Int).Set(cached.num), nil
+	}
+
+	v, err, _ := tagLookups.Do(tag, func() (interface{}, error) {
+		n, err := fetchTaggedBlock(cfg, tag)
+		if err != nil {
+			return nil, err
+		}
+		headLock.Lock()
+		tagBlocks[tag] = taggedNum{n, time.Now()}
+		headLock.Unlock()
+		return n, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).Set(v.(*big.Int)), nil
+}
+
+// fetchTaggedBlock asks the upstream for tag's block number: eth_blockNumber
+// for the head, eth_getBlockByNumber for the others.
+func fetchTaggedBlock(cfg Config, tag string) (*big.Int, error) {
+	var hex string
+	if tag == "latest" {
+		raw, err := callUnslotted(cfg, "eth_blockNumber")
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &hex); err != nil {
+			return nil, err
+		}
+	} else {
+		raw, err := callUnslotted(cfg, "eth_getBlockByNumber", tag, false)
+		if err != nil {
+			return nil, err
+		}
+		var block *struct {
+			Number string `json:"number"`
+		}
+		if err := json.Unmarshal(raw, &block); err != nil {
+			return nil, err
+		}
+		if block == nil {
+			return nil, fmt.Errorf("no %s block", tag)
+		}
+		hex = block.Number
+	}
+	n := blockNum(hex)
+	if n == nil {
+		return nil, fmt.Errorf("bad block number %q", hex)
+	}
+	return n, nil
+}
+
+// countAddresses handles the filter "address" field, which is either a
+// single address string or a list of them.
+func countAddresses(v interface{}) int {
+	switch a := v.(type) {
+	case string:
+		return 1
+	case []interface{}:
+		return len(a)
+	}
+	return 0
+}
+
+// countTopics counts every topic in the filter. Each position is null (any),
+// a single topic, or a nested list of alternatives (OR), all of which the
+// upstream has to match against.
+func countTopics(v interface{}) int {
+	positions, _ := v.([]interface{})
+	n := 0
+	for _, pos := range positions {
+		switch t := pos.(type) {
+		case string:
+			n++
+		case []interface{}:
+			n += len(t)
+		}
+	}
+	return n
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// resetHead forgets the cached head so each test sees its own upstream.
+func resetHead(t *testing.T) {
+	headLock.Lock()
+	tagBlocks = make(map[string]taggedNum)
+	headLock.Unlock()
+	t.Cleanup(func() {
+		headLock.Lock()
+		tagBlocks = make(map[string]taggedNum)
+		headLock.Unlock()
+	})
+}
+
+func TestCheckGetLogsRange(t *testing.T) {
+	// The head is block 0x1000; the limit is 100 blocks.
+	srv := rpcUpstream(t, func(method string, _ json.RawMessage) interface{} { return "0x1000" })
+	cfg := testConfig(srv.URL)
+
+	cases := []struct {
+		name   string
+		filter map[string]interface{}
+		reason string
+	}{
+		{"within limit", map[string]interface{}{"fromBlock": "0x10", "toBlock": "0x20"}, ""},
+		{"too wide", map[string]interface{}{"fromBlock": "0x0", "toBlock": "0x1000"}, "log_range"},
+		{"uppercase prefix", map[string]interface{}{"fromBlock": "0X0", "toBlock": "0X1000"}, "log_range"},
+		{"omitted toBlock is latest", map[string]interface{}{"fromBlock": "0x0"}, "log_range"},
+		{"omitted fromBlock is latest", map[string]interface{}{"toBlock": "latest"}, ""},
+		{"no bounds", map[string]interface{}{}, ""},
+		{"recent from to latest", map[string]interface{}{"fromBlock": "0xfd0", "toBlock": "latest"}, ""},
+		{"earliest to latest", map[string]interface{}{"fromBlock": "earliest"}, "log_range"},
+		{"reversed", map[string]interface{}{"fromBlock": "0x20", "toBlock": "0x10"}, "invalid_block_range"},
+		{"not hex", map[string]interface{}{"fromBlock": "0xzz", "toBlock": "0x10"}, "invalid_block_range"},
+		{"decimal", map[string]interface{}{"fromBlock": "16", "toBlock": "0x10"}, "invalid_block_range"},
+		{"number", map[string]interface{}{"fromBlock": 16.0, "toBlock": "0x10"}, "invalid_block_range"},
+		{"block hash", map[string]interface{}{"blockHash": "0xabc", "fromBlock": "0x0"}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resetHead(t)
+			rej := checkGetLogs(cfg, []interface{}{c.filter})
+			got := ""
+			if rej != nil {
+				got = rej.reason
+			}
+			if got != c.reason {
+				t.Errorf("reason %q, want %q", got, c.reason)
+			}
+		})
+	}
+}
+
+func TestCheckGetLogsHeadUnavailable(t *testing.T) {
+	srv := rpcUpstream(t, func(string, json.RawMessage) interface{} { return nil })
+	cfg := testConfig(srv.URL)
+	srv.Close()
+	for _, filter := range []map[string]interface{}{
+		{"fromBlock": "0x0"},
+		{"fromBlock": "0x0", "toBlock": "latest"},
+		{"fromBlock": "safe", "toBlock": "0x10"},
+	} {
+		resetHead(t)
+		rej := checkGetLogs(cfg, []interface{}{filter})
+		if rej == nil || rej.reason != "block_range_unknown" {
+			t.Errorf("%v: got %v, want block_range_unknown", filter, rej)
+		}
+	}
+}
+
+func TestBlockNum(t *testing.T) {
+	cases := []struct {
+		in   interface{}
+		want *big.Int
+	}{
+		{"0x10", big.NewInt(16)},
+		{"0X10", big.NewInt(16)},
+		{"0x0", big.NewInt(0)},
+		{"0x", nil},
+		{"0xg1", nil},
+		{"0x-1", nil},
+		{"10", nil},
+		{"", nil},
+		{16.0, nil},
+		{nil, nil},
+	}
+	for _, c := range cases {
+		got := blockNum(c.in)
+		if (got == nil) != (c.want == nil) || (got != nil && got.Cmp(c.want) != 0) {
+			t.Errorf("blockNum(%v) = %v, want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestCheckGetLogsReversedBounds(t *testing.T) {
+	var lookups atomic.Int32
+	srv := rpcUpstream(t, func(string, json.RawMessage) interface{} {
+		lookups.Add(1)
+		return "0x1000"
+	})
+	cfg := testConfig(srv.URL)
+	resetHead(t)
+
+	for _, filter := range []map[string]interface{}{
+		{"fromBlock": "0x20", "toBlock": "0x10"},
+		{"fromBlock": "0x1001", "toBlock": "latest"},
+		{"fromBlock": "latest", "toBlock": "0xfff"},
+		{"fromBlock": "0x1", "toBlock": "earliest"},
+		// Reversed by more than the limit still isn't a wide range.
+		{"fromBlock": "0x100000", "toBlock": "0x0"},
+	} {
+		rej := checkGetLogs(cfg, []interface{}{filter})
+		if rej == nil || rej.reason != "invalid_block_range" {
+			t.Errorf("%v: got %v, want invalid_block_range", filter, rej)
+		}
+	}
+	// Checking those must not have touched the cached head.
+	head, err := headBlock(cfg)
+	if err != nil || head.Cmp(big.NewInt(0x1000)) != 0 {
+		t.Errorf("head %v (%v) after checks, want 0x1000", head, err)
+	}
+	if n := lookups.Load(); n != 1 {
+		t.Errorf("%d head lookups, want 1 cached", n)
+	}
+}
+
+// tagUpstream is a node whose head is 0x1000, with safe and finalized
+// trailing it by 64 and 256 blocks.
+func tagUpstream(t *testing.T) *httptest.Server {
+	return rpcUpstream(t, func(method string, params json.RawMessage) interface{} {
+		if method == "eth_blockNumber" {
+			return "0x1000"
+		}
+		var args []interface{}
+		json.Unmarshal(params, &args)
+		switch args[0] {
+		case "safe":
+			return map[string]string{"number": "0xfc0"}
+		case "finalized":
+			return map[string]string{"number": "0xf00"}
+		}
+		return nil
+	})
+}
+
+func TestCheckGetLogsTags(t *testing.T) {
+	cfg := testConfig(tagUpstream(t).URL)
+	cases := []struct {
+		name   string
+		filter map[string]interface{}
+		reason string
+	}{
+		{"finalized to latest", map[string]interface{}{"fromBlock": "finalized", "toBlock": "latest"}, "log_range"},
+		{"finalized, toBlock omitted", map[string]interface{}{"fromBlock": "finalized"}, "log_range"},
+		{"finalized to near it", map[string]interface{}{"fromBlock": "finalized", "toBlock": "0xf50"}, ""},
+		{"safe to latest", map[string]interface{}{"fromBlock": "safe", "toBlock": "latest"}, ""},
+		{"safe to well past it", map[string]interface{}{"fromBlock": "safe", "toBlock": "0x1100"}, "log_range"},
+		{"finalized to safe", map[string]interface{}{"fromBlock": "finalized", "toBlock": "safe"}, "log_range"},
+		{"old block to finalized", map[string]interface{}{"fromBlock": "0x0", "toBlock": "finalized"}, "log_range"},
+		{"latest to finalized", map[string]interface{}{"fromBlock": "latest", "toBlock": "finalized"}, "invalid_block_range"},
+		{"pending to latest", map[string]interface{}{"fromBlock": "pending", "toBlock": "latest"}, ""},
+		{"pending to pending", map[string]interface{}{"fromBlock": "pending", "toBlock": "pending"}, ""},
+		{"pending, toBlock omitted", map[string]interface{}{"fromBlock": "pending"}, ""},
+		{"limit back to pending", map[string]interface{}{"fromBlock": "0xf9d", "toBlock": "pending"}, ""},
+		{"past the limit to pending", map[string]interface{}{"fromBlock": "0xf9c", "toBlock": "pending"}, "log_range"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resetHead(t)
+			got := ""
+			if rej := checkGetLogs(cfg, []interface{}{c.filter}); rej != nil {
+				got = rej.reason
+			}
+			if got != c.reason {
+				t.Errorf("reason %q, want %q", got, c.reason)
+			}
+		})
+	}
+}
+
+func TestCheckGetLogsUnknownTag(t *testing.T) {
+	// A node that has no finalized block yet answers null.
+	cfg := testConfig(rpcUpstream(t, func(method string, _ json.RawMessage) interface{} {
+		if method == "eth_blockNumber" {
+			return "0x1000"
+		}
+		return nil
+	}).URL)
+	resetHead(t)
+	if rej := checkGetLogs(cfg, []interface{}{map[string]interface{}{"fromBlock": "finalized"}}); rej == nil || rej.reason != "block_range_unknown" {
+		t.Errorf("got %v, want block_range_unknown", rej)
+	}
+}
+
+func TestTaggedBlockLookupOutsideLock(t *testing.T) {
+	release := make(chan struct{})
+	var finalizedLookups atomic.Int32
+	cfg := testConfig(rpcUpstream(t, func(method string, _ json.RawMessage) interface{} {
+		if method == "eth_blockNumber" {
+			return "0x1000"
+		}
+		finalizedLookups.Add(1)
+		<-release
+		return map[string]string{"number": "0xf00"}
+	}).URL)
+	resetHead(t)
+	if _, err := headBlock(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// Several callers wait on one slow finalized lookup...
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if n, err := taggedBlock(cfg, "finalized"); err != nil || n.Cmp(big.NewInt(0xf00)) != 0 {
+				t.Errorf("finalized %v (%v)", n, err)
+			}
+		}()
+	}
+	for finalizedLookups.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// ...while the cached head is still served at once.
+	done := make(chan struct{})
+	go func() {
+		headBlock(cfg)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("head lookup blocked behind a slow finalized lookup")
+	}
+	close(release)
+	wg.Wait()
+	if n := finalizedLookups.Load(); n != 1 {
+		t.Errorf("%d finalized lookups for concurrent callers, want 1", n)
+	}
+}
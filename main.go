@@ -1,23 +1,34 @@
 package main
 
 import (
-	"bytes"
+	"container/list"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
+	"io/fs"
 	"log"
+	"log/slog"
+	"math"
 	"math/big"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
 )
 
 // ===== CONFIG STRUCT =====
@@ -27,34 +38,433 @@ type RateLimitConfig struct {
 	Burst      int     `json:"burst"`
 }
 
+// TierConfig is the rate-limit set for one API-key tier.
+type TierConfig struct {
+	RateLimits       map[string]RateLimitConfig `json:"rate_limits"`
+	DefaultRateLimit *RateLimitConfig           `json:"default_rate_limit"`
+}
+
 type Config struct {
-	GethRPC            string                     `json:"geth_rpc"`
-	MinGasPriceGwei    int64                      `json:"min_gas_price_gwei"`
-	LogBlockRangeLimit int64                      `json:"log_block_range_limit"`
-	RateLimits         map[string]RateLimitConfig `json:"rate_limits"`
+	GethRPC              string                     `json:"geth_rpc"`
+	GethRPCs             []string                   `json:"geth_rpcs"`
+	FallbackGethRPC      string                     `json:"fallback_geth_rpc"`
+	UpstreamCooldown     int64                      `json:"upstream_cooldown_ms"`
+	MaxRetries           int                        `json:"max_retries"`
+	RetryBackoff         int64                      `json:"retry_backoff_ms"`
+	MinGasPriceGwei      int64                      `json:"min_gas_price_gwei"`
+	LogBlockRangeLimit   int64                      `json:"log_block_range_limit"`
+	RateLimits           map[string]RateLimitConfig `json:"rate_limits"`
+	UpstreamTimeout      int64                      `json:"upstream_timeout_ms"`
+	MethodTimeouts       map[string]int             `json:"method_timeouts_ms"`
+	MaxIdleConns         int                        `json:"max_idle_conns"`
+	MaxIdleConnsPerHost  int                        `json:"max_idle_conns_per_host"`
+	IdleConnTimeout      int64                      `json:"idle_conn_timeout_ms"`
+	ExpectedChainID      int64                      `json:"expected_chain_id"`
+	AllowUnprotectedTx   bool                       `json:"allow_unprotected_tx"`
+	MaxGasLimit          uint64                     `json:"max_gas_limit"`
+	BlockedSenders       []string                   `json:"blocked_senders"`
+	MaxNonceGap          uint64                     `json:"max_nonce_gap"`
+	NonceCacheTTL        int64                      `json:"nonce_cache_ms"`
+	BaseFeeGwei          int64                      `json:"base_fee_gwei"`
+	MinTipGwei           int64                      `json:"min_tip_gwei"`
+	MinBlobGasFeeGwei    int64                      `json:"min_blob_gas_fee_gwei"`
+	MaxTxBytes           int                        `json:"max_tx_bytes"`
+	TxDedupWindow        int64                      `json:"tx_dedup_window_ms"`
+	PreflightSendRawTx   bool                       `json:"preflight_send_raw_tx"`
+	GlobalRateLimits     map[string]RateLimitConfig `json:"global_rate_limits"`
+	LimiterTTL           int64                      `json:"limiter_ttl_ms"`
+	LimiterSweepEvery    int64                      `json:"limiter_sweep_interval_ms"`
+	MaxLimiterEntries    int                        `json:"max_limiter_entries"`
+	TrustedProxies       []string                   `json:"trusted_proxies"`
+	AllowedMethods       []string                   `json:"allowed_methods"`
+	BlockedMethods       []string                   `json:"blocked_methods"`
+	MaxLogAddresses      int                        `json:"max_log_addresses"`
+	MaxLogTopics         int                        `json:"max_log_topics"`
+	LogResultEstimate    *LogEstimateConfig         `json:"log_result_estimate"`
+	MaxParamsCount       int                        `json:"max_params_count"`
+	MaxRequestBytes      int64                      `json:"max_request_bytes"`
+	MaxResponseBytes     int64                      `json:"max_response_bytes"`
+	CountUpstreamErrors  bool                       `json:"count_upstream_errors"`
+	ShutdownTimeout      int64                      `json:"shutdown_timeout_ms"`
+	ReadyCacheTTL        int64                      `json:"ready_cache_ms"`
+	LogLevel             string                     `json:"log_level"`
+	AccessLog            string                     `json:"access_log"`
+	DefaultRateLimit     *RateLimitConfig           `json:"default_rate_limit"`
+	MaxCallDataBytes     int                        `json:"max_call_data_bytes"`
+	MaxCallGas           uint64                     `json:"max_call_gas"`
+	MaxFeeHistoryBlocks  uint64                     `json:"max_fee_history_blocks"`
+	Quota                *QuotaConfig               `json:"quota"`
+	RestrictFullBlockTxs *FullBlockTxsConfig        `json:"restrict_full_block_txs"`
+	GethWS               string                     `json:"geth_ws"`
+	WSPath               string                     `json:"ws_path"`
+	AdminToken           string                     `json:"admin_token"`
+	AdminHMACSecret      string                     `json:"admin_hmac_secret"`
+	MaxConcurrentPerIP   int                        `json:"max_concurrent_per_ip"`
+	UpstreamConcurrency  int                        `json:"max_upstream_concurrency"`
+	QueueTimeout         int64                      `json:"upstream_queue_timeout_ms"`
+	TLSCertFile          string                     `json:"tls_cert_file"`
+	TLSKeyFile           string                     `json:"tls_key_file"`
+	TLSAddr              string                     `json:"tls_addr"`
+	ClientCAFile         string                     `json:"client_ca_file"`
+	ClientCertTiers      map[string]string          `json:"client_cert_tiers"`
+	ListenAddr           string                     `json:"listen_addr"`
+	MetricsAddr          string                     `json:"metrics_addr"`
+	APIKeys              map[string]string          `json:"api_keys"`
+	Tiers                map[string]TierConfig      `json:"tiers"`
+	RequireAPIKey        bool                       `json:"require_api_key"`
+	MetricsIPLabel       string                     `json:"metrics_ip_label"`
+	ShadowMode           bool                       `json:"shadow_mode"`
+	MaintenanceMode      bool                       `json:"maintenance_mode"`
+	MaintenanceRetry     int64                      `json:"maintenance_retry_after_ms"`
+	LimiterAlgorithm     string                     `json:"limiter_algorithm"`
+	LimiterBackend       string                     `json:"limiter_backend"`
+	RedisURL             string                     `json:"redis_url"`
+	RedisFailOpen        bool                       `json:"redis_fail_open"`
+	StrictJSONRPC        bool                       `json:"strict_jsonrpc"`
+	AllowlistedIPs       []string                   `json:"allowlisted_ips"`
+	DeniedIPs            []string                   `json:"denied_ips"`
+	CORSOrigins          []string                   `json:"cors_allowed_origins"`
+	CORSHeaders          []string                   `json:"cors_allowed_headers"`
+	RequireJSONType      bool                       `json:"require_json_content_type"`
+	OTelEndpoint         string                     `json:"otel_endpoint"`
+	OTelSampleRatio      float64                    `json:"otel_sample_ratio"`
+	LimiterWindow        int64                      `json:"limiter_window_ms"`
+	MethodCosts          map[string]float64         `json:"method_costs"`
+	ForwardHeaders       []string                   `json:"forward_headers"`
+	BreakerFailures      int                        `json:"breaker_failures"`
+	BreakerWindow        int64                      `json:"breaker_window_ms"`
+	BreakerCooldown      int64                      `json:"breaker_cooldown_ms"`
+	MethodRoutes         map[string]string          `json:"method_routes"`
+	CacheMethods         []string                   `json:"cache_methods"`
+	CacheTTL             int64                      `json:"cache_ttl_ms"`
+	BlockCacheEntries    int                        `json:"block_cache_entries"`
+	BlockCacheBytes      int64                      `json:"block_cache_bytes"`
+	BlockCacheTTL        int64                      `json:"block_cache_ttl_ms"`
+
+	// Parsed forms of the IP lists, filled in by setConfig so requests
+	// don't re-parse CIDRs.
+	trustedNets, allowlistedNets, deniedNets []*net.IPNet
+
+	// unconfigured marks the stand-in config used when the guard was started
+	// with -allow-missing-config and no file exists yet.
+	unconfigured bool
+
+	// route is the MethodRoutes upstream withRoute narrowed the pool to, ""
+	// for the default pool. It picks the circuit breaker.
+	route string
 }
 
+// notConfigured answers every call while the guard runs unconfigured.
+var notConfigured = &rejection{"not_configured", "Guard not configured"}
+
 var (
 	config     Config
 	configLock sync.RWMutex
 )
 
-func loadConfig() {
-	for {
-		file, err := os.ReadFile("config.json")
-		if err != nil {
-			log.Fatalf("Failed to read config.json: %v", err)
+// resolveConfigPath picks the config file: the -config flag, then the
+// RPCGUARD_CONFIG env var, then config.json in the working directory.
+func resolveConfigPath(flagPath string) string {
+	if flagPath != "" {
+		return flagPath
+	}
+	if env := os.Getenv("RPCGUARD_CONFIG"); env != "" {
+		return env
+	}
+	return "config.json"
+}
+
+// readConfig reads and parses the config file once, then applies the
+// environment overlay.
+func readConfig(path string) (Config, error) {
+	var c Config
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return c, fmt.Errorf("read %s: %w", path, err)
+	}
+	if err := json.Unmarshal(file, &c); err != nil {
+		return c, fmt.Errorf("parse %s: %w", path, err)
+	}
+	applyEnvOverlay(&c)
+	if err := validateConfig(c); err != nil {
+		return c, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// checkURL accepts an absolute URL with a host and one of the given
+// schemes, so a typo or a file:// URL never becomes an upstream.
+func checkURL(raw string, schemes ...string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute URL", raw)
+	}
+	for _, s := range schemes {
+		if strings.EqualFold(u.Scheme, s) {
+			return nil
 		}
-		var c Config
-		if err := json.Unmarshal(file, &c); err != nil {
-			log.Printf("⚠️ Config parse error: %v", err)
-		} else {
-			configLock.Lock()
-			config = c
-			configLock.Unlock()
+	}
+	return fmt.Errorf("%q: scheme must be %s", raw, strings.Join(schemes, " or "))
+}
+
+// validateConfig checks the invariants the guards rely on, so a typo in a
+// live edit is rejected instead of silently disabling a limit.
+func validateConfig(c Config) error {
+	var errs []error
+	if len(c.GethRPCs) == 0 {
+		if err := checkURL(c.GethRPC, "http", "https"); err != nil {
+			errs = append(errs, fmt.Errorf("geth_rpc: %v", err))
+		}
+	}
+	for i, raw := range c.GethRPCs {
+		if err := checkURL(raw, "http", "https"); err != nil {
+			errs = append(errs, fmt.Errorf("geth_rpcs[%d]: %v", i, err))
+		}
+	}
+	if c.ListenAddr != "" {
+		if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+			errs = append(errs, fmt.Errorf("listen_addr: %v", err))
+		}
+	}
+	if c.MetricsAddr != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddr); err != nil {
+			errs = append(errs, fmt.Errorf("metrics_addr: %v", err))
+		}
+	}
+	if c.FallbackGethRPC != "" {
+		if err := checkURL(c.FallbackGethRPC, "http", "https"); err != nil {
+			errs = append(errs, fmt.Errorf("fallback_geth_rpc: %v", err))
+		}
+	}
+	for pattern, raw := range c.MethodRoutes {
+		if err := checkURL(raw, "http", "https"); err != nil {
+			errs = append(errs, fmt.Errorf("method_routes[%q]: %v", pattern, err))
+		}
+	}
+	for method, ms := range c.MethodTimeouts {
+		if ms <= 0 {
+			errs = append(errs, fmt.Errorf("method_timeouts_ms[%q]: must be positive", method))
+		}
+	}
+	if c.GethWS != "" {
+		if err := checkURL(c.GethWS, "ws", "wss"); err != nil {
+			errs = append(errs, fmt.Errorf("geth_ws: %v", err))
+		}
+	}
+	if c.WSPath != "" && !strings.HasPrefix(c.WSPath, "/") {
+		errs = append(errs, fmt.Errorf("ws_path: %q must start with /", c.WSPath))
+	}
+	switch c.LimiterAlgorithm {
+	case "", algoTokenBucket, algoSlidingWindow:
+	default:
+		errs = append(errs, fmt.Errorf("limiter_algorithm: %q is not one of token_bucket, sliding_window", c.LimiterAlgorithm))
+	}
+	switch c.LimiterBackend {
+	case "", "memory":
+	case "redis":
+		if c.LimiterAlgorithm == algoSlidingWindow {
+			errs = append(errs, fmt.Errorf("limiter_backend: redis only supports the token_bucket algorithm"))
+		}
+		if _, err := redis.ParseURL(c.RedisURL); err != nil {
+			errs = append(errs, fmt.Errorf("redis_url: %v", err))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("limiter_backend: %q is not one of memory, redis", c.LimiterBackend))
+	}
+	switch c.MetricsIPLabel {
+	case "", "none", "subnet", "ip":
+	default:
+		errs = append(errs, fmt.Errorf("metrics_ip_label: %q is not one of none, subnet, ip", c.MetricsIPLabel))
+	}
+	errs = append(errs, validateNets("trusted_proxies", c.TrustedProxies)...)
+	errs = append(errs, validateNets("allowlisted_ips", c.AllowlistedIPs)...)
+	errs = append(errs, validateNets("denied_ips", c.DeniedIPs)...)
+	for i, addr := range c.BlockedSenders {
+		if !common.IsHexAddress(addr) {
+			errs = append(errs, fmt.Errorf("blocked_senders[%d]: %q is not an address", i, addr))
+		}
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs = append(errs, fmt.Errorf("tls_cert_file, tls_key_file: must be set together"))
+	}
+	if c.ClientCAFile != "" && !tlsEnabled(c) {
+		errs = append(errs, fmt.Errorf("client_ca_file: needs tls_cert_file and tls_key_file"))
+	}
+	for name, tier := range c.ClientCertTiers {
+		if _, ok := c.Tiers[tier]; !ok {
+			errs = append(errs, fmt.Errorf("client_cert_tiers: %q maps to unknown tier %q", name, tier))
+		}
+	}
+	if c.BlockCacheEntries < 0 {
+		errs = append(errs, fmt.Errorf("block_cache_entries: must not be negative"))
+	}
+	for method, cost := range c.MethodCosts {
+		if cost <= 0 {
+			errs = append(errs, fmt.Errorf("method_costs[%q]: must be positive", method))
 		}
-		time.Sleep(3 * time.Second)
 	}
+	if c.BreakerFailures < 0 {
+		errs = append(errs, fmt.Errorf("breaker_failures: must not be negative"))
+	}
+	if q := c.Quota; q != nil && (q.Daily < 0 || q.Monthly < 0) {
+		errs = append(errs, fmt.Errorf("quota: daily and monthly must not be negative"))
+	}
+	if q := c.Quota; q != nil && q.MaxSubjects < 0 {
+		errs = append(errs, fmt.Errorf("quota.max_subjects: must not be negative"))
+	}
+	if c.LogResultEstimate != nil {
+		errs = append(errs, validateLogEstimate(c.LogResultEstimate)...)
+	}
+	if r := c.RestrictFullBlockTxs; r != nil && r.Cost < 0 {
+		errs = append(errs, fmt.Errorf("restrict_full_block_txs.cost: must not be negative"))
+	}
+	if c.MaintenanceRetry < 0 {
+		errs = append(errs, fmt.Errorf("maintenance_retry_after_ms: must not be negative"))
+	}
+	if c.MaxLimiterEntries < 0 {
+		errs = append(errs, fmt.Errorf("max_limiter_entries: must not be negative"))
+	}
+	if c.UpstreamConcurrency < 0 {
+		errs = append(errs, fmt.Errorf("max_upstream_concurrency: must not be negative"))
+	}
+	if c.QueueTimeout < 0 {
+		errs = append(errs, fmt.Errorf("upstream_queue_timeout_ms: must not be negative"))
+	}
+	if c.MaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("max_retries: must not be negative"))
+	}
+	if c.MinGasPriceGwei < 0 {
+		errs = append(errs, fmt.Errorf("min_gas_price_gwei: must not be negative"))
+	}
+	if c.OTelSampleRatio < 0 || c.OTelSampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("otel_sample_ratio: must be between 0 and 1"))
+	}
+	if c.MinTipGwei < 0 {
+		errs = append(errs, fmt.Errorf("min_tip_gwei: must not be negative"))
+	}
+	if c.MinBlobGasFeeGwei < 0 {
+		errs = append(errs, fmt.Errorf("min_blob_gas_fee_gwei: must not be negative"))
+	}
+	if c.LogBlockRangeLimit <= 0 {
+		errs = append(errs, fmt.Errorf("log_block_range_limit: must be positive"))
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("log_level: %q is not one of debug, info, warn, error", c.LogLevel))
+	}
+	errs = append(errs, validateRateLimits("rate_limits", c.RateLimits)...)
+	errs = append(errs, validateRateLimits("global_rate_limits", c.GlobalRateLimits)...)
+	if c.DefaultRateLimit != nil {
+		errs = append(errs, validateRateLimit("default_rate_limit", *c.DefaultRateLimit)...)
+	}
+	for name, t := range c.Tiers {
+		errs = append(errs, validateRateLimits("tiers."+name+".rate_limits", t.RateLimits)...)
+		if t.DefaultRateLimit != nil {
+			errs = append(errs, validateRateLimit("tiers."+name+".default_rate_limit", *t.DefaultRateLimit)...)
+		}
+	}
+	for key, tier := range c.APIKeys {
+		if _, ok := c.Tiers[tier]; !ok {
+			errs = append(errs, fmt.Errorf("api_keys: key %s… maps to unknown tier %q", key[:min(4, len(key))], tier))
+		}
+	}
+	return joinErrors(errs)
+}
+
+// joinErrors folds errs into one single-line error, or nil when empty.
+func joinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+func validateRateLimits(field string, limits map[string]RateLimitConfig) []error {
+	var errs []error
+	for method, l := range limits {
+		errs = append(errs, validateRateLimit(field+"."+method, l)...)
+	}
+	return errs
+}
+
+func validateRateLimit(field string, l RateLimitConfig) []error {
+	var errs []error
+	if l.RatePerSec < 0 {
+		errs = append(errs, fmt.Errorf("%s.rate_per_sec: must not be negative", field))
+	}
+	if l.Burst <= 0 {
+		errs = append(errs, fmt.Errorf("%s.burst: must be positive", field))
+	}
+	return errs
+}
+
+func setConfig(c Config) {
+	c.trustedNets = parseNets(c.TrustedProxies)
+	c.allowlistedNets = parseNets(c.AllowlistedIPs)
+	c.deniedNets = parseNets(c.DeniedIPs)
+	if lvl, err := parseLogLevel(c.LogLevel); err == nil {
+		logLevel.Set(lvl)
+	}
+	configLock.Lock()
+	prev := config
+	config = c
+	configLock.Unlock()
+	logMaintenanceChange(prev, c)
+	configureAccessLog(c)
+}
+
+// loadConfig keeps the config current: it watches the file and re-reads it
+// on change, falling back to polling every few seconds if no watcher can be
+// set up. Read and parse failures (e.g. an editor swapping the file mid-read)
+// keep the last good config.
+func loadConfig(ctx context.Context, path string) {
+	err := watchConfig(ctx, path)
+	if err == nil || ctx.Err() != nil {
+		return
+	}
+	log.Printf("⚠️ Config watcher unavailable, polling instead: %v", err)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(3 * time.Second):
+		}
+		reloadConfig(path)
+	}
+}
+
+func reloadConfig(path string) {
+	if _, err := applyConfigFile(path); err != nil {
+		log.Printf("⚠️ Config reload failed, keeping previous config: %v", err)
+	}
+}
+
+// reloadLock serializes reloads, so a watcher event and POST /admin/reload
+// racing each other can't install an older read over a newer one.
+var reloadLock sync.Mutex
+
+// applyConfigFile reads and validates path and, if that succeeds, swaps it in.
+func applyConfigFile(path string) (Config, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	c, err := readConfig(path)
+	if err != nil {
+		return c, err
+	}
+	setConfig(c)
+	return c, nil
+}
+
+const defaultMaxRequestBytes = 5 << 20
+
+func maxRequestBytes(cfg Config) int64 {
+	if cfg.MaxRequestBytes > 0 {
+		return cfg.MaxRequestBytes
+	}
+	return defaultMaxRequestBytes
 }
 
 func getConfig() Config {
@@ -71,17 +481,182 @@ var (
 		[]string{"method", "reason", "ip"},
 	)
 	accepts = prometheus.NewCounterVec(
-		prometheus.CounterOpts{Name: "rpcguard_accepted_total", Help: "Accepted RPCs"},
-		[]string{"method", "ip"},
+		prometheus.CounterOpts{Name: "rpcguard_accepted_total", Help: "Accepted RPCs; allowlisted=\"true\" for calls from allowlisted_ips, which skip the guards"},
+		[]string{"method", "ip", "allowlisted"},
+	)
+	decisions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "rpcguard_decisions_total", Help: "Accepted and rejected RPCs by method, without client labels, for ratio alerts"},
+		[]string{"method", "decision"},
+	)
+	wouldRejects = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "rpcguard_would_reject_total", Help: "RPCs a guard refused but shadow mode forwarded anyway"},
+		[]string{"method", "reason"},
+	)
+	clientCancels = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "rpcguard_client_cancelled_total", Help: "Accepted RPCs abandoned by the client before the upstream replied"},
+		[]string{"method"},
+	)
+	methodsInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "rpcguard_in_flight_requests", Help: "HTTP JSON-RPC requests currently being handled, from parse until the reply is written; batches are labeled method=\"batch\""},
+		[]string{"method"},
+	)
+	tierDecisions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "rpcguard_tier_decisions_total", Help: "Accepted/rejected RPCs per API-key tier"},
+		[]string{"tier", "method", "decision"},
+	)
+	upstreamDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "rpcguard_upstream_duration_seconds",
+			Help:    "Upstream round-trip time until response headers; batches are labeled method=\"batch\"",
+			Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"method"},
+	)
+	requestBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "rpcguard_request_bytes",
+			Help:    "Inbound JSON-RPC body size; batches are labeled method=\"batch\"",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 10),
+		},
+		[]string{"method"},
+	)
+	responseBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "rpcguard_response_bytes",
+			Help:    "Upstream response body size relayed to clients; batches are labeled method=\"batch\"",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 10),
+		},
+		[]string{"method"},
+	)
+	upstreamRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "rpcguard_upstream_requests_total", Help: "Requests sent to each upstream endpoint"},
+		[]string{"endpoint"},
+	)
+	upstreamRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "rpcguard_upstream_retries_total", Help: "Retried upstream attempts, by the endpoint retried against"},
+		[]string{"endpoint"},
+	)
+	responsesTooLarge = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "rpcguard_response_too_large_total", Help: "Upstream replies over max_response_bytes, answered with an error instead; batches are labeled method=\"batch\""},
+		[]string{"method"},
+	)
+	fallbacks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "rpcguard_fallback_total", Help: "Read-only calls retried on fallback_geth_rpc after the primary failed, by result (ok or error); batches are labeled method=\"batch\""},
+		[]string{"method", "result"},
+	)
+	upstreamErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "rpcguard_upstream_error_total", Help: "Failed upstream attempts by cause: timeout, connection_refused, connection_reset, dns, cancelled or other"},
+		[]string{"endpoint", "kind"},
+	)
+	cacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "rpcguard_cache_requests_total", Help: "Response cache lookups for cache_methods, by result (hit or miss)"},
+		[]string{"method", "result"},
+	)
+	blockCacheEvictions = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "rpcguard_block_cache_evictions_total", Help: "Blocks dropped from the block cache to stay within its entry or byte budget"},
+	)
+	blockCacheSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "rpcguard_block_cache_bytes", Help: "Result bytes held in the block cache"},
+	)
+	breakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "rpcguard_circuit_state", Help: "Upstream circuit breaker per pool (default, a method route's upstream, or fallback_geth_rpc): 0 closed, 1 half-open, 2 open"},
+		[]string{"pool"},
+	)
+	quotaEvictions = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "rpcguard_quota_evictions_total", Help: "Least recently seen quota subjects forgotten to stay within quota.max_subjects"},
+	)
+	limiterEvictions = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "rpcguard_limiter_evictions_total", Help: "Least recently used rate-limit buckets dropped to stay within max_limiter_entries"},
+	)
+	upstreamRPCErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "rpcguard_upstream_jsonrpc_error_total", Help: "JSON-RPC errors in upstream replies relayed to clients, by error code, \"other\" for codes outside JSON-RPC, EIP-1474 and 3; unknown methods as method=\"other\" and passed-through batches as method=\"batch\". Needs count_upstream_errors"},
+		[]string{"method", "code"},
+	)
+	limiterBackendErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "rpcguard_limiter_backend_errors_total", Help: "Rate-limit checks that could not reach the Redis limiter and were decided by redis_fail_open"},
+	)
+	upstreamInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "rpcguard_upstream_in_flight", Help: "Upstream calls currently holding a max_upstream_concurrency slot, counted even without a cap"},
+	)
+	maintenanceRejects = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "rpcguard_maintenance_rejected_total", Help: "Calls refused because maintenance_mode is on; also counted in rpcguard_rejected_total{reason=\"maintenance\"}"},
+	)
+	upstreamHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "rpcguard_upstream_healthy", Help: "1 if the endpoint is in rotation, 0 while cooling down"},
+		[]string{"endpoint"},
 	)
 )
 
+// metricIP is the value of the "ip" label. Every distinct value is a new
+// time series, so by default it is left empty and per-client detail lives in
+// the request log. "subnet" buckets clients into /24 (IPv4) or /48 (IPv6)
+// networks; "ip" records full addresses and is only safe for small,
+// known client sets.
+func metricIP(cfg Config, ip string) string {
+	switch cfg.MetricsIPLabel {
+	case "ip":
+		return ip
+	case "subnet":
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return ""
+		}
+		if v4 := parsed.To4(); v4 != nil {
+			return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+		}
+		return parsed.Mask(net.CIDRMask(48, 128)).String() + "/48"
+	}
+	return ""
+}
+
 func init() {
-	prometheus.MustRegister(rejects, accepts)
+	prometheus.MustRegister(
+		rejects, accepts, decisions, wouldRejects, clientCancels, methodsInFlight, tierDecisions,
+		cacheLookups, blockCacheEvictions, blockCacheSize,
+		upstreamDuration, requestBytes, responseBytes, responsesTooLarge,
+		upstreamRequests, upstreamRetries, upstreamErrors, fallbacks, upstreamHealthy, breakerState,
+		upstreamInFlight, limiterBackendErrors, upstreamRPCErrors, limiterEvictions, maintenanceRejects, quotaEvictions,
+	)
 }
 
 // ===== RATE LIMITING =====
 
+const (
+	algoTokenBucket   = "token_bucket"
+	algoSlidingWindow = "sliding_window"
+)
+
+// limiter is one rate-limit bucket, whichever LimiterAlgorithm built it.
+type limiter interface {
+	// allowN takes cost from the bucket if it holds that much.
+	allowN(cost float64) bool
+	// wait is how long until allowN(cost) would next succeed, without using
+	// anything up.
+	wait(cost float64) time.Duration
+	// algorithm names the LimiterAlgorithm the bucket implements.
+	algorithm() string
+	// lastUsed and remaining feed idle eviction and the admin API.
+	lastUsed() time.Time
+	// full reports whether the bucket is back to its fresh state at now, so
+	// dropping it and starting over later changes nothing.
+	full(now time.Time) bool
+	remaining() float64
+	// retune applies a reloaded limit, keeping what the bucket has already
+	// used so a change takes effect for active clients without a reset.
+	retune(conf RateLimitConfig, window time.Duration)
+}
+
+// newLimiter builds a bucket for conf using cfg's LimiterAlgorithm.
+func newLimiter(cfg Config, key string, conf RateLimitConfig) limiter {
+	if cfg.LimiterBackend == "redis" {
+		return newRedisLimiter(key, conf)
+	}
+	if cfg.LimiterAlgorithm == algoSlidingWindow {
+		return newSlidingWindow(conf, limiterWindow(cfg))
+	}
+	return newRateLimiter(conf)
+}
+
 type rateLimiter struct {
 	tokens     float64
 	last       time.Time
@@ -90,43 +665,249 @@ type rateLimiter struct {
 	mutex      sync.Mutex
 }
 
-var ipLimiters = make(map[string]*rateLimiter)
-var limiterLock sync.Mutex
+// ipLimiters holds the per-subject buckets. limiterLRU orders their keys by
+// last use, most recent at the front, so MaxLimiterEntries can evict the
+// stalest one in constant time; limiterPos finds a key's place in it.
+var (
+	ipLimiters  = make(map[string]limiter)
+	limiterLRU  = list.New()
+	limiterPos  = make(map[string]*list.Element)
+	limiterLock sync.Mutex
+)
 
-func getLimiter(ip, method string, conf RateLimitConfig) *rateLimiter {
-	key := ip + ":" + method
+// getLimiter returns the bucket for subject and method, replacing it when a
+// reload switched LimiterAlgorithm. A new bucket that would take the table
+// past MaxLimiterEntries first evicts the least recently used ones.
+func getLimiter(cfg Config, subject, method string, conf RateLimitConfig) limiter {
+	key := subject + ":" + method
 	limiterLock.Lock()
 	defer limiterLock.Unlock()
 
 	lim, ok := ipLimiters[key]
-	if !ok {
-		lim = &rateLimiter{
-			tokens:     float64(conf.Burst),
-			last:       time.Now(),
-			ratePerSec: conf.RatePerSec,
-			burst:      float64(conf.Burst),
+	switch {
+	case !ok:
+		for cfg.MaxLimiterEntries > 0 && len(ipLimiters) >= cfg.MaxLimiterEntries {
+			dropLimiter(limiterLRU.Back().Value.(string))
+			limiterEvictions.Inc()
 		}
+		lim = newLimiter(cfg, key, conf)
+		ipLimiters[key] = lim
+		limiterPos[key] = limiterLRU.PushFront(key)
+		return lim
+	case lim.algorithm() != limiterAlgorithm(cfg):
+		lim = newLimiter(cfg, key, conf)
 		ipLimiters[key] = lim
+	default:
+		lim.retune(conf, limiterWindow(cfg))
 	}
+	limiterLRU.MoveToFront(limiterPos[key])
 	return lim
 }
 
-func (rl *rateLimiter) allow() bool {
+// dropLimiter removes a bucket; limiterLock must be held.
+func dropLimiter(key string) {
+	delete(ipLimiters, key)
+	if e, ok := limiterPos[key]; ok {
+		limiterLRU.Remove(e)
+		delete(limiterPos, key)
+	}
+}
+
+func limiterAlgorithm(cfg Config) string {
+	if cfg.LimiterBackend == "redis" {
+		return algoRedisBucket
+	}
+	if cfg.LimiterAlgorithm == "" {
+		return algoTokenBucket
+	}
+	return cfg.LimiterAlgorithm
+}
+
+const (
+	defaultLimiterTTL        = 10 * time.Minute
+	defaultLimiterSweepEvery = time.Minute
+)
+
+// sweepLimiters periodically drops per-IP limiters that have not been used
+// for LimiterTTL and have refilled to burst, so recreating one on the next
+// request is indistinguishable from keeping it.
+func sweepLimiters(ctx context.Context) {
+	for {
+		cfg := getConfig()
+		every := defaultLimiterSweepEvery
+		if cfg.LimiterSweepEvery > 0 {
+			every = time.Duration(cfg.LimiterSweepEvery) * time.Millisecond
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(every):
+		}
+
+		ttl := defaultLimiterTTL
+		if cfg.LimiterTTL > 0 {
+			ttl = time.Duration(cfg.LimiterTTL) * time.Millisecond
+		}
+		if n := evictIdleLimiters(time.Now(), ttl); n > 0 {
+			log.Printf("🧹 Evicted %d idle rate limiters", n)
+		}
+	}
+}
+
+// evictIdleLimiters removes limiters unused for ttl before now that are full
+// again. One still refilling is kept however long it has been idle: a slow
+// rate can take longer than ttl to refill, and dropping it would hand the
+// client a fresh burst.
+func evictIdleLimiters(now time.Time, ttl time.Duration) int {
+	limiterLock.Lock()
+	defer limiterLock.Unlock()
+
+	evicted := 0
+	cutoff := now.Add(-ttl)
+	for key, lim := range ipLimiters {
+		if lim.lastUsed().Before(cutoff) && lim.full(now) {
+			dropLimiter(key)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// globalLimiters hold one shared bucket per method across all client IPs.
+var globalLimiters = make(map[string]limiter)
+var globalLimiterLock sync.Mutex
+
+func getGlobalLimiter(cfg Config, method string, conf RateLimitConfig) limiter {
+	globalLimiterLock.Lock()
+	defer globalLimiterLock.Unlock()
+
+	lim, ok := globalLimiters[method]
+	if !ok || lim.algorithm() != limiterAlgorithm(cfg) {
+		lim = newLimiter(cfg, "global:"+method, conf)
+		globalLimiters[method] = lim
+	} else {
+		lim.retune(conf, limiterWindow(cfg))
+	}
+	return lim
+}
+
+// rateLimitFor returns the per-IP limit for method: its own entry if listed,
+// else DefaultRateLimit. Without a default, unlisted methods are unlimited.
+// Callers in an API-key tier get the tier's limits first.
+func rateLimitFor(cfg Config, tier, method string) (RateLimitConfig, bool) {
+	if t, ok := cfg.Tiers[tier]; ok {
+		if limCfg, ok := t.RateLimits[method]; ok {
+			return limCfg, true
+		}
+		if t.DefaultRateLimit != nil {
+			return *t.DefaultRateLimit, true
+		}
+	}
+	if limCfg, ok := cfg.RateLimits[method]; ok {
+		return limCfg, true
+	}
+	if cfg.DefaultRateLimit != nil {
+		return *cfg.DefaultRateLimit, true
+	}
+	return RateLimitConfig{}, false
+}
+
+func newRateLimiter(conf RateLimitConfig) *rateLimiter {
+	return &rateLimiter{
+		tokens:     float64(conf.Burst),
+		last:       time.Now(),
+		ratePerSec: conf.RatePerSec,
+		burst:      float64(conf.Burst),
+	}
+}
+
+func (rl *rateLimiter) allowN(cost float64) bool {
+	return rl.allowAt(time.Now(), cost)
+}
+
+// wait is the time until the bucket refills to cost tokens.
+func (rl *rateLimiter) wait(cost float64) time.Duration {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	tokens := minF(rl.burst, rl.tokens+time.Since(rl.last).Seconds()*rl.ratePerSec)
+	if tokens+tokenSlack >= cost {
+		return 0
+	}
+	if rl.ratePerSec <= 0 || cost > rl.burst {
+		// Never gets there; there is no honest answer, so suggest a minute.
+		return time.Minute
+	}
+	return time.Duration((cost - tokens) / rl.ratePerSec * float64(time.Second))
+}
+
+func (rl *rateLimiter) algorithm() string { return algoTokenBucket }
+
+func (rl *rateLimiter) lastUsed() time.Time {
 	rl.mutex.Lock()
 	defer rl.mutex.Unlock()
+	return rl.last
+}
 
+func (rl *rateLimiter) full(now time.Time) bool {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	return rl.tokens+now.Sub(rl.last).Seconds()*rl.ratePerSec >= rl.burst-tokenSlack
+}
+
+func (rl *rateLimiter) remaining() float64 {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	return rl.tokens
+}
+
+// retune settles the refill earned at the old rate before switching, and
+// caps the tokens at a lowered burst.
+func (rl *rateLimiter) retune(conf RateLimitConfig, _ time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if rl.ratePerSec == conf.RatePerSec && rl.burst == float64(conf.Burst) {
+		return
+	}
 	now := time.Now()
+	rl.tokens = minF(rl.burst, rl.tokens+now.Sub(rl.last).Seconds()*rl.ratePerSec)
+	rl.last = now
+	rl.ratePerSec = conf.RatePerSec
+	rl.burst = float64(conf.Burst)
+	rl.tokens = minF(rl.burst, rl.tokens)
+}
+
+// tokenSlack absorbs the rounding error of summing many small refills: ten
+// refills of 0.1 add up to just under 1, and without it such a bucket would
+// wait a further call for each token, then lose the excess to the burst cap.
+const tokenSlack = 1e-9
+
+// allowAt is allowN against an explicit clock, so the bucket can be driven
+// through a simulated timeline. Refilling on every call, granted or not,
+// keeps admissions within one token of rate*seconds+burst over long runs.
+func (rl *rateLimiter) allowAt(now time.Time, cost float64) bool {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
 	elapsed := now.Sub(rl.last).Seconds()
 	rl.tokens = minF(rl.burst, rl.tokens+elapsed*rl.ratePerSec)
 	rl.last = now
 
-	if rl.tokens >= 1 {
-		rl.tokens -= 1
+	if rl.tokens+tokenSlack >= cost {
+		rl.tokens = math.Max(0, rl.tokens-cost)
 		return true
 	}
 	return false
 }
 
+// methodCost is how many tokens one call of method takes: its MethodCosts
+// entry, else 1.
+func methodCost(cfg Config, method string) float64 {
+	if cost, ok := cfg.MethodCosts[method]; ok {
+		return cost
+	}
+	return 1
+}
+
 func minF(a, b float64) float64 {
 	if a < b {
 		return a
@@ -137,125 +918,749 @@ func minF(a, b float64) float64 {
 // ===== RPC STRUCTS =====
 
 type RPCRequest struct {
-	JSONRPC string        `json:"jsonrpc"`
-	Method  string        `json:"method"`
-	Params  []interface{} `json:"params"`
-	ID      interface{}   `json:"id"`
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	// Params is []interface{} when positional, map[string]interface{} when
+	// named, or nil when omitted.
+	Params interface{} `json:"params"`
+	// ID keeps the client's exact bytes so large numeric ids are echoed
+	// without float64 rounding. It is empty for notifications, which carry
+	// no "id" at all; an explicit "id": null is still a call.
+	ID json.RawMessage `json:"id,omitempty"`
+}
+
+// positional returns the params when they were sent as an array.
+func (r *RPCRequest) positional() []interface{} {
+	p, _ := r.Params.([]interface{})
+	return p
+}
+
+// paramCount is the number of positional or named params.
+func (r *RPCRequest) paramCount() int {
+	switch p := r.Params.(type) {
+	case []interface{}:
+		return len(p)
+	case map[string]interface{}:
+		return len(p)
+	}
+	return 0
+}
+
+// isNotification reports whether the caller expects no response.
+func (r *RPCRequest) isNotification() bool {
+	return len(r.ID) == 0
+}
+
+// hasValidID reports whether the id is one JSON-RPC allows: a string, a
+// number or null. Notifications have none, which is valid too.
+func (r *RPCRequest) hasValidID() bool {
+	if r.isNotification() {
+		return true
+	}
+	switch c := r.ID[0]; {
+	case c == '"', c == '-', c >= '0' && c <= '9':
+		return true
+	}
+	return string(r.ID) == "null"
 }
 
 type RPCError struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
 }
 
 type RPCResponse struct {
-	JSONRPC string      `json:"jsonrpc"`
-	ID      interface{} `json:"id"`
-	Error   *RPCError   `json:"error,omitempty"`
-	Result  interface{} `json:"result,omitempty"`
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Error   *RPCError       `json:"error,omitempty"`
+	Result  interface{}     `json:"result,omitempty"`
 }
 
 // ===== MAIN ENTRY =====
 
+const (
+	defaultShutdownTimeout = 15 * time.Second
+	defaultListenAddr      = ":8545"
+)
+
+// listenAddr is where plain HTTP is served: the -listen flag, then
+// ListenAddr, then :8545.
+func listenAddr(cfg Config, flagAddr string) string {
+	if flagAddr != "" {
+		return flagAddr
+	}
+	if cfg.ListenAddr != "" {
+		return cfg.ListenAddr
+	}
+	return defaultListenAddr
+}
+
 func main() {
-	go loadConfig()
+	initLogging()
+	configFlag := flag.String("config", "", "path to config file (default $RPCGUARD_CONFIG or config.json)")
+	listenFlag := flag.String("listen", "", "address to serve HTTP on (default listen_addr from the config, or :8545)")
+	allowMissing := flag.Bool("allow-missing-config", false, "start without a config file, rejecting every call until one appears")
+	signFlag := flag.String("sign-admin", "", `print signature headers for an admin request, e.g. "DELETE /admin/limiters/1.2.3.4:eth_call", using admin_hmac_secret, then exit`)
+	flag.Parse()
+
+	configPath := resolveConfigPath(*configFlag)
+	if *signFlag != "" {
+		c, err := readConfig(configPath)
+		if err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+		method, uri, ok := strings.Cut(*signFlag, " ")
+		if !ok || c.AdminHMACSecret == "" {
+			log.Fatalf("-sign-admin needs \"METHOD /path\" and admin_hmac_secret in the config")
+		}
+		printAdminSignature(os.Stdout, c.AdminHMACSecret, method, uri)
+		return
+	}
+	initial, err := readConfig(configPath)
+	if err != nil {
+		// Only a missing file is tolerated; a broken one still stops the guard.
+		if !*allowMissing || !errors.Is(err, fs.ErrNotExist) {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+		log.Printf("🚨 No config at %s: serving unconfigured, every call is rejected and /readyz reports 503 until it appears", configPath)
+		initial = Config{unconfigured: true}
+	}
+	setConfig(initial)
+	addr := listenAddr(initial, *listenFlag)
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		log.Fatalf("Invalid listen address %q: %v", addr, err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := initTracing(ctx, initial)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
 
-	http.HandleFunc("/", handleRPC)
-	http.Handle("/metrics", promhttp.Handler())
+	initQuotas(initial)
+	go loadConfig(ctx, configPath)
+	go persistQuotas(ctx)
+	go sweepLimiters(ctx)
+	go reopenOnHangup(ctx)
 
-	log.Println("🛡️ Primea RPC Guard (with dynamic config) on :8545")
-	log.Fatal(http.ListenAndServe(":8545", nil))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", withAccessLog(withCORS(withCompression(handleRPC))))
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	mux.HandleFunc(wsPath(initial), withAccessLog(handleWS))
+	mux.HandleFunc("/admin/limiters", requireAdmin(handleAdminLimiters))
+	mux.HandleFunc("/admin/limiters/", requireAdmin(handleAdminLimiters))
+	mux.HandleFunc("/admin/reload", requireAdmin(handleAdminReload(configPath)))
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	// With MetricsAddr set, /metrics moves to its own listener so it can be
+	// firewalled off the public RPC port.
+	var metricsSrv *http.Server
+	if initial.MetricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.Handler())
+		metricsMux.HandleFunc("/healthz", handleHealthz)
+		metricsSrv = &http.Server{Addr: initial.MetricsAddr, Handler: metricsMux}
+	} else {
+		mux.Handle("/metrics", promhttp.Handler())
+	}
+
+	// Whether to terminate TLS is decided at startup; the certificate
+	// itself follows config and file changes.
+	useTLS := tlsEnabled(initial)
+	if useTLS {
+		if _, err := certs.GetCertificate(nil); err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		srv.Addr = tlsAddr(initial)
+		srv.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+		if initial.ClientCAFile != "" {
+			if err := enableClientCerts(srv.TLSConfig, initial.ClientCAFile); err != nil {
+				log.Fatalf("Failed to load client CA: %v", err)
+			}
+			log.Printf("🔐 Requiring client certificates issued by %s", initial.ClientCAFile)
+		}
+	}
+
+	go func() {
+		var err error
+		if useTLS {
+			log.Printf("🛡️ Primea RPC Guard (with dynamic config) on %s (TLS)", srv.Addr)
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("🛡️ Primea RPC Guard (with dynamic config) on %s", srv.Addr)
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed: %v", err)
+		}
+	}()
+	if metricsSrv != nil {
+		go func() {
+			log.Printf("📊 Metrics on %s", metricsSrv.Addr)
+			if err := metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Metrics server failed: %v", err)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	stop()
+	drain := defaultShutdownTimeout
+	if t := getConfig().ShutdownTimeout; t > 0 {
+		drain = time.Duration(t) * time.Millisecond
+	}
+	log.Printf("🛑 Shutting down, draining in-flight requests (up to %s)", drain)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("⚠️ Drain incomplete: %v", err)
+	}
+	// Kept up until the drain is done, so the last scrapes still see it.
+	if metricsSrv != nil {
+		if err := metricsSrv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("⚠️ Metrics server shutdown incomplete: %v", err)
+		}
+	}
+	saveQuotas()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Printf("⚠️ Trace export incomplete: %v", err)
+	}
+	log.Println("👋 RPC Guard stopped")
 }
 
 func handleRPC(w http.ResponseWriter, r *http.Request) {
-	body, _ := io.ReadAll(r.Body)
+	cfg := getConfig()
+	ex := newExchange(r, cfg)
+	w.Header().Set("X-Request-ID", ex.reqID)
+	ctx, span := startRequestSpan(r)
+	defer span.End()
+	ex.ctx = ctx
+
+	// JSON-RPC over HTTP is POST only; CORS preflights never get this far.
+	if r.Method != http.MethodPost {
+		allow := "POST"
+		if len(cfg.CORSOrigins) > 0 {
+			allow = "POST, OPTIONS"
+		}
+		w.Header().Set("Allow", allow)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if cfg.unconfigured {
+		ex.logDecision("", "reject", notConfigured.reason, 0, nil)
+		ex.rejectMetric(w, nil, "", notConfigured)
+		return
+	}
+	// Checked before anything else, the body included, is looked at.
+	if rej := ex.checkDenied(); rej != nil {
+		ex.logDecision("", "reject", rej.reason, 0, nil)
+		ex.rejectMetric(w, nil, "", rej)
+		return
+	}
+	if rej := ex.checkMaintenance(); rej != nil {
+		ex.logDecision("", "reject", rej.reason, 0, nil)
+		setMaintenanceRetry(w, cfg)
+		ex.rejectMetric(w, nil, "", rej)
+		return
+	}
+	if rej := ex.checkClientCert(r); rej != nil {
+		ex.logDecision("", "reject", rej.reason, 0, nil)
+		ex.rejectMetric(w, nil, "", rej)
+		return
+	}
+
+	// A cheap filter for bots posting forms or binary junk.
+	if cfg.RequireJSONType && !isJSONContentType(r.Header.Get("Content-Type")) {
+		ex.logDecision("", "reject", "unsupported_media_type", 0, nil)
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if rej := ex.identify(r); rej != nil {
+		ex.logDecision("", "reject", rej.reason, 0, nil)
+		ex.rejectMetric(w, nil, "", rej)
+		return
+	}
+
+	// Taken before reading the body, so slow uploads count against the quota.
+	if cfg.MaxConcurrentPerIP > 0 && !ex.allowlisted {
+		if !acquireSlot(ex.ip, cfg.MaxConcurrentPerIP) {
+			ex.logDecision("", "reject", tooManyConcurrent.reason, 0, nil)
+			ex.rejectMetric(w, nil, "", tooManyConcurrent)
+			return
+		}
+		defer releaseSlot(ex.ip)
+	}
+
+	// Anything not read in full is refused outright, so a truncated body never
+	// reaches batch detection or the JSON parser.
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBytes(cfg))
+	body, err := readBody(r, maxRequestBytes(cfg))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) || errors.Is(err, errBodyTooLarge) {
+			rej := &rejection{"request_too_large", "Request body too large"}
+			ex.logDecision("", "reject", rej.reason, 0, nil)
+			ex.rejectMetric(w, nil, "", rej)
+			return
+		}
+		if errors.Is(err, errUnsupportedEncoding) {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		http.Error(w, "invalid JSON-RPC", 400)
+		return
+	}
+
+	if isBatch(body) {
+		handleBatch(w, ex, body)
+		return
+	}
+
 	var req RPCRequest
 	if err := json.Unmarshal(body, &req); err != nil {
+		ex.logDecision("", "reject", "invalid_json", 0, nil)
 		http.Error(w, "invalid JSON-RPC", 400)
 		return
 	}
+	label := methodLabel(cfg, req.Method)
+	requestBytes.WithLabelValues(label).Observe(float64(len(body)))
+	methodsInFlight.WithLabelValues(label).Inc()
+	defer methodsInFlight.WithLabelValues(label).Dec()
 
-	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-	cfg := getConfig()
+	rej := checkRequest(ex, &req, body)
+	ex.setQuotaHeaders(w)
+	if rej != nil {
+		ex.logDecision(req.Method, "reject", rej.reason, 0, nil)
+		if req.isNotification() {
+			// Counted like any rejection, but nobody waits for the error.
+			ex.rejectResponse(req.ID, req.Method, rej)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if wait, ok := ex.retryAfter(&req, rej); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		}
+		ex.rejectMetric(w, req.ID, req.Method, rej)
+		return
+	}
+
+	// === Serve from cache ===
+	store, key := cacheFor(cfg, &req)
+	if store != nil && !req.isNotification() {
+		if result, ok := store.get(cfg, key); ok {
+			cacheLookups.WithLabelValues(req.Method, "hit").Inc()
+			ex.countAccept(req.Method)
+			ex.logDecision(req.Method, "accept", "", 0, nil)
+			writeCachedResult(w, req.ID, result)
+			return
+		}
+		cacheLookups.WithLabelValues(req.Method, "miss").Inc()
+	}
 
-	// === Rate limiting per IP per method ===
-	if limCfg, ok := cfg.RateLimits[req.Method]; ok {
-		limiter := getLimiter(ip, req.Method, limCfg)
-		if !limiter.allow() {
-			rejectMetric(w, req.ID, req.Method, "rate_limited", ip, "Too many requests")
+	// === Accept + forward ===
+	start := time.Now()
+	resp, err := forwardOrFallback(ex.ctx, withRoute(cfg, methodRoute(cfg, req.Method)), []string{req.Method}, body, ex.header)
+	elapsed := time.Since(start)
+	if isClientCancel(err) {
+		// Nobody is left to answer.
+		ex.countCancel(req.Method, elapsed)
+		return
+	}
+	if errors.Is(err, errUpstreamBusy) {
+		ex.logDecision(req.Method, "reject", errBusyRejection.reason, elapsed, nil)
+		if req.isNotification() {
+			ex.rejectResponse(req.ID, req.Method, errBusyRejection)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		ex.rejectMetric(w, req.ID, req.Method, errBusyRejection)
+		return
+	}
+	ex.countAccept(req.Method)
+	upstreamDuration.WithLabelValues(label).Observe(elapsed.Seconds())
+	ex.logDecision(req.Method, "accept", "", elapsed, err)
+	if req.isNotification() && (err == nil || answeredInBand(err)) {
+		// Whatever the upstream sent back (usually nothing) is dropped.
+		if err == nil {
+			resp.Body.Close()
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		if answeredInBand(err) {
+			writeJSON(w, http.StatusOK, upstreamErrorResponse(req.ID, err))
 			return
 		}
+		http.Error(w, "upstream RPC failed", 502)
+		return
+	}
+	defer resp.Body.Close()
+	if store != nil {
+		err = relayAndCache(w, resp, cfg, label, store, key)
+	} else {
+		err = relayUpstream(w, resp, cfg, label)
+	}
+	if err != nil {
+		// Nothing was written yet.
+		writeJSON(w, http.StatusOK, upstreamErrorResponse(req.ID, err))
+	}
+}
+
+// retryAfter tells a rate-limited caller how long to back off: the wait on
+// the bucket that refused it, at least one second since Retry-After has no
+// finer unit. ok is false for other rejections.
+func (ex *exchange) retryAfter(req *RPCRequest, rej *rejection) (time.Duration, bool) {
+	method := req.Method
+	var lim limiter
+	switch rej.reason {
+	case "rate_limited":
+		conf, _ := rateLimitFor(ex.cfg, ex.tier, method)
+		lim = getLimiter(ex.cfg, ex.subject, method, conf)
+	case "global_rate_limited":
+		lim = getGlobalLimiter(ex.cfg, method, ex.cfg.GlobalRateLimits[method])
+	default:
+		return 0, false
+	}
+	return max(lim.wait(callCost(ex.cfg, req)), time.Second), true
+}
+
+func (ex *exchange) countAccept(method string) {
+	accepts.WithLabelValues(method, metricIP(ex.cfg, ex.ip), strconv.FormatBool(ex.allowlisted)).Inc()
+	tierDecisions.WithLabelValues(ex.tierLabel(), methodLabel(ex.cfg, method), "accept").Inc()
+	decisions.WithLabelValues(methodLabel(ex.cfg, method), "accept").Inc()
+}
+
+// countCancel records a call the client abandoned while it was upstream, in
+// place of the accept it would otherwise have been counted as.
+func (ex *exchange) countCancel(method string, elapsed time.Duration) {
+	clientCancels.WithLabelValues(methodLabel(ex.cfg, method)).Inc()
+	ex.logDecision(method, "client_abort", "", elapsed, nil)
+}
+
+// rejection describes why a guard refused a single JSON-RPC call.
+type rejection struct {
+	reason string
+	msg    string
+}
+
+// reasonCodes gives each rejection reason its own JSON-RPC error code so
+// clients can branch on it; the reason itself is also sent as error.data.
+// Standard codes are used where the spec has one, the rest sit in the
+// -32000..-32099 server range. Unlisted reasons fall back to -32000.
+var reasonCodes = map[string]int{
+	"invalid_request":        -32600,
+	"request_too_large":      -32600,
+	"method_blocked":         -32601,
+	"method_near_miss":       -32601,
+	"no_param":               -32602,
+	"invalid_tx_hex":         -32602,
+	"malformed_tx":           -32602,
+	"too_many_params":        -32602,
+	"named_params":           -32602,
+	"not_configured":         -32003,
+	"upstream_busy":          -32004,
+	"rate_limited":           -32005,
+	"global_rate_limited":    -32006,
+	"too_many_concurrent":    -32007,
+	"invalid_api_key":        -32008,
+	"ip_denied":              -32009,
+	"low_gas_price":          -32010,
+	"gas_limit_too_high":     -32011,
+	"wrong_chain_id":         -32012,
+	"unprotected_tx":         -32013,
+	"blocked_sender":         -32014,
+	"invalid_signature":      -32015,
+	"nonce_gap_too_large":    -32016,
+	"tip_too_low":            -32017,
+	"tx_too_large":           -32018,
+	"low_blob_gas_price":     -32019,
+	"log_range":              -32020,
+	"log_filter_too_complex": -32021,
+	"invalid_block_range":    -32022,
+	"block_range_unknown":    -32028,
+	"fee_history_range":      -32023,
+	"quota_exceeded":         -32024,
+	"full_block_denied":      -32025,
+	"client_cert_missing":    -32026,
+	"log_result_too_large":   -32027,
+	"call_too_large":         -32030,
+	"would_revert":           -32031,
+}
+
+func reasonCode(reason string) int {
+	if code, ok := reasonCodes[reason]; ok {
+		return code
 	}
+	return -32000
+}
+
+// exchange is the per-HTTP-request state shared by the single, batch and
+// WebSocket paths.
+type exchange struct {
+	cfg   Config
+	ip    string
+	reqID string
+	// tier is the API-key tier, empty for anonymous callers. subject is the
+	// identity rate limits are keyed on: the client IP or the API key.
+	tier    string
+	subject string
+	// header is what the upstream request carries besides Content-Type.
+	header http.Header
+	// ctx is the client request's context; upstream calls are abandoned
+	// when it is cancelled.
+	ctx context.Context
+	// allowlisted callers (AllowlistedIPs) bypass every guard.
+	allowlisted bool
+	// certNames identify a verified client certificate, if mutual TLS is on.
+	certNames []string
+	// quota is what the subject has left, once a call was checked against
+	// Quota.
+	quota *quotaLeft
+	// access collects the request's access log line; nil when that is off.
+	access *accessRecord
+}
 
+func newExchange(r *http.Request, cfg Config) *exchange {
+	ip := clientIP(r, cfg)
+	reqID := requestID(r)
+	access := accessRecordFor(r)
+	if access != nil {
+		access.ip, access.reqID = ip, reqID
+	}
+	return &exchange{
+		cfg:         cfg,
+		ip:          ip,
+		reqID:       reqID,
+		subject:     ip,
+		header:      upstreamHeaders(r, cfg, ip, reqID),
+		ctx:         r.Context(),
+		allowlisted: isAllowlisted(cfg, ip),
+		access:      access,
+	}
+}
+
+// isAllowlisted matches the resolved client IP, so behind TrustedProxies it
+// is the X-Forwarded-For client that has to be on the list.
+func isAllowlisted(cfg Config, ip string) bool {
+	return ipInNets(net.ParseIP(ip), cfg.allowlistedNets)
+}
+
+// checkRequest runs rate limiting and the method-specific guards for one call,
+// req being raw as parsed. It returns nil when the call may be forwarded
+// upstream. In shadow mode a
+// refusal is only counted and logged, and the call goes upstream as if it had
+// passed; a malformed envelope is still refused as there is nothing to forward.
+func checkRequest(ex *exchange, req *RPCRequest, raw []byte) *rejection {
+	// Reached by frames on WebSockets opened before maintenance began.
+	if rej := ex.checkMaintenance(); rej != nil {
+		return rej
+	}
+	rej := runGuards(ex, req, raw)
+	if rej == nil || !ex.cfg.ShadowMode || rej.reason == "invalid_request" {
+		return rej
+	}
+	wouldRejects.WithLabelValues(methodLabel(ex.cfg, req.Method), rej.reason).Inc()
+	ex.logDecision(req.Method, "would_reject", rej.reason, 0, nil)
+	return nil
+}
+
+func runGuards(ex *exchange, req *RPCRequest, raw []byte) *rejection {
+	cfg := ex.cfg
+	// Malformed envelopes are refused first so they never consume tokens.
+	if !req.hasValidID() {
+		// There's no usable id to echo; the error goes out with id null.
+		req.ID = json.RawMessage("null")
+		return &rejection{"invalid_request", "Invalid request: id must be a string, number or null"}
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return &rejection{"invalid_request", "Invalid request"}
+	}
+	switch req.Params.(type) {
+	case nil, []interface{}, map[string]interface{}:
+	default:
+		// JSON-RPC only allows params to be an array or an object.
+		return &rejection{"invalid_request", "Invalid request"}
+	}
+	if cfg.StrictJSONRPC {
+		if err := checkStrict(raw); err != nil {
+			return &rejection{"invalid_request", "Invalid request: " + err.Error()}
+		}
+	}
+	// Internal services are only held to a well-formed envelope.
+	if ex.allowlisted {
+		return nil
+	}
+
+	if rej := checkMethodName(cfg, req.Method); rej != nil {
+		return rej
+	}
+	// Blocked methods are refused before they can consume rate-limit tokens.
+	if !methodPermitted(cfg, req.Method) {
+		return &rejection{"method_blocked", "Method not found"}
+	}
+	if rej := ex.checkFullBlock(req); rej != nil {
+		return rej
+	}
+	if cfg.MaxParamsCount > 0 && req.paramCount() > cfg.MaxParamsCount {
+		return &rejection{"too_many_params", "Too many params"}
+	}
+
+	// === Rate limiting per IP (or API key) per method ===
+	if limCfg, ok := rateLimitFor(cfg, ex.tier, req.Method); ok {
+		if !getLimiter(cfg, ex.subject, req.Method, limCfg).allowN(callCost(cfg, req)) {
+			return &rejection{"rate_limited", "Too many requests"}
+		}
+	}
+	// Checked after the per-IP bucket so one noisy IP can't drain the shared one.
+	if limCfg, ok := cfg.GlobalRateLimits[req.Method]; ok {
+		if !getGlobalLimiter(cfg, req.Method, limCfg).allowN(callCost(cfg, req)) {
+			return &rejection{"global_rate_limited", "Too many requests"}
+		}
+	}
 	// === Special Handling ===
+	if _, named := req.Params.(map[string]interface{}); named && guardedMethods[req.Method] {
+		// The guards below read params by position; don't let named
+		// params route around them.
+		return &rejection{"named_params", "Named params not supported for " + req.Method}
+	}
 	switch req.Method {
 	case "eth_sendRawTransaction":
-		if len(req.Params) == 0 {
-			rejectMetric(w, req.ID, req.Method, "no_param", ip, "Missing tx param")
-			return
-		}
-		rawTxHex, _ := req.Params[0].(string)
-		txBytes, _ := decodeHex(rawTxHex)
-		var tx types.Transaction
-		if err := rlp.DecodeBytes(txBytes, &tx); err == nil {
-			minGas := big.NewInt(0).Mul(big.NewInt(cfg.MinGasPriceGwei), big.NewInt(1_000_000_000))
-			if tx.GasPrice().Cmp(minGas) < 0 {
-				rejectMetric(w, req.ID, req.Method, "low_gas_price", ip, "Gas price too low")
-				return
-			}
+		if rej := checkRawTx(cfg, req.positional()); rej != nil {
+			return rej
 		}
 
 	case "eth_getLogs":
-		if len(req.Params) > 0 {
-			filter, _ := req.Params[0].(map[string]interface{})
-			from, to := blockNum(filter["fromBlock"]), blockNum(filter["toBlock"])
-			if from != nil && to != nil && to.Sub(to, from).Cmp(big.NewInt(cfg.LogBlockRangeLimit)) > 0 {
-				rejectMetric(w, req.ID, req.Method, "log_range", ip, "Log range too wide")
-				return
-			}
+		if rej := checkGetLogs(cfg, req.positional()); rej != nil {
+			return rej
+		}
+
+	case "eth_call":
+		if rej := checkCall(cfg, req.positional()); rej != nil {
+			return rej
+		}
+
+	case "eth_feeHistory":
+		if rej := checkFeeHistory(cfg, req.positional()); rej != nil {
+			return rej
 		}
 	}
+	// Last, so only calls every other guard let through use up quota.
+	return ex.checkQuota(time.Now())
+}
 
-	// === Accept + forward ===
-	accepts.WithLabelValues(req.Method, ip).Inc()
-	resp, err := http.Post(cfg.GethRPC, "application/json", bytes.NewReader(body))
+// guardedMethods have params-inspecting guards in runGuards.
+var guardedMethods = map[string]bool{
+	"eth_sendRawTransaction": true,
+	"eth_getLogs":            true,
+	"eth_call":               true,
+	"eth_feeHistory":         true,
+	"eth_getBlockByNumber":   true,
+	"eth_getBlockByHash":     true,
+}
+
+// reasonStatuses is the HTTP status sent with a rejected single call, so
+// HTTP-layer clients and CDNs see throttling and refusals too. Policy
+// rejections of a well-formed call (gas price, log range, …) keep 200, as
+// the JSON-RPC error is the answer. Batches and WebSocket frames always
+// use 200 since their elements can fail for different reasons.
+var reasonStatuses = map[string]int{
+	"invalid_request":     http.StatusBadRequest,
+	"no_param":            http.StatusBadRequest,
+	"invalid_tx_hex":      http.StatusBadRequest,
+	"malformed_tx":        http.StatusBadRequest,
+	"method_near_miss":    http.StatusBadRequest,
+	"too_many_params":     http.StatusBadRequest,
+	"named_params":        http.StatusBadRequest,
+	"request_too_large":   http.StatusRequestEntityTooLarge,
+	"invalid_api_key":     http.StatusUnauthorized,
+	"method_blocked":      http.StatusForbidden,
+	"full_block_denied":   http.StatusForbidden,
+	"blocked_sender":      http.StatusForbidden,
+	"ip_denied":           http.StatusForbidden,
+	"client_cert_missing": http.StatusForbidden,
+	"rate_limited":        http.StatusTooManyRequests,
+	"global_rate_limited": http.StatusTooManyRequests,
+	"too_many_concurrent": http.StatusTooManyRequests,
+	"quota_exceeded":      http.StatusTooManyRequests,
+	"upstream_busy":       http.StatusServiceUnavailable,
+	"not_configured":      http.StatusServiceUnavailable,
+	"maintenance":         http.StatusServiceUnavailable,
+	"block_range_unknown": http.StatusServiceUnavailable,
+}
+
+func reasonStatus(reason string) int {
+	if status, ok := reasonStatuses[reason]; ok {
+		return status
+	}
+	return http.StatusOK
+}
+
+func (ex *exchange) rejectMetric(w http.ResponseWriter, id json.RawMessage, method string, rej *rejection) {
+	writeJSON(w, reasonStatus(rej.reason), ex.rejectResponse(id, method, rej))
+}
+
+// writeJSON sends v as a JSON body with status. v is encoded before anything
+// is written, so an encoding failure becomes a clean 500; a failed write
+// only means the client has gone and is logged at debug level.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
 	if err != nil {
-		http.Error(w, "upstream RPC failed", 502)
+		slog.Error("encoding reply failed", slog.String("error", err.Error()))
+		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
-	io.Copy(w, resp.Body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(append(body, '\n')); err != nil {
+		slog.Debug("writing reply failed", slog.String("error", err.Error()))
+	}
 }
 
-func rejectMetric(w http.ResponseWriter, id interface{}, method, reason, ip, msg string) {
-	rejects.WithLabelValues(method, reason, ip).Inc()
-	json.NewEncoder(w).Encode(RPCResponse{
+// rejectResponse records the rejection and builds the JSON-RPC error object.
+func (ex *exchange) rejectResponse(id json.RawMessage, method string, rej *rejection) RPCResponse {
+	rejects.WithLabelValues(method, rej.reason, metricIP(ex.cfg, ex.ip)).Inc()
+	tierDecisions.WithLabelValues(ex.tierLabel(), methodLabel(ex.cfg, method), "reject").Inc()
+	decisions.WithLabelValues(methodLabel(ex.cfg, method), "reject").Inc()
+	return RPCResponse{
 		JSONRPC: "2.0",
 		ID:      id,
 		Error: &RPCError{
-			Code:    -32000,
-			Message: msg,
+			Code:    reasonCode(rej.reason),
+			Message: rej.msg,
+			Data:    rej.reason,
 		},
-	})
+	}
 }
 
 func decodeHex(s string) ([]byte, error) {
-	if strings.HasPrefix(s, "0x") {
-		s = s[2:]
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	if s == "" {
+		return nil, fmt.Errorf("empty hex string")
 	}
-	bigint, ok := new(big.Int).SetString(s, 16)
-	if !ok {
-		return nil, fmt.Errorf("invalid hex: %s", s)
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex: %w", err)
 	}
-	return bigint.Bytes(), nil
+	return b, nil
 }
 
+// blockNum parses a hex quantity such as a block number, with the 0x or 0X
+// prefix geth requires. It returns nil for anything else.
 func blockNum(val interface{}) *big.Int {
 	s, ok := val.(string)
-	if !ok || !strings.HasPrefix(s, "0x") {
+	if !ok || len(s) < 3 || (s[:2] != "0x" && s[:2] != "0X") {
+		return nil
+	}
+	n, ok := new(big.Int).SetString(s[2:], 16)
+	if !ok || n.Sign() < 0 {
 		return nil
 	}
-	n := new(big.Int)
-	n.SetString(s[2:], 16)
 	return n
 }
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// rpcUpstream is a fake node: answer gets each call's method and params and
+// returns its result, or an *RPCError to fail it. Batches are answered call
+// by call.
+func rpcUpstream(t testing.TB, answer func(method string, params json.RawMessage) interface{}) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		type call struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		reply := func(c call) map[string]interface{} {
+			out := map[string]interface{}{"jsonrpc": "2.0", "id": c.ID}
+			switch res := answer(c.Method, c.Params).(type) {
+			case *RPCError:
+				out["error"] = res
+			default:
+				out["result"] = res
+			}
+			return out
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+			var calls []call
+			json.Unmarshal(body, &calls)
+			replies := make([]map[string]interface{}, len(calls))
+			for i, c := range calls {
+				replies[i] = reply(c)
+			}
+			json.NewEncoder(w).Encode(replies)
+			return
+		}
+		var c call
+		json.Unmarshal(body, &c)
+		json.NewEncoder(w).Encode(reply(c))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testConfig is a valid config pointing at upstream, with the defaults a
+// test doesn't care about.
+func testConfig(upstream string) Config {
+	return Config{GethRPC: upstream, LogBlockRangeLimit: 100}
+}
+
+// postRPC sends body to handler as a JSON-RPC POST from 192.0.2.1.
+func postRPC(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	return postRPCFrom(handler, "192.0.2.1:1234", body)
+}
+
+// postRPCFrom is postRPC from the peer remoteAddr.
+func postRPCFrom(handler http.HandlerFunc, remoteAddr, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = remoteAddr
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+// useConfig installs cfg as the live config for the rest of the test.
+func useConfig(t *testing.T, cfg Config) {
+	t.Helper()
+	prev := getConfig()
+	setConfig(cfg)
+	t.Cleanup(func() { setConfig(prev) })
+}
+
+// resetLimiters starts the test with no rate-limit buckets and drops the
+// ones it made when it ends.
+func resetLimiters(t *testing.T) {
+	reset := func() {
+		limiterLock.Lock()
+		ipLimiters = make(map[string]limiter)
+		limiterLRU = list.New()
+		limiterPos = make(map[string]*list.Element)
+		limiterLock.Unlock()
+		globalLimiterLock.Lock()
+		globalLimiters = make(map[string]limiter)
+		globalLimiterLock.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// testReply is a JSON-RPC reply as a client decodes it.
+type testReply struct {
+	ID     json.RawMessage `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *RPCError       `json:"error"`
+}
+
+// reason is the rejection reason the guard put in the error's data: "" for
+// a result, or for an error the upstream sent.
+func (r testReply) reason() string {
+	if r.Error == nil {
+		return ""
+	}
+	reason, _ := r.Error.Data.(string)
+	return reason
+}
+
+func TestEnvelopeValidation(t *testing.T) {
+	resetLimiters(t)
+	cfg := testConfig(okUpstream(t).URL)
+	cfg.DefaultRateLimit = &RateLimitConfig{RatePerSec: 0.001, Burst: 1}
+	useConfig(t, cfg)
+
+	cases := []struct {
+		name string
+		body string
+	}{
+		{"empty method", `{"jsonrpc":"2.0","id":1,"method":""}`},
+		{"missing method", `{"jsonrpc":"2.0","id":1}`},
+		{"wrong version", `{"jsonrpc":"1.0","id":1,"method":"eth_blockNumber"}`},
+		{"missing version", `{"id":1,"method":"eth_blockNumber"}`},
+		{"scalar params", `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":"0x1"}`},
+	}
+	for _, c := range cases {
+		rec := postRPC(handleRPC, c.body)
+		var reply testReply
+		json.Unmarshal(rec.Body.Bytes(), &reply)
+		if rec.Code != http.StatusBadRequest || reply.Error == nil || reply.Error.Code != -32600 {
+			t.Errorf("%s: got %d %s, want 400 with -32600", c.name, rec.Code, rec.Body)
+		}
+	}
+
+	// None of those took the one token the bucket holds.
+	rec := postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`)
+	if rec.Code != http.StatusOK {
+		t.Errorf("valid call after malformed ones: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	resetLimiters(t)
+	var forwarded atomic.Int32
+	srv := rpcUpstream(t, func(string, json.RawMessage) interface{} {
+		forwarded.Add(1)
+		return "0x1"
+	})
+	cfg := testConfig(srv.URL)
+	cfg.MaxRequestBytes = 256
+	useConfig(t, cfg)
+
+	call := `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[{"data":"0x%s"},"latest"]}`
+	pad := func(n int) string { return strings.Repeat("ab", n) }
+	// Trailing whitespace is still valid JSON.
+	atLimit := fmt.Sprintf(call, pad(10))
+	atLimit += strings.Repeat(" ", 256-len(atLimit))
+	cases := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"small", fmt.Sprintf(call, pad(10)), http.StatusOK},
+		{"exactly at the limit", atLimit, http.StatusOK},
+		{"one byte over", atLimit + " ", http.StatusRequestEntityTooLarge},
+		{"far over", fmt.Sprintf(call, pad(10000)), http.StatusRequestEntityTooLarge},
+		// A batch cut off at the limit must not be mistaken for a smaller one.
+		{"oversized batch", "[" + strings.Repeat(fmt.Sprintf(call, pad(10))+",", 10) + fmt.Sprintf(call, pad(10)) + "]", http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		forwarded.Store(0)
+		rec := postRPC(handleRPC, c.body)
+		if rec.Code != c.status {
+			t.Errorf("%s (%d bytes): status %d, want %d", c.name, len(c.body), rec.Code, c.status)
+			continue
+		}
+		if c.status != http.StatusRequestEntityTooLarge {
+			continue
+		}
+		var reply testReply
+		if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil || reply.reason() != "request_too_large" {
+			t.Errorf("%s: body %s, want a request_too_large error", c.name, rec.Body)
+		}
+		if forwarded.Load() != 0 {
+			t.Errorf("%s: oversized body reached the upstream", c.name)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	valid := `"geth_rpc":"http://127.0.0.1:8545","log_block_range_limit":100`
+	cases := []struct {
+		name  string
+		extra string
+		field string // "" when the config is valid
+	}{
+		{"minimal", ``, ""},
+		{"negative rate", `,"rate_limits":{"eth_call":{"rate_per_sec":-1,"burst":5}}`, "rate_limits.eth_call.rate_per_sec"},
+		{"zero burst", `,"rate_limits":{"eth_call":{"rate_per_sec":1,"burst":0}}`, "rate_limits.eth_call.burst"},
+		{"zero default burst", `,"default_rate_limit":{"rate_per_sec":1}`, "default_rate_limit.burst"},
+		{"bad tier limit", `,"tiers":{"pro":{"rate_limits":{"eth_call":{"rate_per_sec":1}}}}`, "tiers.pro.rate_limits.eth_call.burst"},
+		{"file upstream", `,"geth_rpc":"file:///etc/passwd"`, "geth_rpc"},
+		{"relative upstream", `,"geth_rpc":"localhost:8545"`, "geth_rpc"},
+		{"pool member", `,"geth_rpcs":["http://a:8545","ftp://b"]`, "geth_rpcs[1]"},
+		{"zero log range", `,"log_block_range_limit":0`, "log_block_range_limit"},
+		{"negative gas price", `,"min_gas_price_gwei":-1`, "min_gas_price_gwei"},
+		{"bad cidr", `,"trusted_proxies":["10.0.0.0/33"]`, "trusted_proxies[0]"},
+		{"unknown algorithm", `,"limiter_algorithm":"leaky"`, "limiter_algorithm"},
+		{"unknown tier", `,"api_keys":{"secret-key":"gold"}`, "api_keys"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var cfg Config
+			if err := json.Unmarshal([]byte("{"+valid+c.extra+"}"), &cfg); err != nil {
+				t.Fatal(err)
+			}
+			err := validateConfig(cfg)
+			switch {
+			case c.field == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case c.field != "" && (err == nil || !strings.HasPrefix(err.Error(), c.field+":")):
+				t.Errorf("error %v, want one for %s", err, c.field)
+			}
+		})
+	}
+}
+
+func TestReloadKeepsPreviousConfigWhenInvalid(t *testing.T) {
+	path := t.TempDir() + "/config.json"
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	useConfig(t, getConfig())
+
+	write(`{"geth_rpc":"http://127.0.0.1:8545","log_block_range_limit":100}`)
+	reloadConfig(path)
+	if getConfig().LogBlockRangeLimit != 100 {
+		t.Fatalf("valid config not applied: %+v", getConfig())
+	}
+	for _, bad := range []string{
+		`{"geth_rpc":"http://127.0.0.1:8545","log_block_range_limit":100,"rate_limits":{"eth_call":{"rate_per_sec":-5,"burst":1}}}`,
+		`{"geth_rpc":"http://127.0.0.1:8545","log_block_range_limit":5`,
+		`{"geth_rpc":"not a url","log_block_range_limit":5}`,
+	} {
+		write(bad)
+		reloadConfig(path)
+		if cfg := getConfig(); cfg.LogBlockRangeLimit != 100 || len(cfg.RateLimits) != 0 {
+			t.Errorf("invalid update %s was applied", bad)
+		}
+	}
+}
+
+func TestRejectionCodes(t *testing.T) {
+	resetLimiters(t)
+	resetHead(t)
+	cfg := testConfig(rpcUpstream(t, func(string, json.RawMessage) interface{} { return "0x1000" }).URL)
+	cfg.RateLimits = map[string]RateLimitConfig{"eth_chainId": {RatePerSec: 0.001, Burst: 1}}
+	cfg.BlockedMethods = []string{"admin_peers"}
+	cfg.MaxParamsCount = 3
+	cfg.MinGasPriceGwei = 2
+	useConfig(t, cfg)
+
+	cases := []struct {
+		body   string
+		reason string
+		code   int
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`, "", 0},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`, "rate_limited", -32005},
+		{`{"jsonrpc":"2.0","id":1,"method":"admin_peers"}`, "method_blocked", -32601},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[1,2,3,4]}`, "too_many_params", -32602},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_sendRawTransaction","params":[]}`, "no_param", -32602},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_sendRawTransaction","params":["0xzz"]}`, "invalid_tx_hex", -32602},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_sendRawTransaction","params":["0xdeadbeef"]}`, "malformed_tx", -32602},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x0"}]}`, "log_range", -32020},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x9","toBlock":"0x1"}]}`, "invalid_block_range", -32022},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":{"fromBlock":"0x0"}}`, "named_params", -32602},
+	}
+	for _, c := range cases {
+		rec := postRPC(handleRPC, c.body)
+		var reply testReply
+		if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+			t.Fatalf("%s: reply %s: %v", c.body, rec.Body, err)
+		}
+		if reply.reason() != c.reason || (c.code != 0 && reply.Error.Code != c.code) {
+			t.Errorf("%s: got %s, want reason %q code %d", c.body, rec.Body, c.reason, c.code)
+		}
+	}
+	raw := signedTx(t, gweiTx(21_000, 1))
+	rec := postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"eth_sendRawTransaction","params":["`+raw+`"]}`)
+	var reply testReply
+	json.Unmarshal(rec.Body.Bytes(), &reply)
+	if reply.reason() != "low_gas_price" || reply.Error.Code != -32010 {
+		t.Errorf("cheap tx: got %s, want low_gas_price -32010", rec.Body)
+	}
+}
+
+// TestReasonCodesDocumented keeps the README's code table and reasonCodes
+// in step.
+func TestReasonCodesDocumented(t *testing.T) {
+	readme, err := os.ReadFile("README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	documented := map[string]int{}
+	for _, line := range strings.Split(string(readme), "\n") {
+		cells := strings.Split(line, "|")
+		if len(cells) != 4 || !strings.HasPrefix(strings.TrimSpace(cells[1]), "`") {
+			continue
+		}
+		var code int
+		if _, err := fmt.Sscanf(strings.Trim(strings.TrimSpace(cells[2]), "`"), "%d", &code); err != nil {
+			continue
+		}
+		for _, r := range strings.Split(cells[1], ",") {
+			documented[strings.Trim(strings.TrimSpace(r), "`")] = code
+		}
+	}
+	for reason, code := range reasonCodes {
+		if documented[reason] != code {
+			t.Errorf("%s: code %d, README says %d", reason, code, documented[reason])
+		}
+	}
+	for reason := range documented {
+		if _, ok := reasonCodes[reason]; !ok {
+			t.Errorf("README documents %s, which has no code", reason)
+		}
+	}
+}
+
+func TestIDRoundTrip(t *testing.T) {
+	resetLimiters(t)
+	cfg := testConfig(okUpstream(t).URL)
+	cfg.BlockedMethods = []string{"admin_peers"}
+	useConfig(t, cfg)
+
+	ids := []string{
+		"9007199254740993", // 2^53+1, not representable as a float64
+		"18446744073709551616",
+		"-1",
+		"1.5",
+		"1e3",
+		`"abc"`,
+		`"9007199254740993"`,
+		`""`,
+		"null",
+	}
+	for _, id := range ids {
+		for _, method := range []string{"eth_chainId", "admin_peers"} {
+			rec := postRPC(handleRPC, `{"jsonrpc":"2.0","id":`+id+`,"method":"`+method+`"}`)
+			var reply testReply
+			if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+				t.Fatalf("id %s, %s: reply %s: %v", id, method, rec.Body, err)
+			}
+			if string(reply.ID) != id {
+				t.Errorf("id %s, %s: echoed %s", id, method, reply.ID)
+			}
+		}
+	}
+
+	// Batch replies keep each element's id verbatim too.
+	rec := postRPC(handleRPC, `[{"jsonrpc":"2.0","id":9007199254740993,"method":"eth_chainId"},{"jsonrpc":"2.0","id":"x","method":"admin_peers"}]`)
+	var replies []testReply
+	if err := json.Unmarshal(rec.Body.Bytes(), &replies); err != nil || len(replies) != 2 {
+		t.Fatalf("batch reply %s: %v", rec.Body, err)
+	}
+	if string(replies[0].ID) != "9007199254740993" || string(replies[1].ID) != `"x"` {
+		t.Errorf("batch ids %s, %s", replies[0].ID, replies[1].ID)
+	}
+}
+
+func TestRejectionStatus(t *testing.T) {
+	resetLimiters(t)
+	resetHead(t)
+	cfg := testConfig(rpcUpstream(t, func(string, json.RawMessage) interface{} { return "0x1000" }).URL)
+	cfg.RateLimits = map[string]RateLimitConfig{"eth_chainId": {RatePerSec: 0.5, Burst: 1}}
+	cfg.BlockedMethods = []string{"admin_peers"}
+	useConfig(t, cfg)
+
+	cases := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"accepted", `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`, http.StatusOK},
+		{"rate limited", `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`, http.StatusTooManyRequests},
+		{"malformed", `{"jsonrpc":"2.0","id":1}`, http.StatusBadRequest},
+		{"blocked", `{"jsonrpc":"2.0","id":1,"method":"admin_peers"}`, http.StatusForbidden},
+		{"policy", `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x0"}]}`, http.StatusOK},
+		// A batch's elements can fail differently, so it is always 200.
+		{"batch", `[{"jsonrpc":"2.0","id":1,"method":"admin_peers"},{"jsonrpc":"2.0","id":2}]`, http.StatusOK},
+	}
+	for _, c := range cases {
+		rec := postRPC(handleRPC, c.body)
+		if rec.Code != c.status {
+			t.Errorf("%s: status %d, want %d", c.name, rec.Code, c.status)
+		}
+		if got := rec.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("%s: Content-Type %q, want application/json", c.name, got)
+		}
+		if c.status == http.StatusTooManyRequests && rec.Header().Get("Retry-After") != "2" {
+			t.Errorf("%s: Retry-After %q, want 2", c.name, rec.Header().Get("Retry-After"))
+		}
+	}
+
+	cfg.DeniedIPs = []string{"192.0.2.0/24"}
+	useConfig(t, cfg)
+	if rec := postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("denied IP: status %d, want 403", rec.Code)
+	}
+}
+
+func TestNonPostRejected(t *testing.T) {
+	upstream := okUpstream(t).URL
+	cases := []struct {
+		method string
+		cors   []string
+		allow  string
+	}{
+		{http.MethodGet, nil, "POST"},
+		{http.MethodPut, nil, "POST"},
+		{http.MethodDelete, nil, "POST"},
+		{http.MethodGet, []string{"https://app.example"}, "POST, OPTIONS"},
+	}
+	for _, c := range cases {
+		cfg := testConfig(upstream)
+		cfg.CORSOrigins = c.cors
+		useConfig(t, cfg)
+		rec := httptest.NewRecorder()
+		handleRPC(rec, httptest.NewRequest(c.method, "/", nil))
+		if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != c.allow {
+			t.Errorf("%s (cors %v): %d Allow %q, want 405 Allow %q", c.method, c.cors, rec.Code, rec.Header().Get("Allow"), c.allow)
+		}
+	}
+}
+
+func TestMaxParamsCount(t *testing.T) {
+	resetLimiters(t)
+	upstream := okUpstream(t).URL
+	params := func(n int) string {
+		p := make([]string, n)
+		for i := range p {
+			p[i] = "1"
+		}
+		return "[" + strings.Join(p, ",") + "]"
+	}
+	cases := []struct {
+		name   string
+		limit  int
+		params string
+		reason string
+	}{
+		{"at the limit", 4, params(4), ""},
+		{"one over", 4, params(5), "too_many_params"},
+		{"oversized", 4, params(5000), "too_many_params"},
+		{"named within", 2, `{"a":1,"b":2}`, ""},
+		{"named over", 2, `{"a":1,"b":2,"c":3}`, "too_many_params"},
+		{"no params", 4, `[]`, ""},
+		{"no limit", 0, params(5000), ""},
+	}
+	for _, c := range cases {
+		cfg := testConfig(upstream)
+		cfg.MaxParamsCount = c.limit
+		useConfig(t, cfg)
+		rec := postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"eth_chainId","params":`+c.params+`}`)
+		var reply testReply
+		json.Unmarshal(rec.Body.Bytes(), &reply)
+		if reply.reason() != c.reason {
+			t.Errorf("%s: reply %.100s, want reason %q", c.name, rec.Body, c.reason)
+		}
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	cases := []struct {
+		raw     string
+		schemes []string
+		ok      bool
+	}{
+		{"http://127.0.0.1:8545", []string{"http", "https"}, true},
+		{"HTTPS://node.example/rpc", []string{"http", "https"}, true},
+		{"ws://127.0.0.1:8546", []string{"ws", "wss"}, true},
+		{"127.0.0.1:8545", []string{"http", "https"}, false},
+		{"localhost:8545", []string{"http", "https"}, false},
+		{"file:///etc/passwd", []string{"http", "https"}, false},
+		{"gopher://node.example", []string{"http", "https"}, false},
+		{"http://", []string{"http", "https"}, false},
+		{"/just/a/path", []string{"http", "https"}, false},
+		{"http://[::1", []string{"http", "https"}, false},
+		{"", []string{"http", "https"}, false},
+		{"http://127.0.0.1:8545", []string{"ws", "wss"}, false},
+	}
+	for _, c := range cases {
+		if err := checkURL(c.raw, c.schemes...); (err == nil) != c.ok {
+			t.Errorf("checkURL(%q, %v) = %v, want ok %v", c.raw, c.schemes, err, c.ok)
+		}
+	}
+}
+
+func TestReadConfigRejectsBadUpstream(t *testing.T) {
+	path := t.TempDir() + "/config.json"
+	for _, raw := range []string{"127.0.0.1:8545", "file:///etc/passwd", "ftp://node"} {
+		os.WriteFile(path, []byte(`{"geth_rpc":"`+raw+`","log_block_range_limit":10}`), 0o644)
+		if _, err := readConfig(path); err == nil || !strings.Contains(err.Error(), "geth_rpc") {
+			t.Errorf("geth_rpc %q: error %v, want one naming geth_rpc", raw, err)
+		}
+	}
+}
+
+func TestParamsEncodings(t *testing.T) {
+	resetLimiters(t)
+	resetHead(t)
+	var got json.RawMessage
+	srv := rpcUpstream(t, func(method string, params json.RawMessage) interface{} {
+		if method == "eth_blockNumber" {
+			return "0x1000"
+		}
+		got = params
+		return "ok"
+	})
+	useConfig(t, testConfig(srv.URL))
+
+	cases := []struct {
+		name   string
+		method string
+		params string
+		reason string
+	}{
+		{"array", "eth_getBalance", `["0xaa","latest"]`, ""},
+		{"object", "custom_namedCall", `{"address":"0xaa","block":"latest"}`, ""},
+		{"empty object", "custom_namedCall", `{}`, ""},
+		{"guarded array", "eth_getLogs", `[{"fromBlock":"0xff0"}]`, ""},
+		// Named params would slip past the positional guards.
+		{"guarded object", "eth_getLogs", `{"filter":{"fromBlock":"0x0"}}`, "named_params"},
+		{"guarded tx object", "eth_sendRawTransaction", `{"tx":"0x00"}`, "named_params"},
+	}
+	for _, c := range cases {
+		got = nil
+		rec := postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"`+c.method+`","params":`+c.params+`}`)
+		var reply testReply
+		if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+			t.Fatalf("%s: reply %s: %v", c.name, rec.Body, err)
+		}
+		if reply.reason() != c.reason {
+			t.Errorf("%s: reply %s, want reason %q", c.name, rec.Body, c.reason)
+			continue
+		}
+		if c.reason == "" {
+			var sent, want interface{}
+			json.Unmarshal(got, &sent)
+			json.Unmarshal([]byte(c.params), &want)
+			if fmt.Sprint(sent) != fmt.Sprint(want) {
+				t.Errorf("%s: upstream got params %s, want %s", c.name, got, c.params)
+			}
+		}
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeJSON(rec, http.StatusForbidden, RPCResponse{JSONRPC: "2.0", ID: json.RawMessage("1"), Error: &RPCError{Code: -32001, Message: "no"}})
+	if rec.Code != http.StatusForbidden || rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("got %d %q, want 403 application/json", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var reply testReply
+	if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil || reply.Error == nil || reply.Error.Code != -32001 {
+		t.Errorf("body %q (%v)", rec.Body, err)
+	}
+
+	// Nothing is sent under the intended status when v can't be encoded.
+	rec = httptest.NewRecorder()
+	writeJSON(rec, http.StatusForbidden, map[string]interface{}{"bad": make(chan int)})
+	if rec.Code != http.StatusInternalServerError || rec.Header().Get("Content-Type") == "application/json" {
+		t.Errorf("unencodable reply: %d %q, want a plain 500", rec.Code, rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestStructuredIDRejected(t *testing.T) {
+	resetLimiters(t)
+	var forwarded atomic.Int32
+	useConfig(t, testConfig(rpcUpstream(t, func(string, json.RawMessage) interface{} {
+		forwarded.Add(1)
+		return "0x1"
+	}).URL))
+
+	for _, id := range []string{`[1]`, `[]`, `{"n":1}`, `{}`, `true`, `false`} {
+		rec := postRPC(handleRPC, `{"jsonrpc":"2.0","id":`+id+`,"method":"eth_chainId"}`)
+		var reply testReply
+		if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+			t.Fatalf("id %s: reply %s: %v", id, rec.Body, err)
+		}
+		if rec.Code != http.StatusBadRequest || reply.reason() != "invalid_request" || reply.Error.Code != -32600 {
+			t.Errorf("id %s: %d %s, want a 400 invalid_request -32600", id, rec.Code, rec.Body)
+		}
+		if string(reply.ID) != "null" {
+			t.Errorf("id %s: echoed %s, want null", id, reply.ID)
+		}
+	}
+	if n := forwarded.Load(); n != 0 {
+		t.Errorf("%d calls with structured ids reached the upstream", n)
+	}
+
+	// In a batch only the offending element fails.
+	rec := postRPC(handleRPC, `[{"jsonrpc":"2.0","id":[7],"method":"eth_chainId"},{"jsonrpc":"2.0","id":8,"method":"eth_chainId"}]`)
+	var replies []testReply
+	if err := json.Unmarshal(rec.Body.Bytes(), &replies); err != nil || len(replies) != 2 {
+		t.Fatalf("batch reply %s: %v", rec.Body, err)
+	}
+	if string(replies[0].ID) != "null" || replies[0].reason() != "invalid_request" {
+		t.Errorf("structured id in a batch: %s %q", replies[0].ID, replies[0].reason())
+	}
+	if string(replies[1].ID) != "8" || replies[1].Error != nil {
+		t.Errorf("valid batch element: %s %+v", replies[1].ID, replies[1].Error)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ===== MAINTENANCE MODE =====
+
+const defaultMaintenanceRetry = time.Minute
+
+var underMaintenance = &rejection{"maintenance", "Under maintenance, try again later"}
+
+// checkMaintenance refuses every call while MaintenanceMode is on, except
+// from AllowlistedIPs. It is looked up per call, so flipping the flag in the
+// config takes effect on the next request, open WebSockets included.
+func (ex *exchange) checkMaintenance() *rejection {
+	if !ex.cfg.MaintenanceMode || ex.allowlisted {
+		return nil
+	}
+	maintenanceRejects.Inc()
+	return underMaintenance
+}
+
+// setMaintenanceRetry tells clients when to come back, MaintenanceRetry
+// rounded up to whole seconds.
+func setMaintenanceRetry(w http.ResponseWriter, cfg Config) {
+	wait := defaultMaintenanceRetry
+	if cfg.MaintenanceRetry > 0 {
+		wait = time.Duration(cfg.MaintenanceRetry) * time.Millisecond
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+// logMaintenanceChange notes a reload switching maintenance mode.
+func logMaintenanceChange(prev, next Config) {
+	switch {
+	case next.MaintenanceMode && !prev.MaintenanceMode:
+		log.Printf("🚧 Maintenance mode on: rejecting all calls except from allowlisted IPs")
+	case !next.MaintenanceMode && prev.MaintenanceMode:
+		log.Printf("✅ Maintenance mode off")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	resetLimiters(t)
+	var forwarded atomic.Int32
+	cfg := testConfig(rpcUpstream(t, func(string, json.RawMessage) interface{} {
+		forwarded.Add(1)
+		return "0x1"
+	}).URL)
+	cfg.MaintenanceMode = true
+	cfg.AllowlistedIPs = []string{"10.0.0.0/8"}
+	useConfig(t, cfg)
+	const call = `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`
+
+	before := testutil.ToFloat64(maintenanceRejects)
+	rec := postRPCFrom(handleRPC, "192.0.2.1:1", call)
+	var reply testReply
+	json.Unmarshal(rec.Body.Bytes(), &reply)
+	if rec.Code != http.StatusServiceUnavailable || reply.reason() != "maintenance" || reply.Error.Code != -32000 {
+		t.Errorf("during maintenance: %d %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After %q, want the 60s default", got)
+	}
+	if got := testutil.ToFloat64(maintenanceRejects) - before; got != 1 || forwarded.Load() != 0 {
+		t.Errorf("%v maintenance rejections counted, %d forwarded", got, forwarded.Load())
+	}
+
+	// Allowlisted callers are served as usual.
+	if rec := postRPCFrom(handleRPC, "10.1.2.3:1", call); rec.Code != http.StatusOK || forwarded.Load() != 1 {
+		t.Errorf("allowlisted caller: %d %s", rec.Code, rec.Body)
+	}
+
+	// Switched off on reload, the next call goes through.
+	cfg.MaintenanceMode = false
+	useConfig(t, cfg)
+	if rec := postRPCFrom(handleRPC, "192.0.2.1:1", call); rec.Code != http.StatusOK || forwarded.Load() != 2 {
+		t.Errorf("after maintenance: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestMaintenanceRetryRoundsUp(t *testing.T) {
+	cases := []struct {
+		ms   int64
+		want string
+	}{
+		{0, "60"},
+		{1, "1"},
+		{1000, "1"},
+		{1001, "2"},
+		{1500, "2"},
+		{30000, "30"},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		setMaintenanceRetry(rec, Config{MaintenanceRetry: c.ms})
+		if got := rec.Header().Get("Retry-After"); got != c.want {
+			t.Errorf("%d ms: Retry-After %q, want %q", c.ms, got, c.want)
+		}
+	}
+}
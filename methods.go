@@ -0,0 +1,111 @@
+package main
+
+import (
+	"path"
+	"slices"
+	"strings"
+)
+
+// ===== METHOD FILTERING =====
+
+// methodPermitted applies the allow/block lists. A non-empty allowlist admits
+// only the methods it matches, and the blocklist always wins.
+func methodPermitted(cfg Config, method string) bool {
+	if matchesAny(cfg.BlockedMethods, method) {
+		return false
+	}
+	return len(cfg.AllowedMethods) == 0 || matchesAny(cfg.AllowedMethods, method)
+}
+
+// matchesAny reports whether method matches one of the glob patterns
+// (e.g. "admin_*", "debug_trace?ransaction"). Plain names match exactly.
+func matchesAny(patterns []string, method string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, method); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ===== METHOD NAMES =====
+
+// checkMethodName refuses names that only look like a method the guard
+// knows. Matching stays case-sensitive, as JSON-RPC specifies, so
+// "Eth_getLogs" or " eth_getLogs" would otherwise skip the eth_getLogs guards
+// and limits while a lenient upstream might still run it. Namespaces are
+// always lower case; the rest of a name is compared against known methods.
+func checkMethodName(cfg Config, method string) *rejection {
+	if strings.IndexFunc(method, func(r rune) bool { return r <= ' ' || r == 0x7f }) >= 0 {
+		return &rejection{"method_near_miss", "Invalid method name"}
+	}
+	if known := knownMethod(cfg, method); known != "" && known != method {
+		return &rejection{"method_near_miss", "Method names are case-sensitive; did you mean " + known + "?"}
+	}
+	if namespace, _, _ := strings.Cut(method, "_"); namespace != strings.ToLower(namespace) {
+		return &rejection{"method_near_miss", "Method names are case-sensitive"}
+	}
+	return nil
+}
+
+// knownMethod returns the method the guard treats specially (a guard, a
+// limit, a cost, caching, fallback) that equals method ignoring case, or ""
+// if there is none. An exact match returns method itself.
+func knownMethod(cfg Config, method string) string {
+	var found string
+	check := func(name string) bool {
+		if name == method {
+			found = name
+			return true
+		}
+		if found == "" && strings.EqualFold(name, method) {
+			found = name
+		}
+		return false
+	}
+	for _, names := range []map[string]bool{guardedMethods, readOnlyMethods, subscriptionMethods} {
+		for name := range names {
+			if check(name) {
+				return found
+			}
+		}
+	}
+	for _, name := range configuredMethods(cfg) {
+		if check(name) {
+			return found
+		}
+	}
+	return found
+}
+
+// methodLabel is method as a metric label. Methods the guard knows or the
+// allowlist names, and that are permitted, keep their name; anything else a
+// client sends is counted as "other", so junk names can't grow the metrics
+// without bound.
+func methodLabel(cfg Config, method string) string {
+	if method != "" && methodPermitted(cfg, method) &&
+		(knownMethod(cfg, method) == method || slices.Contains(cfg.AllowedMethods, method)) {
+		return method
+	}
+	return "other"
+}
+
+// configuredMethods lists the method names the config refers to directly.
+func configuredMethods(cfg Config) []string {
+	names := append([]string{"eth_sendRawTransaction"}, cfg.CacheMethods...)
+	for name := range cfg.RateLimits {
+		names = append(names, name)
+	}
+	for name := range cfg.GlobalRateLimits {
+		names = append(names, name)
+	}
+	for name := range cfg.MethodCosts {
+		names = append(names, name)
+	}
+	for _, tier := range cfg.Tiers {
+		for name := range tier.RateLimits {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCheckMethodName(t *testing.T) {
+	cfg := Config{RateLimits: map[string]RateLimitConfig{"custom_heavyQuery": {RatePerSec: 1, Burst: 1}}}
+	cases := []struct {
+		method string
+		ok     bool
+	}{
+		{"eth_getLogs", true},
+		{"eth_sendRawTransaction", true},
+		{"custom_heavyQuery", true},
+		// Unknown methods are the upstream's business as long as they look sane.
+		{"eth_someFutureMethod", true},
+		{"web3_clientVersion", true},
+		{"Eth_getLogs", false},
+		{"ETH_GETLOGS", false},
+		{"eth_getlogs", false},
+		{"eth_GetLogs", false},
+		{"custom_HeavyQuery", false},
+		{"Eth_someFutureMethod", false},
+		{" eth_getLogs", false},
+		{"eth_getLogs ", false},
+		{"eth_getLogs\n", false},
+		{"eth_get\tLogs", false},
+		{"eth_getLogs\x00", false},
+		{"eth_getLogs\x7f", false},
+	}
+	for _, c := range cases {
+		rej := checkMethodName(cfg, c.method)
+		if (rej == nil) != c.ok {
+			t.Errorf("%q: rejection %v, want ok=%v", c.method, rej, c.ok)
+		}
+		if rej != nil && rej.reason != "method_near_miss" {
+			t.Errorf("%q: reason %q", c.method, rej.reason)
+		}
+	}
+	if rej := checkMethodName(cfg, "eth_getlogs"); rej == nil || rej.msg != "Method names are case-sensitive; did you mean eth_getLogs?" {
+		t.Errorf("near miss of a known method should name it, got %v", rej)
+	}
+}
+
+func TestNearMissNotForwarded(t *testing.T) {
+	resetLimiters(t)
+	var forwarded atomic.Int32
+	cfg := testConfig(rpcUpstream(t, func(string, json.RawMessage) interface{} {
+		forwarded.Add(1)
+		return "0x1"
+	}).URL)
+	useConfig(t, cfg)
+
+	// A wide range under each spelling: only the exact one reaches the guard.
+	for method, want := range map[string]string{
+		"Eth_getLogs":  "method_near_miss",
+		"eth_getlogs":  "method_near_miss",
+		"eth_getLogs ": "method_near_miss",
+	} {
+		var reply testReply
+		rec := postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"`+method+`","params":[{"fromBlock":"0x0","toBlock":"0x100000"}]}`)
+		json.Unmarshal(rec.Body.Bytes(), &reply)
+		if reply.reason() != want || reply.Error.Code != -32601 {
+			t.Errorf("%q: %s, want %s -32601", method, rec.Body, want)
+		}
+	}
+	if n := forwarded.Load(); n != 0 {
+		t.Errorf("%d near-miss calls reached the upstream", n)
+	}
+}
+
+func TestMethodLabel(t *testing.T) {
+	cfg := Config{
+		AllowedMethods: []string{"eth_*", "custom_query"},
+		BlockedMethods: []string{"eth_sign"},
+		RateLimits:     map[string]RateLimitConfig{"eth_heavyQuery": {RatePerSec: 1, Burst: 1}},
+	}
+	cases := []struct{ method, label string }{
+		{"eth_getLogs", "eth_getLogs"},
+		{"eth_heavyQuery", "eth_heavyQuery"},
+		{"custom_query", "custom_query"},
+		// Permitted by the glob, but the name is the client's to pick.
+		{"eth_x7f3a9", "other"},
+		{"eth_sign", "other"},
+		{"debug_traceTransaction", "other"},
+		{"Eth_getLogs", "other"},
+		{"", "other"},
+	}
+	for _, c := range cases {
+		if got := methodLabel(cfg, c.method); got != c.label {
+			t.Errorf("%q labeled %q, want %q", c.method, got, c.label)
+		}
+	}
+}
+
+func TestDecisionsBoundMethodLabel(t *testing.T) {
+	resetLimiters(t)
+	cfg := testConfig(rpcUpstream(t, func(string, json.RawMessage) interface{} { return "0x1" }).URL)
+	cfg.AllowedMethods = []string{"eth_chainId"}
+	useConfig(t, cfg)
+
+	refused := testutil.ToFloat64(decisions.WithLabelValues("other", "reject"))
+	series := testutil.CollectAndCount(decisions)
+	for i := 0; i < 3; i++ {
+		postRPC(handleRPC, fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":"junk_%d"}`, i))
+	}
+	if got := testutil.ToFloat64(decisions.WithLabelValues("other", "reject")) - refused; got != 3 {
+		t.Errorf("%v junk methods counted as other, want 3", got)
+	}
+	if n := testutil.CollectAndCount(decisions); n != series {
+		t.Errorf("junk methods added %d decision series", n-series)
+	}
+}
+
+func TestForwardedJunkMethodsBoundLabels(t *testing.T) {
+	resetLimiters(t)
+	// Without an allowlist, made-up names are forwarded like any other call.
+	useConfig(t, testConfig(rpcUpstream(t, func(string, json.RawMessage) interface{} { return "0x1" }).URL))
+	collectors := map[string]prometheus.Collector{
+		"upstream_duration": upstreamDuration,
+		"tier_decisions":    tierDecisions,
+	}
+	postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"junk_first"}`)
+	series := make(map[string]int)
+	for name, c := range collectors {
+		series[name] = testutil.CollectAndCount(c)
+	}
+	for i := 0; i < 3; i++ {
+		postRPC(handleRPC, fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":"junk_%d"}`, i))
+	}
+	for name, c := range collectors {
+		if n := testutil.CollectAndCount(c); n != series[name] {
+			t.Errorf("%s: junk methods added %d series", name, n-series[name])
+		}
+	}
+}
+
+func TestWouldRejectsBoundMethodLabel(t *testing.T) {
+	resetLimiters(t)
+	cfg := testConfig(rpcUpstream(t, func(string, json.RawMessage) interface{} { return "0x1" }).URL)
+	cfg.AllowedMethods = []string{"eth_chainId"}
+	cfg.ShadowMode = true
+	useConfig(t, cfg)
+
+	// Shadow mode forwards every junk name, so each would mint a series.
+	refused := testutil.ToFloat64(wouldRejects.WithLabelValues("other", "method_blocked"))
+	series := testutil.CollectAndCount(wouldRejects)
+	for i := 0; i < 3; i++ {
+		postRPC(handleRPC, fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":"junk_%d"}`, i))
+	}
+	if got := testutil.ToFloat64(wouldRejects.WithLabelValues("other", "method_blocked")) - refused; got != 3 {
+		t.Errorf("%v junk methods counted as other, want 3", got)
+	}
+	if n := testutil.CollectAndCount(wouldRejects); n != series {
+		t.Errorf("junk methods added %d would-reject series", n-series)
+	}
+}
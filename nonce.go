@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// ===== NONCE GAP CHECK =====
+
+const (
+	defaultNonceCacheTTL = 5 * time.Second
+	nonceCacheSweepSize  = 10000
+)
+
+type cachedNonce struct {
+	nonce uint64
+	at    time.Time
+}
+
+var (
+	nonceCache     = make(map[common.Address]cachedNonce)
+	nonceCacheLock sync.Mutex
+)
+
+// checkNonceGap rejects a tx whose nonce is more than MaxNonceGap ahead of
+// the sender's pending count. It is a sanity check, so it fails open when
+// the upstream can't be asked.
+func checkNonceGap(cfg Config, from common.Address, nonce uint64) *rejection {
+	pending, err := pendingNonce(cfg, from)
+	if err != nil {
+		return nil
+	}
+	if nonce > pending+cfg.MaxNonceGap {
+		return &rejection{"nonce_gap_too_large", "Nonce too far ahead"}
+	}
+	return nil
+}
+
+// pendingNonce returns eth_getTransactionCount(from, "pending"), cached for
+// NonceCacheTTL so bursts from one sender cost a single upstream call.
+func pendingNonce(cfg Config, from common.Address) (uint64, error) {
+	ttl := defaultNonceCacheTTL
+	if cfg.NonceCacheTTL > 0 {
+		ttl = time.Duration(cfg.NonceCacheTTL) * time.Millisecond
+	}
+
+	nonceCacheLock.Lock()
+	c, ok := nonceCache[from]
+	nonceCacheLock.Unlock()
+	if ok && time.Since(c.at) < ttl {
+		return c.nonce, nil
+	}
+
+	raw, err := callUpstream(cfg, "eth_getTransactionCount", from.Hex(), "pending")
+	if err != nil {
+		return 0, err
+	}
+	var count hexutil.Uint64
+	if err := json.Unmarshal(raw, &count); err != nil {
+		return 0, err
+	}
+
+	nonceCacheLock.Lock()
+	defer nonceCacheLock.Unlock()
+	if len(nonceCache) >= nonceCacheSweepSize {
+		for addr, c := range nonceCache {
+			if time.Since(c.at) >= ttl {
+				delete(nonceCache, addr)
+			}
+		}
+	}
+	nonceCache[from] = cachedNonce{nonce: uint64(count), at: time.Now()}
+	return uint64(count), nil
+}
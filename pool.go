@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ===== UPSTREAM POOL =====
+
+const defaultUpstreamCooldown = 30 * time.Second
+
+var (
+	rrNext    atomic.Uint64
+	downUntil = make(map[string]time.Time)
+	downLock  sync.Mutex
+)
+
+// upstreamURLs is the endpoint pool. GethRPC alone still works as a
+// single-entry pool for configs written before GethRPCs existed.
+func upstreamURLs(cfg Config) []string {
+	if len(cfg.GethRPCs) > 0 {
+		return cfg.GethRPCs
+	}
+	return []string{cfg.GethRPC}
+}
+
+func upstreamCooldown(cfg Config) time.Duration {
+	if cfg.UpstreamCooldown > 0 {
+		return time.Duration(cfg.UpstreamCooldown) * time.Millisecond
+	}
+	return defaultUpstreamCooldown
+}
+
+// pickUpstream returns the next endpoint in round-robin order, skipping any
+// still cooling down after a connection error as well as avoid (the endpoint
+// a retry just failed on). If nothing else qualifies the round-robin choice
+// is returned anyway rather than failing closed.
+func pickUpstream(cfg Config, avoid string) string {
+	urls := upstreamURLs(cfg)
+	start := int(rrNext.Add(1) - 1)
+	now := time.Now()
+
+	downLock.Lock()
+	defer downLock.Unlock()
+	for i := 0; i < len(urls); i++ {
+		u := urls[(start+i)%len(urls)]
+		if u != avoid && now.After(downUntil[u]) {
+			return u
+		}
+	}
+	return urls[start%len(urls)]
+}
+
+// markUpstreamDown takes an endpoint out of rotation for the cooldown.
+func markUpstreamDown(cfg Config, endpoint string) {
+	downLock.Lock()
+	downUntil[endpoint] = time.Now().Add(upstreamCooldown(cfg))
+	downLock.Unlock()
+	upstreamHealthy.WithLabelValues(endpoint).Set(0)
+}
+
+func markUpstreamUp(endpoint string) {
+	downLock.Lock()
+	delete(downUntil, endpoint)
+	downLock.Unlock()
+	upstreamHealthy.WithLabelValues(endpoint).Set(1)
+}
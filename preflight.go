@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// ===== SEND PREFLIGHT =====
+
+// revertCode is the JSON-RPC error code geth uses for a reverted eth_call.
+const revertCode = 3
+
+// checkPreflight eth_calls tx as from against the latest block and rejects
+// it if the call reverts, so a doomed transaction is never broadcast. Any
+// other failure (the upstream unreachable, timing out, or erroring for its
+// own reasons) says nothing about the transaction, and it is let through.
+func checkPreflight(cfg Config, tx *types.Transaction, from common.Address) *rejection {
+	call := map[string]interface{}{
+		"from":  from,
+		"data":  hexutil.Bytes(tx.Data()),
+		"value": (*hexutil.Big)(tx.Value()),
+		"gas":   hexutil.Uint64(tx.Gas()),
+	}
+	if tx.To() != nil {
+		call["to"] = tx.To()
+	}
+	_, err := callUpstream(cfg, "eth_call", call, "latest")
+	var rpcErr *upstreamRPCError
+	if errors.As(err, &rpcErr) && isRevert(rpcErr) {
+		return &rejection{"would_revert", "Transaction would revert: " + rpcErr.Message}
+	}
+	return nil
+}
+
+func isRevert(e *upstreamRPCError) bool {
+	return e.Code == revertCode || strings.Contains(strings.ToLower(e.Message), "execution reverted")
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ===== VOLUME QUOTAS =====
+
+// QuotaConfig caps the calls one API key (or, without a key, one IP) may
+// make over a rolling day and a rolling 30 days. 0 leaves a window uncapped.
+type QuotaConfig struct {
+	Daily   int64 `json:"daily"`
+	Monthly int64 `json:"monthly"`
+	// StateFile keeps the counts across restarts; read at startup only.
+	StateFile string `json:"state_file"`
+	// MaxSubjects caps the subjects tracked; past it the least recently
+	// seen one is forgotten, and starts over with a full quota.
+	MaxSubjects int `json:"max_subjects"`
+}
+
+const (
+	quotaSaveEvery       = time.Minute
+	defaultQuotaSubjects = 50000
+)
+
+// quotaUsage counts one subject's calls in hourly buckets for the daily
+// window and daily buckets for the monthly one, so the windows roll forward
+// an hour (or a day) at a time instead of resetting at midnight.
+type quotaUsage struct {
+	Hours [24]quotaBucket `json:"hours"`
+	Days  [30]quotaBucket `json:"days"`
+}
+
+// quotaBucket is the count for one slot: a Unix hour or a Unix day.
+type quotaBucket struct {
+	Slot int64 `json:"slot"`
+	N    int64 `json:"n"`
+}
+
+// quotaSum counts the calls in buckets whose slot is still inside the window
+// ending at slot.
+func quotaSum(buckets []quotaBucket, slot int64) int64 {
+	var n int64
+	for _, b := range buckets {
+		if b.Slot > slot-int64(len(buckets)) && b.Slot <= slot {
+			n += b.N
+		}
+	}
+	return n
+}
+
+func quotaAdd(buckets []quotaBucket, slot int64) {
+	b := &buckets[slot%int64(len(buckets))]
+	if b.Slot != slot {
+		*b = quotaBucket{Slot: slot}
+	}
+	b.N++
+}
+
+// quotaLeft is what a subject has left after the current call; -1 means the
+// window is uncapped.
+type quotaLeft struct {
+	daily, monthly int64
+}
+
+// quotaStore persists quota counts. The file store is built in; anything
+// shared between replicas (e.g. Redis) only has to load and save the map.
+type quotaStore interface {
+	load() (map[string]*quotaUsage, error)
+	save(map[string]*quotaUsage) error
+}
+
+// quotas holds the usage per subject. As with the rate limiters, quotaLRU
+// orders subjects by last use, most recent at the front, so MaxSubjects can
+// drop the stalest in constant time; quotaPos finds a subject's place in it.
+// Subjects with no calls left in either window are dropped on every save.
+var (
+	quotas     = make(map[string]*quotaUsage)
+	quotaLRU   = list.New()
+	quotaPos   = make(map[string]*list.Element)
+	quotaLock  sync.Mutex
+	quotaSaver quotaStore
+)
+
+func maxQuotaSubjects(q *QuotaConfig) int {
+	if q.MaxSubjects > 0 {
+		return q.MaxSubjects
+	}
+	return defaultQuotaSubjects
+}
+
+// trackQuota returns subject's usage, adding it (and evicting the least
+// recently used subjects past MaxSubjects) if it is new; quotaLock must be
+// held.
+func trackQuota(q *QuotaConfig, subject string) *quotaUsage {
+	if u, ok := quotas[subject]; ok {
+		quotaLRU.MoveToFront(quotaPos[subject])
+		return u
+	}
+	for len(quotas) >= maxQuotaSubjects(q) {
+		dropQuota(quotaLRU.Back().Value.(string))
+		quotaEvictions.Inc()
+	}
+	u := &quotaUsage{}
+	quotas[subject] = u
+	quotaPos[subject] = quotaLRU.PushFront(subject)
+	return u
+}
+
+// dropQuota forgets subject; quotaLock must be held.
+func dropQuota(subject string) {
+	delete(quotas, subject)
+	if e, ok := quotaPos[subject]; ok {
+		quotaLRU.Remove(e)
+		delete(quotaPos, subject)
+	}
+}
+
+// checkQuota takes one call off subject's quota, or refuses it once either
+// window is used up. Refused calls don't count.
+func (ex *exchange) checkQuota(now time.Time) *rejection {
+	q := ex.cfg.Quota
+	if q == nil || (q.Daily == 0 && q.Monthly == 0) {
+		return nil
+	}
+	hour, day := now.Unix()/3600, now.Unix()/86400
+
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+	u := trackQuota(q, ex.subject)
+	// A lowered limit can leave usage above it; that reads as none left.
+	left := quotaLeft{daily: -1, monthly: -1}
+	if q.Daily > 0 {
+		left.daily = max(q.Daily-quotaSum(u.Hours[:], hour), 0)
+	}
+	if q.Monthly > 0 {
+		left.monthly = max(q.Monthly-quotaSum(u.Days[:], day), 0)
+	}
+	ex.quota = &left
+	if left.daily == 0 || left.monthly == 0 {
+		return &rejection{"quota_exceeded", "Quota exceeded"}
+	}
+	quotaAdd(u.Hours[:], hour)
+	quotaAdd(u.Days[:], day)
+	if left.daily > 0 {
+		left.daily--
+	}
+	if left.monthly > 0 {
+		left.monthly--
+	}
+	return nil
+}
+
+// setQuotaHeaders reports the quota left after this request's calls. It must
+// run before the reply is written.
+func (ex *exchange) setQuotaHeaders(w http.ResponseWriter) {
+	if ex.quota == nil {
+		return
+	}
+	if ex.quota.daily >= 0 {
+		w.Header().Set("X-Quota-Remaining-Daily", strconv.FormatInt(ex.quota.daily, 10))
+	}
+	if ex.quota.monthly >= 0 {
+		w.Header().Set("X-Quota-Remaining-Monthly", strconv.FormatInt(ex.quota.monthly, 10))
+	}
+}
+
+// initQuotas loads the counts saved by a previous run, if cfg persists them.
+func initQuotas(cfg Config) {
+	if cfg.Quota == nil || cfg.Quota.StateFile == "" {
+		return
+	}
+	quotaSaver = fileQuotaStore{cfg.Quota.StateFile}
+	saved, err := quotaSaver.load()
+	if err != nil {
+		log.Printf("⚠️ Quota state not loaded, starting from zero: %v", err)
+		return
+	}
+	// Rebuild the LRU with the most recently used subjects at the front.
+	subjects := make([]string, 0, len(saved))
+	for subject := range saved {
+		subjects = append(subjects, subject)
+	}
+	sort.Slice(subjects, func(i, j int) bool {
+		return saved[subjects[i]].lastSlot() < saved[subjects[j]].lastSlot()
+	})
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+	quotas, quotaLRU, quotaPos = make(map[string]*quotaUsage), list.New(), make(map[string]*list.Element)
+	for _, subject := range subjects {
+		trackQuota(cfg.Quota, subject)
+		*quotas[subject] = *saved[subject]
+	}
+}
+
+// lastSlot is the latest hour with calls counted.
+func (u *quotaUsage) lastSlot() int64 {
+	var last int64
+	for _, b := range u.Hours {
+		last = max(last, b.Slot)
+	}
+	for _, b := range u.Days {
+		last = max(last, b.Slot*24)
+	}
+	return last
+}
+
+// persistQuotas drops subjects with nothing left in either window and saves
+// the rest, every minute until ctx is done.
+func persistQuotas(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(quotaSaveEvery):
+		}
+		saveQuotas()
+	}
+}
+
+func saveQuotas() {
+	now := time.Now()
+	hour, day := now.Unix()/3600, now.Unix()/86400
+	quotaLock.Lock()
+	snapshot := make(map[string]*quotaUsage, len(quotas))
+	for subject, u := range quotas {
+		if quotaSum(u.Hours[:], hour) == 0 && quotaSum(u.Days[:], day) == 0 {
+			dropQuota(subject)
+			continue
+		}
+		copied := *u
+		snapshot[subject] = &copied
+	}
+	quotaLock.Unlock()
+
+	if quotaSaver == nil {
+		return
+	}
+	if err := quotaSaver.save(snapshot); err != nil {
+		log.Printf("⚠️ Quota state not saved: %v", err)
+	}
+}
+
+// fileQuotaStore keeps the counts as JSON, replaced atomically on save so a
+// crash mid-write leaves the previous state.
+type fileQuotaStore struct {
+	path string
+}
+
+func (s fileQuotaStore) load() (map[string]*quotaUsage, error) {
+	saved := make(map[string]*quotaUsage)
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return saved, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+func (s fileQuotaStore) save(usage map[string]*quotaUsage) error {
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
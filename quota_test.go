@@ -0,0 +1,151 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// resetQuotas starts the test with no quota usage and clears it afterwards.
+func resetQuotas(t *testing.T) {
+	clear := func() {
+		quotaLock.Lock()
+		quotas, quotaLRU, quotaPos = make(map[string]*quotaUsage), list.New(), make(map[string]*list.Element)
+		quotaLock.Unlock()
+	}
+	clear()
+	t.Cleanup(clear)
+}
+
+func quotaUsed(subject string, now time.Time) int64 {
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+	u, ok := quotas[subject]
+	if !ok {
+		return 0
+	}
+	return quotaSum(u.Hours[:], now.Unix()/3600)
+}
+
+func TestQuotaOnlyCountsAcceptedCalls(t *testing.T) {
+	resetQuotas(t)
+	resetHead(t)
+	srv := rpcUpstream(t, func(string, json.RawMessage) interface{} { return "0x1000" })
+	cfg := testConfig(srv.URL)
+	cfg.Quota = &QuotaConfig{Daily: 10}
+	cfg.BlockedMethods = []string{"debug_*"}
+
+	cases := []struct {
+		name   string
+		req    RPCRequest
+		reason string
+	}{
+		{"accepted", RPCRequest{JSONRPC: "2.0", Method: "eth_chainId", ID: json.RawMessage("1")}, ""},
+		{"blocked", RPCRequest{JSONRPC: "2.0", Method: "debug_traceCall", ID: json.RawMessage("1")}, "method_blocked"},
+		{"log range", RPCRequest{JSONRPC: "2.0", Method: "eth_getLogs", ID: json.RawMessage("1"),
+			Params: []interface{}{map[string]interface{}{"fromBlock": "0x0"}}}, "log_range"},
+		{"named params", RPCRequest{JSONRPC: "2.0", Method: "eth_call", ID: json.RawMessage("1"),
+			Params: map[string]interface{}{}}, "named_params"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ex := &exchange{cfg: cfg, ip: "192.0.2.1", subject: "192.0.2.1"}
+			before := quotaUsed(ex.subject, time.Now())
+			rej := runGuards(ex, &c.req, nil)
+			got := ""
+			if rej != nil {
+				got = rej.reason
+			}
+			if got != c.reason {
+				t.Fatalf("reason %q, want %q", got, c.reason)
+			}
+			want := before
+			if c.reason == "" {
+				want++
+			}
+			if used := quotaUsed(ex.subject, time.Now()); used != want {
+				t.Errorf("quota used %d, want %d", used, want)
+			}
+		})
+	}
+}
+
+func TestQuotaExhaustion(t *testing.T) {
+	resetQuotas(t)
+	ex := &exchange{cfg: Config{Quota: &QuotaConfig{Daily: 3, Monthly: 100}}, subject: "k"}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if rej := ex.checkQuota(now); rej != nil {
+			t.Fatalf("call %d refused: %v", i, rej.reason)
+		}
+	}
+	if ex.quota.daily != 0 || ex.quota.monthly != 97 {
+		t.Errorf("left %+v, want daily 0 monthly 97", *ex.quota)
+	}
+	if rej := ex.checkQuota(now); rej == nil || rej.reason != "quota_exceeded" {
+		t.Fatalf("4th call: got %v, want quota_exceeded", rej)
+	}
+	// The daily window rolls an hour at a time.
+	if rej := ex.checkQuota(now.Add(24 * time.Hour)); rej != nil {
+		t.Errorf("next day refused: %v", rej.reason)
+	}
+}
+
+func TestQuotaEvictsLeastRecentlyUsed(t *testing.T) {
+	resetQuotas(t)
+	cfg := Config{Quota: &QuotaConfig{Daily: 100, MaxSubjects: 2}}
+	now := time.Now()
+	use := func(subject string) {
+		(&exchange{cfg: cfg, subject: subject}).checkQuota(now)
+	}
+	use("a")
+	use("b")
+	use("a") // b is now the least recently used
+	use("c")
+
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+	if len(quotas) != 2 || quotaLRU.Len() != 2 {
+		t.Fatalf("%d subjects, %d in LRU; want 2", len(quotas), quotaLRU.Len())
+	}
+	if _, ok := quotas["b"]; ok {
+		t.Error("b should have been evicted")
+	}
+	for _, s := range []string{"a", "c"} {
+		if _, ok := quotas[s]; !ok {
+			t.Errorf("%s evicted", s)
+		}
+	}
+}
+
+func TestQuotaStateRoundTrip(t *testing.T) {
+	resetQuotas(t)
+	path := filepath.Join(t.TempDir(), "quota.json")
+	cfg := Config{Quota: &QuotaConfig{Daily: 100, StateFile: path, MaxSubjects: 2}}
+	now := time.Now().Add(-3 * time.Hour)
+	for _, s := range []string{"old", "mid", "new"} {
+		quotaLock.Lock()
+		u := trackQuota(&QuotaConfig{MaxSubjects: 10}, s)
+		quotaLock.Unlock()
+		quotaAdd(u.Hours[:], now.Unix()/3600)
+		quotaAdd(u.Days[:], now.Unix()/86400)
+		now = now.Add(time.Hour)
+	}
+	quotaSaver = fileQuotaStore{path}
+	t.Cleanup(func() { quotaSaver = nil })
+	saveQuotas()
+
+	resetQuotas(t)
+	initQuotas(cfg)
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+	// Over max_subjects on load, the stalest saved subject goes first.
+	if _, ok := quotas["old"]; ok || len(quotas) != 2 {
+		t.Errorf("loaded %v, want mid and new", quotaPos)
+	}
+	if quotaLRU.Front().Value != "new" {
+		t.Errorf("most recent is %v, want new", quotaLRU.Front().Value)
+	}
+}
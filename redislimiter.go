@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ===== REDIS LIMITER =====
+
+const (
+	algoRedisBucket     = "redis_token_bucket"
+	redisKeyPrefix      = "rpcguard:limiter:"
+	defaultRedisTimeout = 100 * time.Millisecond
+)
+
+// redisBucketScript is the token bucket of rateLimiter, run atomically in
+// Redis so every replica draws from the same bucket. The Redis clock is
+// used, so replicas with skewed clocks still agree on the refill. It
+// returns whether cost was taken and the tokens left.
+var redisBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local t = redis.call("TIME")
+local now = t[1] * 1000 + math.floor(t[2] / 1000)
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+local allowed = 0
+if tokens >= cost then
+	tokens = tokens - cost
+	allowed = 1
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+local ttl = 86400000
+if rate > 0 then
+	ttl = math.ceil(burst / rate * 1000) + 1000
+end
+redis.call("PEXPIRE", KEYS[1], ttl)
+return {allowed, tostring(tokens)}
+`)
+
+var errRedisUnconfigured = errors.New("redis_url not usable")
+
+var (
+	redisClient    *redis.Client
+	redisClientURL string
+	redisLock      sync.Mutex
+	// redisDown makes an outage log once when it starts and once when it ends.
+	redisDown atomic.Bool
+)
+
+// getRedisClient returns the client for RedisURL, reconnecting when a reload
+// changes it, or nil if the URL doesn't parse.
+func getRedisClient(cfg Config) *redis.Client {
+	redisLock.Lock()
+	defer redisLock.Unlock()
+	if redisClient == nil || redisClientURL != cfg.RedisURL {
+		opts, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			return nil
+		}
+		if redisClient != nil {
+			redisClient.Close()
+		}
+		redisClient = redis.NewClient(opts)
+		redisClientURL = cfg.RedisURL
+	}
+	return redisClient
+}
+
+// redisLimiter is a token bucket kept in Redis. When Redis can't be reached
+// in time, RedisFailOpen decides whether the call passes. The client and
+// RedisFailOpen are looked up per call so they follow reloads.
+type redisLimiter struct {
+	key  string
+	conf RateLimitConfig
+
+	mutex  sync.Mutex
+	last   time.Time
+	tokens float64 // as of the last reply from Redis
+}
+
+func newRedisLimiter(key string, conf RateLimitConfig) *redisLimiter {
+	return &redisLimiter{
+		key:    redisKeyPrefix + key,
+		conf:   conf,
+		last:   time.Now(),
+		tokens: float64(conf.Burst),
+	}
+}
+
+func (rl *redisLimiter) allowN(cost float64) bool {
+	cfg := getConfig()
+	rl.mutex.Lock()
+	conf := rl.conf
+	rl.mutex.Unlock()
+	var res []interface{}
+	err := errRedisUnconfigured
+	if client := getRedisClient(cfg); client != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultRedisTimeout)
+		res, err = redisBucketScript.Run(ctx, client, []string{rl.key},
+			conf.RatePerSec, conf.Burst, cost).Slice()
+		cancel()
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.last = time.Now()
+	if err == nil && len(res) != 2 {
+		err = fmt.Errorf("unexpected script reply %v", res)
+	}
+	if err != nil {
+		limiterBackendErrors.Inc()
+		if !redisDown.Swap(true) {
+			log.Printf("⚠️ Redis limiter unavailable (fail open: %t): %v", cfg.RedisFailOpen, err)
+		}
+		return cfg.RedisFailOpen
+	}
+	if redisDown.Swap(false) {
+		log.Printf("✅ Redis limiter reachable again")
+	}
+	allowed, _ := res[0].(int64)
+	if s, ok := res[1].(string); ok {
+		rl.tokens, _ = strconv.ParseFloat(s, 64)
+	}
+	return allowed == 1
+}
+
+// wait estimates the refill from the tokens Redis last reported; other
+// replicas may have drawn on the bucket since.
+func (rl *redisLimiter) wait(cost float64) time.Duration {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	burst := float64(rl.conf.Burst)
+	tokens := minF(burst, rl.tokens+time.Since(rl.last).Seconds()*rl.conf.RatePerSec)
+	if tokens >= cost {
+		return 0
+	}
+	if rl.conf.RatePerSec <= 0 || cost > burst {
+		return time.Minute
+	}
+	return time.Duration((cost - tokens) / rl.conf.RatePerSec * float64(time.Second))
+}
+
+func (rl *redisLimiter) algorithm() string { return algoRedisBucket }
+
+func (rl *redisLimiter) lastUsed() time.Time {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	return rl.last
+}
+
+// full is always true: the bucket lives in Redis, and a local one dropped
+// and recreated picks it up from there.
+func (rl *redisLimiter) full(time.Time) bool { return true }
+
+// retune only swaps the parameters sent with each check; the bucket state
+// lives in Redis and carries over.
+func (rl *redisLimiter) retune(conf RateLimitConfig, _ time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.conf = conf
+}
+
+func (rl *redisLimiter) remaining() float64 {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	return rl.tokens
+}
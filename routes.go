@@ -0,0 +1,37 @@
+package main
+
+import "path"
+
+// ===== METHOD ROUTING =====
+
+// methodRoute returns the upstream MethodRoutes sends method to, or "" for
+// the default pool. An exact entry wins over patterns; among matching
+// patterns the longest (most specific) one is used, and between patterns of
+// the same length the lexically smallest, so the choice never depends on
+// map order.
+func methodRoute(cfg Config, method string) string {
+	if u, ok := cfg.MethodRoutes[method]; ok {
+		return u
+	}
+	best, route := "", ""
+	for pattern, u := range cfg.MethodRoutes {
+		if ok, _ := path.Match(pattern, method); !ok {
+			continue
+		}
+		if best == "" || len(pattern) > len(best) || (len(pattern) == len(best) && pattern < best) {
+			best, route = pattern, u
+		}
+	}
+	return route
+}
+
+// withRoute narrows cfg's pool to route, so retries and cooldowns work the
+// same for routed and default calls. Each route has its own circuit breaker:
+// a dead archive node must not open the circuit for the default pool.
+func withRoute(cfg Config, route string) Config {
+	if route != "" {
+		cfg.GethRPCs = []string{route}
+		cfg.route = route
+	}
+	return cfg
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+)
+
+func TestMethodRoute(t *testing.T) {
+	cfg := Config{MethodRoutes: map[string]string{
+		"eth_getLogs":  "http://exact",
+		"eth_*":        "http://eth",
+		"eth_get*":     "http://get",
+		"debug_*":      "http://debug-a",
+		"debug_?race*": "http://debug-b",
+		"debug_t*ace*": "http://debug-c",
+	}}
+	cases := []struct{ method, want string }{
+		{"eth_getLogs", "http://exact"},
+		{"eth_getBalance", "http://get"},
+		{"eth_call", "http://eth"},
+		{"debug_storageRangeAt", "http://debug-a"},
+		// Both twelve-character globs match; "debug_?race*" sorts first.
+		{"debug_traceCall", "http://debug-b"},
+		{"net_version", ""},
+	}
+	for _, c := range cases {
+		// Map order changes from run to run; the answer must not.
+		for i := 0; i < 20; i++ {
+			if got := methodRoute(cfg, c.method); got != c.want {
+				t.Fatalf("methodRoute(%q) = %q, want %q", c.method, got, c.want)
+			}
+		}
+	}
+}
+
+func TestMethodRoutesForward(t *testing.T) {
+	resetLimiters(t)
+	var mu sync.Mutex
+	served := map[string]string{} // method -> upstream that answered it
+	node := func(name string) string {
+		return rpcUpstream(t, func(method string, _ json.RawMessage) interface{} {
+			mu.Lock()
+			served[method] = name
+			mu.Unlock()
+			return name
+		}).URL
+	}
+	cfg := testConfig(node("full"))
+	cfg.MethodRoutes = map[string]string{"eth_getLogs": node("archive"), "debug_*": node("tracer")}
+	useConfig(t, cfg)
+
+	postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"blockHash":"0xabc"}]}`)
+	postRPC(handleRPC, `{"jsonrpc":"2.0","id":2,"method":"debug_traceTransaction","params":["0xabc"]}`)
+	postRPC(handleRPC, `{"jsonrpc":"2.0","id":3,"method":"eth_chainId"}`)
+	// A batch spanning routes is split, and each reply lands in its slot.
+	rec := postRPC(handleRPC, `[
+		{"jsonrpc":"2.0","id":4,"method":"debug_traceCall","params":[{},"latest"]},
+		{"jsonrpc":"2.0","id":5,"method":"net_version"}
+	]`)
+
+	want := map[string]string{
+		"eth_getLogs":            "archive",
+		"debug_traceTransaction": "tracer",
+		"eth_chainId":            "full",
+		"debug_traceCall":        "tracer",
+		"net_version":            "full",
+	}
+	for method, node := range want {
+		if served[method] != node {
+			t.Errorf("%s served by %q, want %q", method, served[method], node)
+		}
+	}
+	var replies []testReply
+	if err := json.Unmarshal(rec.Body.Bytes(), &replies); err != nil || len(replies) != 2 {
+		t.Fatalf("batch reply %s: %v", rec.Body, err)
+	}
+	if string(replies[0].Result) != `"tracer"` || string(replies[1].Result) != `"full"` {
+		t.Errorf("batch replies out of place: %s", rec.Body)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// ===== UPSTREAM JSON-RPC ERRORS =====
+
+// errorSniffBytes is how much of a relayed reply is kept for spotting an
+// error object. Error replies are small and carry no result, so a longer
+// reply that is still going by then is a result, not an error.
+const errorSniffBytes = 64 << 10
+
+// errorSniffer keeps the first errorSniffBytes written to it and drops the
+// rest, so teeing a reply through it never buffers more than that.
+type errorSniffer struct {
+	buf bytes.Buffer
+}
+
+func (s *errorSniffer) Write(p []byte) (int, error) {
+	if room := errorSniffBytes - s.buf.Len(); room > 0 {
+		s.buf.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+// knownRPCCodes are the error codes given their own code label: JSON-RPC's
+// own, EIP-1474's and geth's 3 (execution reverted). Any other code an
+// upstream sends is counted as "other", so a node can't grow the metric
+// without bound.
+var knownRPCCodes = map[int]bool{
+	-32700: true, -32600: true, -32601: true, -32602: true, -32603: true,
+	-32000: true, -32001: true, -32002: true, -32003: true, -32004: true, -32005: true,
+	3: true,
+}
+
+func rpcCodeLabel(code int) string {
+	if knownRPCCodes[code] {
+		return strconv.Itoa(code)
+	}
+	return "other"
+}
+
+// countRPCErrors counts the JSON-RPC errors in a reply, or in as much of it
+// as was kept: a lone reply, or each reply of a batch. A reply that can't be
+// read, compressed ones included, counts nothing.
+func countRPCErrors(method string, body []byte) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if !bytes.HasPrefix(bytes.TrimLeft(body, " \t\r\n"), []byte("[")) {
+		countRPCError(method, dec)
+		return
+	}
+	if _, err := dec.Token(); err != nil {
+		return
+	}
+	for dec.More() {
+		var raw json.RawMessage
+		if dec.Decode(&raw) != nil {
+			return // cut off mid-batch
+		}
+		countRPCError(method, json.NewDecoder(bytes.NewReader(raw)))
+	}
+}
+
+// countRPCError reads one reply's top-level keys until it finds error or
+// result, so a large result isn't decoded just to learn it isn't an error.
+func countRPCError(method string, dec *json.Decoder) {
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return
+		}
+		switch key {
+		case "error":
+			var rpcErr RPCError
+			if dec.Decode(&rpcErr) == nil {
+				upstreamRPCErrors.WithLabelValues(method, rpcCodeLabel(rpcErr.Code)).Inc()
+			}
+			return
+		case "result":
+			return
+		}
+		var skip json.RawMessage
+		if dec.Decode(&skip) != nil {
+			return
+		}
+	}
+}
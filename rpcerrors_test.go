@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCountRPCErrorsBoundsCodes(t *testing.T) {
+	upstreamRPCErrors.Reset()
+	t.Cleanup(upstreamRPCErrors.Reset)
+	countRPCErrors("eth_call", []byte(`{"jsonrpc":"2.0","id":1,"error":{"code":3,"message":"execution reverted"}}`))
+	countRPCErrors("eth_call", []byte(`[
+		{"jsonrpc":"2.0","id":1,"result":"0x"},
+		{"jsonrpc":"2.0","id":2,"error":{"code":-32602,"message":"invalid params"}},
+		{"jsonrpc":"2.0","id":3,"error":{"code":-31337,"message":"made up"}},
+		{"jsonrpc":"2.0","id":4,"error":{"code":123456,"message":"made up too"}}
+	]`))
+
+	cases := []struct {
+		code string
+		want float64
+	}{
+		{"3", 1},
+		{"-32602", 1},
+		{"other", 2},
+	}
+	for _, c := range cases {
+		if got := testutil.ToFloat64(upstreamRPCErrors.WithLabelValues("eth_call", c.code)); got != c.want {
+			t.Errorf("code %s: counted %v, want %v", c.code, got, c.want)
+		}
+	}
+	if n := testutil.CollectAndCount(upstreamRPCErrors); n != 3 {
+		t.Errorf("%d code series, want 3", n)
+	}
+}
+
+func TestRPCCodeLabel(t *testing.T) {
+	cases := []struct {
+		code int
+		want string
+	}{
+		{-32700, "-32700"},
+		{-32601, "-32601"},
+		{-32005, "-32005"},
+		{-32006, "other"},
+		{-32099, "other"},
+		{3, "3"},
+		{0, "other"},
+		{42, "other"},
+	}
+	for _, c := range cases {
+		if got := rpcCodeLabel(c.code); got != c.want {
+			t.Errorf("rpcCodeLabel(%d) = %q, want %q", c.code, got, c.want)
+		}
+	}
+}
+
+func TestUpstreamRPCErrorsBoundMethods(t *testing.T) {
+	resetLimiters(t)
+	upstreamRPCErrors.Reset()
+	t.Cleanup(upstreamRPCErrors.Reset)
+	cfg := testConfig(rpcUpstream(t, func(string, json.RawMessage) interface{} {
+		return &RPCError{Code: -32601, Message: "the method does not exist"}
+	}).URL)
+	cfg.CountUpstreamErrors = true
+	useConfig(t, cfg)
+
+	// Made-up names reach the upstream when there is no allowlist.
+	for _, method := range []string{"junk_a", "junk_b", "eth_chainId"} {
+		postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"`+method+`"}`)
+	}
+	if got := testutil.ToFloat64(upstreamRPCErrors.WithLabelValues("other", "-32601")); got != 2 {
+		t.Errorf("counted %v errors for unknown methods, want 2", got)
+	}
+	if n := testutil.CollectAndCount(upstreamRPCErrors); n != 2 {
+		t.Errorf("%d series, want eth_chainId and other", n)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// ===== STRICT JSON-RPC =====
+
+// requestMembers are the only top-level members a strict request may have.
+var requestMembers = map[string]bool{"jsonrpc": true, "method": true, "params": true, "id": true}
+
+// checkStrict enforces StrictJSONRPC on one request object: no members
+// besides jsonrpc, method, params and id, and no object anywhere in it that
+// repeats a key. Either could make a lax upstream parser read the call
+// differently from the guard.
+func checkStrict(raw []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	// One key set per open object; nil entries stand for arrays.
+	var stack []map[string]bool
+	expectKey := false
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			// The request already parsed, so this is just the end of input.
+			return nil
+		}
+		switch t := tok.(type) {
+		case json.Delim:
+			switch t {
+			case '{':
+				stack = append(stack, map[string]bool{})
+				expectKey = true
+				continue
+			case '[':
+				stack = append(stack, nil)
+			case '}', ']':
+				stack = stack[:len(stack)-1]
+			}
+		case string:
+			if expectKey {
+				keys := stack[len(stack)-1]
+				if keys[t] {
+					return fmt.Errorf("duplicate member %q", t)
+				}
+				keys[t] = true
+				if len(stack) == 1 && !requestMembers[t] {
+					return fmt.Errorf("unknown member %q", t)
+				}
+				expectKey = false
+				continue
+			}
+		}
+		// After a value inside an object the next token is a key again.
+		expectKey = len(stack) > 0 && stack[len(stack)-1] != nil
+	}
+}
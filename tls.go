@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ===== TLS TERMINATION =====
+
+const defaultTLSAddr = ":8443"
+
+func tlsEnabled(cfg Config) bool {
+	return cfg.TLSCertFile != "" && cfg.TLSKeyFile != ""
+}
+
+func tlsAddr(cfg Config) string {
+	if cfg.TLSAddr != "" {
+		return cfg.TLSAddr
+	}
+	return defaultTLSAddr
+}
+
+// certReloader serves the keypair named by the live config, reloading it
+// when the paths change or either file is rewritten. Existing connections
+// keep their session; only new handshakes see the new certificate.
+type certReloader struct {
+	mu       sync.Mutex
+	certFile string
+	keyFile  string
+	certMod  time.Time
+	keyMod   time.Time
+	cert     *tls.Certificate
+}
+
+var certs certReloader
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cfg := getConfig()
+	certInfo, certErr := os.Stat(cfg.TLSCertFile)
+	keyInfo, keyErr := os.Stat(cfg.TLSKeyFile)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if certErr != nil || keyErr != nil {
+		// Mid-rotation or a bad path: keep serving the last good pair.
+		if c.cert != nil {
+			return c.cert, nil
+		}
+		return nil, fmt.Errorf("tls: certificate files unavailable")
+	}
+	if c.cert != nil && c.certFile == cfg.TLSCertFile && c.keyFile == cfg.TLSKeyFile &&
+		c.certMod.Equal(certInfo.ModTime()) && c.keyMod.Equal(keyInfo.ModTime()) {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		if c.cert != nil {
+			log.Printf("⚠️ TLS reload failed, keeping previous certificate: %v", err)
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	if c.cert != nil {
+		log.Printf("🔐 Reloaded TLS certificate from %s", cfg.TLSCertFile)
+	}
+	c.cert = &cert
+	c.certFile, c.keyFile = cfg.TLSCertFile, cfg.TLSKeyFile
+	c.certMod, c.keyMod = certInfo.ModTime(), keyInfo.ModTime()
+	return c.cert, nil
+}
+
+// ===== CLIENT CERTIFICATES =====
+
+// requireClientCert is set at startup when ClientCAFile is configured
+// alongside TLS; like TLS itself it can't be switched by a reload.
+var requireClientCert bool
+
+// loadClientCAs reads the PEM bundle client certificates must chain to.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", path)
+	}
+	return pool, nil
+}
+
+// enableClientCerts turns on mutual TLS for tc with the CAs in caFile.
+func enableClientCerts(tc *tls.Config, caFile string) error {
+	pool, err := loadClientCAs(caFile)
+	if err != nil {
+		return err
+	}
+	tc.ClientCAs = pool
+	tc.ClientAuth = tls.VerifyClientCertIfGiven
+	requireClientCert = true
+	return nil
+}
+
+// checkClientCert refuses requests without a verified client certificate
+// while mutual TLS is on. The handshake only verifies certificates that are
+// offered, so a missing one is answered here with a 403 rather than a
+// failed handshake the client can't make sense of.
+func (ex *exchange) checkClientCert(r *http.Request) *rejection {
+	if !requireClientCert {
+		return nil
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return &rejection{"client_cert_missing", "Client certificate required"}
+	}
+	ex.certNames = certNames(r.TLS.VerifiedChains[0][0])
+	return nil
+}
+
+// certNames lists the identities a client certificate can be mapped by in
+// ClientCertTiers: the subject common name, then DNS, email and URI SANs.
+func certNames(cert *x509.Certificate) []string {
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	return names
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// issueCert creates a certificate for cn and sans, signed by parent or
+// self-signed when parent is nil.
+func issueCert(t *testing.T, cn string, sans []string, isCA bool, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              sans,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	}
+	signer, signerKey := tmpl, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// mtlsServer serves handleRPC over TLS, requiring client certificates from ca
+// the way main does with client_ca_file set.
+func mtlsServer(t *testing.T, ca tls.Certificate) *httptest.Server {
+	t.Helper()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(handleRPC))
+	srv.TLS = &tls.Config{}
+	if err := enableClientCerts(srv.TLS, caFile); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { requireClientCert = false })
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// clientWith is srv's client presenting cert, or no certificate when nil.
+// The cert is offered even if it isn't from a CA the server asks for.
+func clientWith(srv *httptest.Server, cert *tls.Certificate) *http.Client {
+	tr := srv.Client().Transport.(*http.Transport).Clone()
+	if cert != nil {
+		tr.TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert, nil
+		}
+	}
+	return &http.Client{Transport: tr}
+}
+
+func TestMutualTLS(t *testing.T) {
+	resetLimiters(t)
+	cfg := testConfig(okUpstream(t).URL)
+	cfg.ClientCertTiers = map[string]string{"partner-svc": "partner", "batch.internal": "partner"}
+	cfg.RestrictFullBlockTxs = &FullBlockTxsConfig{RejectTiers: []string{"anonymous"}}
+	useConfig(t, cfg)
+
+	ca := issueCert(t, "test client CA", nil, true, nil)
+	srv := mtlsServer(t, ca)
+	byCN := issueCert(t, "partner-svc", nil, false, &ca)
+	bySAN := issueCert(t, "batch-7", []string{"batch.internal"}, false, &ca)
+	unmapped := issueCert(t, "someone-else", nil, false, &ca)
+	rogue := issueCert(t, "partner-svc", nil, false, nil)
+
+	// A full block fetch tells the partner tier from anonymous callers.
+	const body = `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["latest",true]}`
+	cases := []struct {
+		name   string
+		cert   *tls.Certificate
+		status int
+		reason string
+	}{
+		{"no certificate", nil, http.StatusForbidden, "client_cert_missing"},
+		{"mapped by common name", &byCN, http.StatusOK, ""},
+		{"mapped by DNS SAN", &bySAN, http.StatusOK, ""},
+		{"valid but unmapped", &unmapped, http.StatusForbidden, "full_block_denied"},
+	}
+	for _, c := range cases {
+		resp, err := clientWith(srv, c.cert).Post(srv.URL, "application/json", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		var reply testReply
+		json.NewDecoder(resp.Body).Decode(&reply)
+		resp.Body.Close()
+		if resp.StatusCode != c.status || reply.reason() != c.reason {
+			t.Errorf("%s: %d %q, want %d %q", c.name, resp.StatusCode, reply.reason(), c.status, c.reason)
+		}
+	}
+
+	// A certificate the CA didn't issue fails the handshake, whatever its name.
+	if resp, err := clientWith(srv, &rogue).Post(srv.URL, "application/json", bytes.NewBufferString(body)); err == nil {
+		resp.Body.Close()
+		t.Errorf("self-signed client certificate accepted: %d", resp.StatusCode)
+	}
+}
+
+func TestLoadClientCAsRejectsNonPEM(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(path, []byte("not a certificate"), 0o600)
+	if _, err := loadClientCAs(path); err == nil {
+		t.Error("loaded a CA bundle without certificates")
+	}
+	if _, err := loadClientCAs(filepath.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Error("loaded a missing CA bundle")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ===== TRACING =====
+
+const defaultTraceSampleRatio = 1.0
+
+// tracer goes through the global provider, which stays the no-op one unless
+// initTracing installs an exporter, so unconfigured spans cost next to nothing.
+var tracer = otel.Tracer("primea/rpcguard")
+
+// initTracing exports spans over OTLP/HTTP to OTelEndpoint, sampling
+// OTelSampleRatio of new traces; a caller's sampled traceparent is always
+// followed. It is read at startup only. The returned func flushes pending
+// spans on shutdown.
+func initTracing(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	if cfg.OTelEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(cfg.OTelEndpoint))
+	if err != nil {
+		return nil, err
+	}
+	ratio := defaultTraceSampleRatio
+	if cfg.OTelSampleRatio > 0 {
+		ratio = cfg.OTelSampleRatio
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "rpc-guard"))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// startRequestSpan opens the server span for an HTTP request, continuing the
+// caller's trace when it sent a W3C traceparent.
+func startRequestSpan(r *http.Request) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return tracer.Start(ctx, "rpc", trace.WithSpanKind(trace.SpanKindServer))
+}
+
+// startUpstreamSpan wraps a forward, retries included, in a client span.
+// The guard's own calls (probes, head lookups) have no request span and
+// are left untraced.
+func startUpstreamSpan(ctx context.Context) (context.Context, trace.Span) {
+	if !trace.SpanFromContext(ctx).SpanContext().IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return tracer.Start(ctx, "upstream", trace.WithSpanKind(trace.SpanKindClient))
+}
+
+// endUpstreamSpan records a failed forward before closing the span.
+func endUpstreamSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, errorKind(err))
+	}
+	span.End()
+}
+
+// injectTrace adds traceparent to an upstream request so node-side spans
+// join the caller's trace.
+func injectTrace(ctx context.Context, h http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(h))
+}
+
+// traceDecision annotates the request span with a guard decision. A batch
+// makes one decision per call, so each is also kept as a span event.
+func traceDecision(ctx context.Context, method, decision, reason string) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("rpc.method", method),
+		attribute.String("rpcguard.decision", decision),
+	}
+	if reason != "" {
+		attrs = append(attrs, attribute.String("rpcguard.reason", reason))
+	}
+	span.SetAttributes(attrs...)
+	span.AddEvent("decision", trace.WithAttributes(attrs...))
+}
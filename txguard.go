@@ -0,0 +1,141 @@
+package main
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// ===== RAW TRANSACTION GUARDS =====
+
+// checkRawTx decodes the eth_sendRawTransaction payload and applies the
+// transaction-level guards. Undecodable payloads are always rejected.
+func checkRawTx(cfg Config, params []interface{}) *rejection {
+	if len(params) == 0 {
+		return &rejection{"no_param", "Missing tx param"}
+	}
+	rawTxHex, _ := params[0].(string)
+	txBytes, err := decodeHex(rawTxHex)
+	if err != nil {
+		return &rejection{"invalid_tx_hex", "Invalid tx hex"}
+	}
+	// Before decoding, so an oversized payload is never parsed.
+	if cfg.MaxTxBytes > 0 && len(txBytes) > cfg.MaxTxBytes {
+		return &rejection{"tx_too_large", "Transaction too large"}
+	}
+	// UnmarshalBinary accepts both legacy RLP and typed (EIP-2718) envelopes.
+	var tx types.Transaction
+	if err := tx.UnmarshalBinary(txBytes); err != nil {
+		return &rejection{"malformed_tx", "Malformed transaction"}
+	}
+
+	if cfg.ExpectedChainID != 0 {
+		// Pre-EIP-155 legacy txs carry no chain ID and replay on any chain.
+		if !tx.Protected() {
+			if !cfg.AllowUnprotectedTx {
+				return &rejection{"unprotected_tx", "Unprotected (pre-EIP-155) transaction"}
+			}
+		} else if tx.ChainId().Cmp(big.NewInt(cfg.ExpectedChainID)) != 0 {
+			return &rejection{"wrong_chain_id", "Wrong chain ID"}
+		}
+	}
+
+	minGas := gwei(cfg.MinGasPriceGwei)
+	if txGasPrice(cfg, &tx).Cmp(minGas) < 0 {
+		return &rejection{"low_gas_price", "Gas price too low"}
+	}
+	// Only fee-market txs sign a separate tip; a legacy gasPrice is all tip.
+	if cfg.MinTipGwei > 0 && tx.Type() >= types.DynamicFeeTxType && tx.GasTipCap().Cmp(gwei(cfg.MinTipGwei)) < 0 {
+		return &rejection{"tip_too_low", "Priority fee too low"}
+	}
+	if cfg.MinBlobGasFeeGwei > 0 && tx.Type() == types.BlobTxType && tx.BlobGasFeeCap().Cmp(gwei(cfg.MinBlobGasFeeGwei)) < 0 {
+		return &rejection{"low_blob_gas_price", "Blob gas fee cap too low"}
+	}
+	if cfg.MaxGasLimit > 0 && tx.Gas() > cfg.MaxGasLimit {
+		return &rejection{"gas_limit_too_high", "Gas limit too high"}
+	}
+
+	if len(cfg.BlockedSenders) == 0 && cfg.MaxNonceGap == 0 && !cfg.PreflightSendRawTx {
+		return nil
+	}
+	// Fail closed: with sender checks active, an unrecoverable signature
+	// could hide a blocked sender.
+	from, err := txSender(&tx)
+	if err != nil {
+		return &rejection{"invalid_signature", "Invalid transaction signature"}
+	}
+	for _, blocked := range cfg.BlockedSenders {
+		if common.HexToAddress(blocked) == from {
+			return &rejection{"blocked_sender", "Sender not allowed"}
+		}
+	}
+	// A resubmission is answered from txDedup. Its first copy passed the
+	// checks below, and asking the upstream again would refuse it for the
+	// nonce that copy used.
+	if isResubmission(cfg, tx.Hash()) {
+		return nil
+	}
+	// Last, since these may cost an upstream call; the simulation is the
+	// most expensive, so it goes at the very end.
+	if cfg.MaxNonceGap > 0 {
+		if rej := checkNonceGap(cfg, from, tx.Nonce()); rej != nil {
+			return rej
+		}
+	}
+	if cfg.PreflightSendRawTx {
+		if rej := checkPreflight(cfg, &tx, from); rej != nil {
+			return rej
+		}
+	}
+	return nil
+}
+
+// rawTxHash decodes an eth_sendRawTransaction param far enough to hash it.
+// ok is false when it isn't a valid transaction.
+func rawTxHash(params []interface{}) (common.Hash, bool) {
+	if len(params) == 0 {
+		return common.Hash{}, false
+	}
+	rawTxHex, _ := params[0].(string)
+	txBytes, err := decodeHex(rawTxHex)
+	if err != nil {
+		return common.Hash{}, false
+	}
+	var tx types.Transaction
+	if err := tx.UnmarshalBinary(txBytes); err != nil {
+		return common.Hash{}, false
+	}
+	return tx.Hash(), true
+}
+
+// txSender recovers the signer. Unprotected legacy txs were signed under
+// Homestead rules; everything else uses the latest signer for its chain ID,
+// which covers EIP-155 legacy as well as every typed transaction.
+func txSender(tx *types.Transaction) (common.Address, error) {
+	var signer types.Signer = types.HomesteadSigner{}
+	if tx.Protected() {
+		signer = types.LatestSignerForChainID(tx.ChainId())
+	}
+	return types.Sender(signer, tx)
+}
+
+// txGasPrice is the per-gas price compared against MinGasPriceGwei. Legacy
+// and access-list txs pay GasPrice outright. For dynamic-fee and blob txs
+// GasPrice is only the fee cap, so with BaseFeeGwei set the effective price
+// min(feeCap, baseFee+tip) is used instead; without it the fee cap is kept.
+// Blob gas is priced separately and never counts here.
+func txGasPrice(cfg Config, tx *types.Transaction) *big.Int {
+	if tx.Type() < types.DynamicFeeTxType || cfg.BaseFeeGwei <= 0 {
+		return tx.GasPrice()
+	}
+	effective := new(big.Int).Add(gwei(cfg.BaseFeeGwei), tx.GasTipCap())
+	if effective.Cmp(tx.GasFeeCap()) > 0 {
+		return tx.GasFeeCap()
+	}
+	return effective
+}
+
+func gwei(n int64) *big.Int {
+	return new(big.Int).Mul(big.NewInt(n), big.NewInt(1_000_000_000))
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/crypto/kzg4844"
+	"github.com/holiman/uint256"
+)
+
+// testKey signs the transaction fixtures; it guards no funds anywhere.
+var testKey, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+
+// signedTx signs data for chain 1 and returns it as eth_sendRawTransaction
+// sends it.
+func signedTx(t *testing.T, data types.TxData) string {
+	t.Helper()
+	tx, err := types.SignNewTx(testKey, types.LatestSignerForChainID(big.NewInt(1)), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hexutil.Encode(raw)
+}
+
+func gweiTx(gas uint64, gasPriceGwei int64) *types.LegacyTx {
+	to := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+	return &types.LegacyTx{Nonce: 1, To: &to, Gas: gas, GasPrice: gwei(gasPriceGwei), Value: big.NewInt(1)}
+}
+
+func rawTxReason(cfg Config, params ...interface{}) string {
+	if rej := checkRawTx(cfg, params); rej != nil {
+		return rej.reason
+	}
+	return ""
+}
+
+func TestCheckRawTxGasLimit(t *testing.T) {
+	cfg := Config{MaxGasLimit: 100_000, MinGasPriceGwei: 2}
+	cases := []struct {
+		name   string
+		tx     string
+		reason string
+	}{
+		{"under the limit", signedTx(t, gweiTx(21_000, 5)), ""},
+		{"at the limit", signedTx(t, gweiTx(100_000, 5)), ""},
+		{"over the limit", signedTx(t, gweiTx(100_001, 5)), "gas_limit_too_high"},
+		{"whole block", signedTx(t, gweiTx(30_000_000, 5)), "gas_limit_too_high"},
+		{"cheap and over the limit", signedTx(t, gweiTx(30_000_000, 1)), "low_gas_price"},
+		{"cheap", signedTx(t, gweiTx(21_000, 1)), "low_gas_price"},
+		// Neither check runs on a payload that doesn't decode.
+		{"not RLP", "0xdeadbeef", "malformed_tx"},
+		{"not hex", "0xzz", "invalid_tx_hex"},
+	}
+	for _, c := range cases {
+		if got := rawTxReason(cfg, c.tx); got != c.reason {
+			t.Errorf("%s: reason %q, want %q", c.name, got, c.reason)
+		}
+	}
+	if got := rawTxReason(cfg); got != "no_param" {
+		t.Errorf("no params: reason %q, want no_param", got)
+	}
+	if got := rawTxReason(Config{}, signedTx(t, gweiTx(30_000_000, 0))); got != "" {
+		t.Errorf("no limit configured: reason %q, want none", got)
+	}
+}
+
+func TestCheckRawTxSizeLimit(t *testing.T) {
+	tx := signedTx(t, gweiTx(21_000, 5))
+	size := (len(tx) - 2) / 2
+	cases := []struct {
+		name   string
+		limit  int
+		tx     string
+		reason string
+	}{
+		{"at the limit", size, tx, ""},
+		{"one byte over", size - 1, tx, "tx_too_large"},
+		{"no limit", 0, tx, ""},
+		// Size comes first: garbage too big is refused without decoding.
+		{"oversized garbage", 64, "0x" + strings.Repeat("ff", 65), "tx_too_large"},
+		{"garbage within", 64, "0x" + strings.Repeat("ff", 64), "malformed_tx"},
+	}
+	for _, c := range cases {
+		if got := rawTxReason(Config{MaxTxBytes: c.limit}, c.tx); got != c.reason {
+			t.Errorf("%s: reason %q, want %q", c.name, got, c.reason)
+		}
+	}
+}
+
+// blobTx is a type-3 transaction paying feeCap/tip gwei for gas and
+// blobFeeCap gwei for blob gas, carrying one empty blob with its sidecar.
+func blobTx(t *testing.T, feeCap, tip, blobFeeCap int64) *types.BlobTx {
+	t.Helper()
+	var blob kzg4844.Blob
+	commitment, err := kzg4844.BlobToCommitment(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := kzg4844.ComputeBlobProof(blob, commitment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sidecar := &types.BlobTxSidecar{
+		Blobs:       []kzg4844.Blob{blob},
+		Commitments: []kzg4844.Commitment{commitment},
+		Proofs:      []kzg4844.Proof{proof},
+	}
+	return &types.BlobTx{
+		ChainID:    uint256.NewInt(1),
+		Nonce:      1,
+		GasTipCap:  uint256.MustFromBig(gwei(tip)),
+		GasFeeCap:  uint256.MustFromBig(gwei(feeCap)),
+		Gas:        21_000,
+		To:         common.HexToAddress("0x00000000000000000000000000000000000000aa"),
+		Value:      uint256.NewInt(0),
+		BlobFeeCap: uint256.MustFromBig(gwei(blobFeeCap)),
+		BlobHashes: sidecar.BlobHashes(),
+		Sidecar:    sidecar,
+	}
+}
+
+func TestCheckRawTxBlob(t *testing.T) {
+	cases := []struct {
+		name   string
+		cfg    Config
+		tx     *types.BlobTx
+		reason string
+	}{
+		{"fee cap above minimum", Config{MinGasPriceGwei: 10}, blobTx(t, 20, 1, 1), ""},
+		{"fee cap below minimum", Config{MinGasPriceGwei: 10}, blobTx(t, 5, 1, 100), "low_gas_price"},
+		// With a base fee the effective price is min(feeCap, base+tip).
+		{"effective price too low", Config{MinGasPriceGwei: 10, BaseFeeGwei: 3}, blobTx(t, 20, 1, 1), "low_gas_price"},
+		{"effective price enough", Config{MinGasPriceGwei: 10, BaseFeeGwei: 3}, blobTx(t, 20, 7, 1), ""},
+		// Blob gas is priced on its own and never counts as gas.
+		{"blob fee cap enough", Config{MinBlobGasFeeGwei: 5}, blobTx(t, 1, 1, 5), ""},
+		{"blob fee cap too low", Config{MinBlobGasFeeGwei: 5}, blobTx(t, 100, 50, 4), "low_blob_gas_price"},
+		{"tip too low", Config{MinTipGwei: 2}, blobTx(t, 100, 1, 1), "tip_too_low"},
+	}
+	for _, c := range cases {
+		raw := signedTx(t, c.tx)
+		if got := rawTxReason(c.cfg, raw); got != c.reason {
+			t.Errorf("%s: reason %q, want %q", c.name, got, c.reason)
+		}
+	}
+
+	// The same tx without its sidecar, as it appears in a block, decodes too.
+	bare := blobTx(t, 20, 1, 1)
+	bare.Sidecar = nil
+	if got := rawTxReason(Config{MinGasPriceGwei: 10}, signedTx(t, bare)); got != "" {
+		t.Errorf("blob tx without sidecar: reason %q", got)
+	}
+}
+
+func TestMalformedRawTxNotForwarded(t *testing.T) {
+	resetLimiters(t)
+	var sent atomic.Int32
+	cfg := testConfig(rpcUpstream(t, func(method string, _ json.RawMessage) interface{} {
+		if method == "eth_sendRawTransaction" {
+			sent.Add(1)
+		}
+		return "0x1"
+	}).URL)
+	useConfig(t, cfg)
+	good := signedTx(t, gweiTx(21_000, 5))
+
+	cases := []struct {
+		name string
+		tx   string
+	}{
+		{"truncated", good[:len(good)-10]},
+		{"trailing bytes", good + "00"},
+		{"not rlp", "0xdeadbeef"},
+		{"unknown type", "0x7f" + good[2:]},
+		{"typed, truncated body", "0x02c0"},
+	}
+	for _, c := range cases {
+		rec := postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"eth_sendRawTransaction","params":["`+c.tx+`"]}`)
+		var reply testReply
+		json.Unmarshal(rec.Body.Bytes(), &reply)
+		if reply.reason() != "malformed_tx" || reply.Error.Code != -32602 || rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d %s, want a 400 malformed_tx -32602", c.name, rec.Code, rec.Body)
+		}
+	}
+	if n := sent.Load(); n != 0 {
+		t.Errorf("%d malformed transactions reached the upstream", n)
+	}
+	// The same path still forwards a well-formed one.
+	if rec := postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"eth_sendRawTransaction","params":["`+good+`"]}`); sent.Load() != 1 {
+		t.Errorf("well-formed tx not forwarded: %s", rec.Body)
+	}
+}
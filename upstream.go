@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ===== UPSTREAM =====
+
+const (
+	defaultUpstreamTimeout     = 10 * time.Second
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 100
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// poolSettings are the transport knobs taken from Config. The client is only
+// rebuilt when they change, so steady-state traffic keeps its idle pool.
+type poolSettings struct {
+	maxIdle        int
+	maxIdlePerHost int
+	idleTimeout    time.Duration
+}
+
+// errResponseTooLarge is returned for an upstream reply over MaxResponseBytes.
+var errResponseTooLarge = errors.New("upstream response too large")
+
+var (
+	upstreamClient *http.Client
+	upstreamPool   poolSettings
+	upstreamLock   sync.Mutex
+)
+
+func poolSettingsFor(cfg Config) poolSettings {
+	ps := poolSettings{
+		maxIdle:        defaultMaxIdleConns,
+		maxIdlePerHost: defaultMaxIdleConnsPerHost,
+		idleTimeout:    defaultIdleConnTimeout,
+	}
+	if cfg.MaxIdleConns > 0 {
+		ps.maxIdle = cfg.MaxIdleConns
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		ps.maxIdlePerHost = cfg.MaxIdleConnsPerHost
+	}
+	if cfg.IdleConnTimeout > 0 {
+		ps.idleTimeout = time.Duration(cfg.IdleConnTimeout) * time.Millisecond
+	}
+	return ps
+}
+
+// getUpstreamClient returns the shared pooled client, replacing it when the
+// pool settings in cfg differ from the ones it was built with. The deadline is
+// applied per request, so timeout changes never require a rebuild.
+func getUpstreamClient(cfg Config) *http.Client {
+	ps := poolSettingsFor(cfg)
+	upstreamLock.Lock()
+	defer upstreamLock.Unlock()
+
+	if upstreamClient != nil && upstreamPool == ps {
+		return upstreamClient
+	}
+	if upstreamClient != nil {
+		upstreamClient.CloseIdleConnections()
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = ps.maxIdle
+	transport.MaxIdleConnsPerHost = ps.maxIdlePerHost
+	transport.IdleConnTimeout = ps.idleTimeout
+	upstreamClient = &http.Client{Transport: transport}
+	upstreamPool = ps
+	return upstreamClient
+}
+
+func upstreamTimeout(cfg Config) time.Duration {
+	if cfg.UpstreamTimeout > 0 {
+		return time.Duration(cfg.UpstreamTimeout) * time.Millisecond
+	}
+	return defaultUpstreamTimeout
+}
+
+// withMethodTimeout sets cfg's upstream deadline for a call to methods: a
+// MethodTimeouts entry beats upstream_timeout_ms. A batch gets the longest
+// deadline any of its calls would get on its own, so one slow call in it
+// isn't cut short.
+func withMethodTimeout(cfg Config, methods []string) Config {
+	base := upstreamTimeout(cfg)
+	var timeout time.Duration
+	overridden := false
+	for _, m := range methods {
+		d := base
+		if ms, ok := cfg.MethodTimeouts[m]; ok {
+			d, overridden = time.Duration(ms)*time.Millisecond, true
+		}
+		timeout = max(timeout, d)
+	}
+	if !overridden {
+		return cfg
+	}
+	cfg.UpstreamTimeout = timeout.Milliseconds()
+	return cfg
+}
+
+// forwardUpstream POSTs body to the next healthy upstream in the pool,
+// retrying up to MaxRetries times on another endpoint when the attempt fails
+// to connect, or times out and methods (the calls in body) are all
+// read-only. The client returns only once response headers
+// have arrived, so a retry can never follow a partially relayed body. The
+// caller must close the response body, which also releases the deadline.
+// header is added to every attempt; it may be nil. Cancelling ctx, e.g. when
+// the client hangs up, aborts the call and any further retries.
+// While the pool's circuit breaker is open nothing is sent and errCircuitOpen is
+// returned. With UpstreamConcurrency set, the call holds an upstream slot
+// until the response body is closed, or fails with errUpstreamBusy.
+func forwardUpstream(ctx context.Context, cfg Config, methods []string, body []byte, header http.Header) (*http.Response, error) {
+	ctx, span := startUpstreamSpan(ctx)
+	// The slot comes first: once allow hands out the half-open probe, the
+	// call must reach breaker.record or the breaker stays half-open for good.
+	release, err := acquireUpstream(ctx, cfg)
+	if err != nil {
+		endUpstreamSpan(span, err)
+		return nil, err
+	}
+	breaker := breakerFor(cfg)
+	if !breaker.allow(cfg) {
+		release()
+		endUpstreamSpan(span, errCircuitOpen)
+		return nil, errCircuitOpen
+	}
+	resp, err := forwardWithRetries(ctx, cfg, allReadOnly(methods), body, header)
+	if err != nil {
+		release()
+	} else {
+		resp.Body = releaseOnClose{resp.Body, release}
+	}
+	breaker.record(cfg, resp, err)
+	endUpstreamSpan(span, err)
+	return resp, err
+}
+
+func forwardWithRetries(ctx context.Context, cfg Config, readOnly bool, body []byte, header http.Header) (*http.Response, error) {
+	var lastEndpoint string
+	var err error
+	for attempt := 0; attempt <= cfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(retryBackoff(cfg, attempt)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		endpoint := pickUpstream(cfg, lastEndpoint)
+		if attempt > 0 {
+			upstreamRetries.WithLabelValues(endpoint).Inc()
+		}
+		var resp *http.Response
+		resp, err = attemptUpstream(ctx, cfg, endpoint, body, header)
+		if err == nil {
+			return resp, nil
+		}
+		if !isRetryable(err, readOnly) {
+			return nil, err
+		}
+		lastEndpoint = endpoint
+	}
+	return nil, err
+}
+
+const defaultRetryBackoff = 100 * time.Millisecond
+
+// retryBackoff doubles RetryBackoff for each further attempt.
+func retryBackoff(cfg Config, attempt int) time.Duration {
+	base := defaultRetryBackoff
+	if cfg.RetryBackoff > 0 {
+		base = time.Duration(cfg.RetryBackoff) * time.Millisecond
+	}
+	return base << (attempt - 1)
+}
+
+// isRetryable limits retries to failures where the upstream cannot have
+// acted on the call: a refused connection. A timeout or a reset may come
+// after the node received and applied the call (a sent transaction, say),
+// so those are retried only for read-only calls.
+func isRetryable(err error, readOnly bool) bool {
+	if isTimeout(err) || errors.Is(err, syscall.ECONNRESET) {
+		return readOnly
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+func attemptUpstream(ctx context.Context, cfg Config, endpoint string, body []byte, header http.Header) (*http.Response, error) {
+	upstreamRequests.WithLabelValues(endpoint).Inc()
+	resp, err := forwardTo(ctx, cfg, endpoint, body, header)
+	if err != nil {
+		upstreamErrors.WithLabelValues(endpoint, errorKind(err)).Inc()
+	}
+	switch {
+	case err == nil:
+		markUpstreamUp(endpoint)
+	case isClientCancel(err):
+		// The client went away; says nothing about the endpoint.
+	case !isTimeout(err):
+		// A slow reply is not a dead node; only connection failures bench it.
+		markUpstreamDown(cfg, endpoint)
+	}
+	return resp, err
+}
+
+func forwardTo(ctx context.Context, cfg Config, endpoint string, body []byte, header http.Header) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout(cfg))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Content-Type", "application/json")
+	injectTrace(ctx, req.Header)
+
+	resp, err := getUpstreamClient(cfg).Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+// callUpstream makes a JSON-RPC call of the guard's own (e.g. probes and
+// lookups needed by a guard) and returns the raw result.
+func callUpstream(cfg Config, method string, params ...interface{}) (json.RawMessage, error) {
+	return callUpstreamCtx(context.Background(), cfg, method, params...)
+}
+
+// callUnslotted is callUpstream without taking an UpstreamConcurrency slot.
+func callUnslotted(cfg Config, method string, params ...interface{}) (json.RawMessage, error) {
+	return callUpstreamCtx(unslotted(context.Background()), cfg, method, params...)
+}
+
+func callUpstreamCtx(ctx context.Context, cfg Config, method string, params ...interface{}) (json.RawMessage, error) {
+	if params == nil {
+		params = []interface{}{}
+	}
+	payload, err := json.Marshal(RPCRequest{JSONRPC: "2.0", Method: method, Params: params, ID: json.RawMessage("1")})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := forwardUpstream(ctx, withMethodTimeout(cfg, []string{method}), []string{method}, payload, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if err := decodeUpstream(resp); err != nil {
+		return nil, fmt.Errorf("bad response: %w", err)
+	}
+	var reply struct {
+		Result json.RawMessage `json:"result"`
+		Error  *RPCError       `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("bad response: %w", err)
+	}
+	if reply.Error != nil {
+		return nil, &upstreamRPCError{*reply.Error}
+	}
+	return reply.Result, nil
+}
+
+// upstreamRPCError is a JSON-RPC error returned for one of the guard's own
+// calls, as opposed to the call never being answered.
+type upstreamRPCError struct {
+	RPCError
+}
+
+func (e *upstreamRPCError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// relayedHeaders are the upstream response headers passed back to clients.
+var relayedHeaders = []string{"Content-Type", "Content-Encoding", "Retry-After"}
+
+// relayUpstream copies the upstream status, relevant headers and body to w,
+// so an upstream 429 or 5xx reaches the client as such instead of a 200.
+// The body is streamed and its size is recorded under method. With
+// MaxResponseBytes set it is first read up to that size instead, and a
+// bigger one is refused with errResponseTooLarge before anything is written,
+// leaving the caller free to answer with an error.
+func relayUpstream(w http.ResponseWriter, resp *http.Response, cfg Config, method string) error {
+	var body io.Reader = resp.Body
+	if cfg.MaxResponseBytes > 0 {
+		buf, err := io.ReadAll(io.LimitReader(resp.Body, cfg.MaxResponseBytes+1))
+		if err != nil {
+			return err
+		}
+		if int64(len(buf)) > cfg.MaxResponseBytes {
+			responsesTooLarge.WithLabelValues(method).Inc()
+			return errResponseTooLarge
+		}
+		body = bytes.NewReader(buf)
+	}
+	for _, h := range relayedHeaders {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	var sniff *errorSniffer
+	if cfg.CountUpstreamErrors {
+		sniff = &errorSniffer{}
+		body = io.TeeReader(body, sniff)
+	}
+	w.WriteHeader(resp.StatusCode)
+	n, _ := io.Copy(w, body)
+	responseBytes.WithLabelValues(method).Observe(float64(n))
+	if sniff != nil {
+		countRPCErrors(method, sniff.buf.Bytes())
+	}
+	return nil
+}
+
+// countingReader tallies bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// errorKind classifies a failed upstream attempt for the error metric, so a
+// flaky client (cancelled) can be told apart from a failing node.
+func errorKind(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case isClientCancel(err):
+		return "cancelled"
+	case isTimeout(err):
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection_reset"
+	}
+	return "other"
+}
+
+// isClientCancel reports whether a forward failed because the client's
+// request context was cancelled, i.e. the client disconnected.
+func isClientCancel(err error) bool {
+	return errors.Is(err, context.Canceled)
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// answeredInBand reports whether a forwarding error is answered with a
+// JSON-RPC error rather than an HTTP 502.
+func answeredInBand(err error) bool {
+	return isTimeout(err) || errors.Is(err, errCircuitOpen)
+}
+
+// upstreamErrorResponse builds the JSON-RPC error returned in place of a
+// result when forwarding a call failed.
+func upstreamErrorResponse(id json.RawMessage, err error) RPCResponse {
+	msg := "upstream RPC failed"
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		msg = "upstream unavailable"
+	case errors.Is(err, errResponseTooLarge):
+		msg = "response too large"
+	case isTimeout(err):
+		msg = "upstream timeout"
+	}
+	return RPCResponse{
+		JSONRPC: "2.0",
+		ID:      id,
+		Error:   &RPCError{Code: -32000, Message: msg},
+	}
+}
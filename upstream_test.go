@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestRetriesTimeoutsOnlyForReadOnly(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	t.Cleanup(srv.Close)
+	cfg := Config{GethRPC: srv.URL, LogBlockRangeLimit: 10, UpstreamTimeout: 20, MaxRetries: 2, RetryBackoff: 1}
+
+	cases := []struct {
+		methods []string
+		want    int32
+	}{
+		{[]string{"eth_blockNumber"}, 3},
+		{[]string{"eth_sendRawTransaction"}, 1},
+		{[]string{"eth_call", "eth_sendRawTransaction"}, 1},
+		{nil, 1},
+	}
+	for _, c := range cases {
+		hits.Store(0)
+		if _, err := forwardUpstream(context.Background(), cfg, c.methods, []byte(`{}`), nil); !isTimeout(err) {
+			t.Fatalf("%v: got %v, want a timeout", c.methods, err)
+		}
+		if got := hits.Load(); got != c.want {
+			t.Errorf("%v: %d attempts, want %d", c.methods, got, c.want)
+		}
+	}
+}
+
+func TestRetriesResetsOnlyForReadOnly(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		// The request arrived in full; the node may well have acted on it.
+		io.Copy(io.Discard, r.Body)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}))
+	t.Cleanup(srv.Close)
+	cfg := Config{GethRPC: srv.URL, LogBlockRangeLimit: 10, MaxRetries: 2, RetryBackoff: 1}
+
+	cases := []struct {
+		methods []string
+		want    int32
+	}{
+		{[]string{"eth_blockNumber"}, 3},
+		{[]string{"eth_sendRawTransaction"}, 1},
+	}
+	for _, c := range cases {
+		hits.Store(0)
+		if _, err := forwardUpstream(context.Background(), cfg, c.methods, []byte(`{}`), nil); !errors.Is(err, syscall.ECONNRESET) {
+			t.Fatalf("%v: got %v, want a reset", c.methods, err)
+		}
+		if got := hits.Load(); got != c.want {
+			t.Errorf("%v: %d attempts, want %d", c.methods, got, c.want)
+		}
+	}
+}
+
+// newConnCounter traces ctx's requests and counts the connections dialed for
+// them rather than taken from the idle pool.
+func newConnCounter(ctx context.Context) (context.Context, *atomic.Int64) {
+	var n atomic.Int64
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !info.Reused {
+				n.Add(1)
+			}
+		},
+	}), &n
+}
+
+func forwardAndDrain(tb testing.TB, ctx context.Context, cfg Config) {
+	resp, err := forwardUpstream(ctx, cfg, []string{"eth_blockNumber"}, []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`), nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+func TestForwardUpstreamReusesConnections(t *testing.T) {
+	cfg := testConfig(okUpstream(t).URL)
+	ctx, dialed := newConnCounter(context.Background())
+	for i := 0; i < 50; i++ {
+		forwardAndDrain(t, ctx, cfg)
+	}
+	if n := dialed.Load(); n != 1 {
+		t.Errorf("50 sequential calls dialed %d connections, want 1", n)
+	}
+}
+
+// BenchmarkForwardUpstream reports the new-conns dialed over each run, which
+// starts from an empty pool: with pooling working that is about one per
+// concurrent caller, however large b.N.
+func BenchmarkForwardUpstream(b *testing.B) {
+	cfg := testConfig(okUpstream(b).URL)
+	b.Run("serial", func(b *testing.B) {
+		getUpstreamClient(cfg).CloseIdleConnections()
+		ctx, dialed := newConnCounter(context.Background())
+		for i := 0; i < b.N; i++ {
+			forwardAndDrain(b, ctx, cfg)
+		}
+		b.ReportMetric(float64(dialed.Load()), "new-conns")
+	})
+	b.Run("parallel", func(b *testing.B) {
+		getUpstreamClient(cfg).CloseIdleConnections()
+		ctx, dialed := newConnCounter(context.Background())
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				forwardAndDrain(b, ctx, cfg)
+			}
+		})
+		b.ReportMetric(float64(dialed.Load()), "new-conns")
+	})
+}
+
+func TestUpstreamStatusRelayed(t *testing.T) {
+	cases := []struct {
+		status     int
+		retryAfter string
+	}{
+		{http.StatusOK, ""},
+		{http.StatusTooManyRequests, "7"},
+		{http.StatusInternalServerError, ""},
+		{http.StatusServiceUnavailable, "30"},
+	}
+	for _, c := range cases {
+		t.Run(http.StatusText(c.status), func(t *testing.T) {
+			resetLimiters(t)
+			const body = `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"busy"}}`
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.Header().Set("X-Upstream-Internal", "secret")
+				if c.retryAfter != "" {
+					w.Header().Set("Retry-After", c.retryAfter)
+				}
+				w.WriteHeader(c.status)
+				w.Write([]byte(body))
+			}))
+			t.Cleanup(srv.Close)
+			useConfig(t, testConfig(srv.URL))
+
+			rec := postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`)
+			if rec.Code != c.status {
+				t.Errorf("status %d, want %d", rec.Code, c.status)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json; charset=utf-8" {
+				t.Errorf("Content-Type %q", got)
+			}
+			if got := rec.Header().Get("Retry-After"); got != c.retryAfter {
+				t.Errorf("Retry-After %q, want %q", got, c.retryAfter)
+			}
+			if rec.Header().Get("X-Upstream-Internal") != "" {
+				t.Error("unlisted upstream header was relayed")
+			}
+			if rec.Body.String() != body {
+				t.Errorf("body %q, want %q", rec.Body, body)
+			}
+		})
+	}
+}
+
+// observations is how many samples h holds under label.
+func observations(t *testing.T, h *prometheus.HistogramVec, label string) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := h.WithLabelValues(label).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestUpstreamDurationObserved(t *testing.T) {
+	resetLimiters(t)
+	upstreamDuration.Reset()
+	t.Cleanup(upstreamDuration.Reset)
+	cfg := testConfig(okUpstream(t).URL)
+	cfg.BlockedMethods = []string{"admin_peers"}
+	useConfig(t, cfg)
+
+	postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`)
+	postRPC(handleRPC, `{"jsonrpc":"2.0","id":2,"method":"eth_blockNumber"}`)
+	postRPC(handleRPC, `{"jsonrpc":"2.0","id":3,"method":"admin_peers"}`)
+	postRPC(handleRPC, `[{"jsonrpc":"2.0","id":4,"method":"eth_chainId"}]`)
+
+	cases := []struct {
+		label string
+		want  uint64
+	}{
+		{"eth_blockNumber", 2},
+		{"admin_peers", 0}, // rejected, never forwarded
+		{"batch", 1},
+	}
+	for _, c := range cases {
+		if got := observations(t, upstreamDuration, c.label); got != c.want {
+			t.Errorf("%s: %d observations, want %d", c.label, got, c.want)
+		}
+	}
+}
+
+func TestClientDisconnectCancelsUpstream(t *testing.T) {
+	cases := []struct{ method, label string }{
+		{"eth_estimateGas", "eth_estimateGas"},
+		// Forwarded without an allowlist, but counted under a bounded label.
+		{"junk_abandoned", "other"},
+	}
+	for _, c := range cases {
+		t.Run(c.method, func(t *testing.T) {
+			resetLimiters(t)
+			arrived, cancelled := make(chan struct{}), make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// The server only notices a dropped connection once the body is read.
+				io.Copy(io.Discard, r.Body)
+				close(arrived)
+				select {
+				case <-r.Context().Done():
+					close(cancelled)
+				case <-time.After(5 * time.Second):
+				}
+			}))
+			t.Cleanup(srv.Close)
+			useConfig(t, testConfig(srv.URL))
+			accepted := testutil.ToFloat64(decisions.WithLabelValues(c.label, "accept"))
+			aborted := testutil.ToFloat64(clientCancels.WithLabelValues(c.label))
+
+			ctx, hangUp := context.WithCancel(context.Background())
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(`{"jsonrpc":"2.0","id":1,"method":"`+c.method+`"}`)).WithContext(ctx)
+			req.Header.Set("Content-Type", "application/json")
+			done := make(chan struct{})
+			go func() {
+				handleRPC(httptest.NewRecorder(), req)
+				close(done)
+			}()
+			<-arrived
+			hangUp()
+
+			select {
+			case <-cancelled:
+			case <-time.After(2 * time.Second):
+				t.Fatal("upstream call outlived the client")
+			}
+			<-done
+			if got := testutil.ToFloat64(clientCancels.WithLabelValues(c.label)) - aborted; got != 1 {
+				t.Errorf("%v client aborts counted under %q, want 1", got, c.label)
+			}
+			if got := testutil.ToFloat64(decisions.WithLabelValues(c.label, "accept")) - accepted; got != 0 {
+				t.Errorf("%v accepts counted for an abandoned call, want 0", got)
+			}
+		})
+	}
+}
+
+func TestWithMethodTimeout(t *testing.T) {
+	cases := []struct {
+		name    string
+		global  int64
+		methods []string
+		want    int64
+	}{
+		{"default", 0, []string{"eth_chainId"}, 0},
+		{"global only", 500, []string{"eth_chainId"}, 500},
+		{"override beats global", 500, []string{"eth_getLogs"}, 3000},
+		{"override beats default", 0, []string{"eth_getLogs"}, 3000},
+		{"override may be shorter", 500, []string{"eth_blockNumber"}, 50},
+		{"batch takes the longest", 500, []string{"eth_blockNumber", "eth_getLogs"}, 3000},
+		{"batch keeps a longer global", 500, []string{"eth_blockNumber", "eth_chainId"}, 500},
+		{"batch with the default", 0, []string{"eth_blockNumber", "eth_chainId"}, defaultUpstreamTimeout.Milliseconds()},
+	}
+	for _, c := range cases {
+		cfg := Config{UpstreamTimeout: c.global, MethodTimeouts: map[string]int{"eth_getLogs": 3000, "eth_blockNumber": 50}}
+		if got := withMethodTimeout(cfg, c.methods).UpstreamTimeout; got != c.want {
+			t.Errorf("%s: timeout %dms, want %dms", c.name, got, c.want)
+		}
+	}
+}
+
+func TestMethodTimeoutsOnSlowUpstream(t *testing.T) {
+	// Every call takes 100ms; only a deadline longer than that gets an answer.
+	srv := rpcUpstream(t, func(string, json.RawMessage) interface{} {
+		time.Sleep(100 * time.Millisecond)
+		return "0x1"
+	})
+	cases := []struct {
+		name     string
+		global   int64
+		method   string
+		timedOut bool
+	}{
+		{"global too short", 30, "eth_chainId", true},
+		{"override extends it", 30, "eth_getLogs", false},
+		{"global long enough", 2000, "eth_chainId", false},
+		{"override cuts it short", 2000, "eth_blockNumber", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resetLimiters(t)
+			resetHead(t)
+			cfg := testConfig(srv.URL)
+			cfg.UpstreamTimeout = c.global
+			cfg.MethodTimeouts = map[string]int{"eth_getLogs": 2000, "eth_blockNumber": 30}
+			cfg.LogBlockRangeLimit = 0
+			useConfig(t, cfg)
+
+			var reply testReply
+			json.Unmarshal(postRPC(handleRPC, `{"jsonrpc":"2.0","id":1,"method":"`+c.method+`","params":[]}`).Body.Bytes(), &reply)
+			timedOut := reply.Error != nil && reply.Error.Message == "upstream timeout"
+			if timedOut != c.timedOut {
+				t.Errorf("timed out %v, want %v (reply %+v)", timedOut, c.timedOut, reply.Error)
+			}
+		})
+	}
+}
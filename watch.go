@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ===== CONFIG WATCHER =====
+
+var errWatcherClosed = errors.New("watcher closed")
+
+// configDebounce collapses the burst of events a single save produces.
+const configDebounce = 250 * time.Millisecond
+
+// watchConfig reloads the config whenever the file is written or replaced.
+// It watches the parent directory rather than the file, so editors that save
+// by renaming a temp file over it (and Kubernetes ConfigMap symlink swaps)
+// are still seen after the original inode is gone. It returns nil once ctx
+// is done, or an error if the watch can't be set up or breaks.
+func watchConfig(ctx context.Context, path string) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		return err
+	}
+	base := filepath.Base(path)
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-w.Events:
+			if !ok {
+				return errWatcherClosed
+			}
+			name := filepath.Base(ev.Name)
+			if name != base && name != "..data" {
+				continue
+			}
+			if ev.Has(fsnotify.Write) || ev.Has(fsnotify.Create) {
+				debounce = time.After(configDebounce)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return errWatcherClosed
+			}
+			return err
+		case <-debounce:
+			debounce = nil
+			reloadConfig(path)
+		}
+	}
+}
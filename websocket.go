@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// ===== WEBSOCKET PROXY =====
+
+const defaultWSPath = "/ws"
+
+// wsMaxInFlight caps the frames of one connection that are out on HTTP at
+// once; further frames wait to be read until one of them is answered.
+const wsMaxInFlight = 16
+
+var wsUpgrader = websocket.Upgrader{
+	// Browser dApps connect from arbitrary origins; access is governed by
+	// the same guards as HTTP, not by origin.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+func wsPath(cfg Config) string {
+	if cfg.WSPath != "" {
+		return cfg.WSPath
+	}
+	return defaultWSPath
+}
+
+// wsUpstreamURL is GethWS, or the next HTTP upstream with its scheme
+// switched to ws(s).
+func wsUpstreamURL(cfg Config) string {
+	if cfg.GethWS != "" {
+		return cfg.GethWS
+	}
+	httpURL := pickUpstream(cfg, "")
+	if strings.HasPrefix(httpURL, "https://") {
+		return "wss://" + strings.TrimPrefix(httpURL, "https://")
+	}
+	return "ws://" + strings.TrimPrefix(httpURL, "http://")
+}
+
+// subscriptionMethods need the upstream WebSocket: the subscription, and any
+// notifications it produces, live on that connection. The kind of feed
+// (newHeads, logs, newPendingTransactions) is a param of eth_subscribe.
+var subscriptionMethods = map[string]bool{
+	"eth_subscribe":   true,
+	"eth_unsubscribe": true,
+}
+
+// handleWS proxies a client WebSocket to the upstream. Every inbound frame
+// goes through the same guards as an HTTP call. Frames touching a
+// subscription are sent over the upstream WebSocket, whose frames (replies
+// and subscription notifications) are relayed untouched; all other calls go
+// to the HTTP pool like they would over /.
+func handleWS(w http.ResponseWriter, r *http.Request) {
+	// Checked first so a plain GET costs no guard work or upstream dial.
+	if !websocket.IsWebSocketUpgrade(r) {
+		http.Error(w, "WebSocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	cfg := getConfig()
+	ex := newExchange(r, cfg)
+	if cfg.unconfigured {
+		ex.logDecision("", "reject", notConfigured.reason, 0, nil)
+		ex.rejectMetric(w, nil, "", notConfigured)
+		return
+	}
+	if rej := ex.checkDenied(); rej != nil {
+		ex.logDecision("", "reject", rej.reason, 0, nil)
+		ex.rejectMetric(w, nil, "", rej)
+		return
+	}
+	if rej := ex.checkMaintenance(); rej != nil {
+		ex.logDecision("", "reject", rej.reason, 0, nil)
+		setMaintenanceRetry(w, cfg)
+		ex.rejectMetric(w, nil, "", rej)
+		return
+	}
+	if rej := ex.checkClientCert(r); rej != nil {
+		ex.logDecision("", "reject", rej.reason, 0, nil)
+		ex.rejectMetric(w, nil, "", rej)
+		return
+	}
+	if rej := ex.identify(r); rej != nil {
+		ex.logDecision("", "reject", rej.reason, 0, nil)
+		ex.rejectMetric(w, nil, "", rej)
+		return
+	}
+
+	client, err := wsUpgrader.Upgrade(w, r, http.Header{"X-Request-ID": {ex.reqID}})
+	if err != nil {
+		return
+	}
+	// The access log gets one line for the connection, written when it
+	// closes; the frames are in the per-call log.
+	ex.access.note("websocket", "accept", "")
+	ex.access = nil
+	upstream, _, err := websocket.DefaultDialer.DialContext(r.Context(), wsUpstreamURL(cfg), nil)
+	if err != nil {
+		client.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "upstream RPC failed"))
+		client.Close()
+		return
+	}
+
+	// gorilla allows one writer per connection: the upstream pump, guard
+	// rejections and HTTP replies all write to the client, and the read
+	// loop and teardown both write to the upstream.
+	var clientMu, upstreamMu sync.Mutex
+	writeClient := func(mt int, msg []byte) error {
+		clientMu.Lock()
+		defer clientMu.Unlock()
+		return client.WriteMessage(mt, msg)
+	}
+	writeUpstream := func(mt int, msg []byte) error {
+		upstreamMu.Lock()
+		defer upstreamMu.Unlock()
+		return upstream.WriteMessage(mt, msg)
+	}
+	var closeOnce sync.Once
+	teardown := func() {
+		closeOnce.Do(func() {
+			bye := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			writeClient(websocket.CloseMessage, bye)
+			writeUpstream(websocket.CloseMessage, bye)
+			client.Close()
+			upstream.Close()
+		})
+	}
+	defer teardown()
+
+	var partials wsPartials
+	go func() {
+		defer teardown()
+		for {
+			mt, msg, err := upstream.ReadMessage()
+			if err != nil {
+				return
+			}
+			if p := partials.take(msg); p != nil {
+				msg = p.merge(msg)
+			}
+			if err := writeClient(mt, msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	pending := make(chan struct{}, wsMaxInFlight)
+	for {
+		// A frame over MaxRequestBytes fails the read and closes the socket
+		// with 1009, like an oversized HTTP body is refused.
+		client.SetReadLimit(maxRequestBytes(ex.cfg))
+		mt, msg, err := client.ReadMessage()
+		if err != nil {
+			return
+		}
+		// Pick up config reloads for long-lived connections.
+		ex.cfg = getConfig()
+		forward, reply, partial := guardFrame(ex, msg)
+		if reply != nil {
+			if err := writeClient(websocket.TextMessage, reply); err != nil {
+				return
+			}
+		}
+		if forward == nil {
+			continue
+		}
+		if !needsWS(forward) {
+			// A copy, since the loop swaps ex.cfg on reloads.
+			call := *ex
+			pending <- struct{}{}
+			go func(payload []byte) {
+				defer func() { <-pending }()
+				reply := wsCallHTTP(&call, payload)
+				if partial != nil {
+					reply = partial.merge(reply)
+				}
+				if reply != nil {
+					writeClient(websocket.TextMessage, reply)
+				}
+			}(forward)
+			continue
+		}
+		if partial != nil {
+			if len(partial.awaited()) > 0 {
+				partials.add(partial)
+			} else if reply := partial.merge(nil); reply != nil {
+				// Only notifications go out, so the rejections are the reply.
+				if err := writeClient(websocket.TextMessage, reply); err != nil {
+					return
+				}
+			}
+		}
+		if err := writeUpstream(mt, forward); err != nil {
+			return
+		}
+	}
+}
+
+// guardFrame applies the guards to one inbound frame. It returns the payload
+// to forward upstream (nil if nothing is allowed) and an error reply to send
+// back to the client when every call was rejected. A partly rejected batch
+// has no reply yet: its rejections come back as partial, to be merged with
+// the upstream's answers into the one array JSON-RPC requires.
+func guardFrame(ex *exchange, msg []byte) (forward, reply []byte, partial *partialBatch) {
+	if !isBatch(msg) {
+		var req RPCRequest
+		if err := json.Unmarshal(msg, &req); err != nil {
+			reply, _ = json.Marshal(RPCResponse{
+				JSONRPC: "2.0",
+				Error:   &RPCError{Code: -32700, Message: "Parse error"},
+			})
+			return nil, reply, nil
+		}
+		if rej := checkRequest(ex, &req, msg); rej != nil {
+			ex.logDecision(req.Method, "reject", rej.reason, 0, nil)
+			resp := ex.rejectResponse(req.ID, req.Method, rej)
+			if req.isNotification() {
+				return nil, nil, nil
+			}
+			reply, _ = json.Marshal(resp)
+			return nil, reply, nil
+		}
+		ex.countAccept(req.Method)
+		ex.logDecision(req.Method, "accept", "", 0, nil)
+		return msg, nil, nil
+	}
+
+	var raws []json.RawMessage
+	if err := json.Unmarshal(msg, &raws); err != nil || len(raws) == 0 {
+		reply, _ = json.Marshal(RPCResponse{
+			JSONRPC: "2.0",
+			Error:   &RPCError{Code: -32600, Message: "Invalid request"},
+		})
+		return nil, reply, nil
+	}
+	partial = &partialBatch{reqs: make([]RPCRequest, len(raws)), replies: make([]interface{}, len(raws))}
+	var allowed []json.RawMessage
+	for i, raw := range raws {
+		req := &partial.reqs[i]
+		if err := json.Unmarshal(raw, req); err != nil {
+			partial.replies[i] = RPCResponse{
+				JSONRPC: "2.0",
+				Error:   &RPCError{Code: -32600, Message: "Invalid request"},
+			}
+			continue
+		}
+		if rej := checkRequest(ex, req, raw); rej != nil {
+			ex.logDecision(req.Method, "reject", rej.reason, 0, nil)
+			resp := ex.rejectResponse(req.ID, req.Method, rej)
+			if !req.isNotification() {
+				partial.replies[i] = resp
+			}
+			continue
+		}
+		ex.countAccept(req.Method)
+		ex.logDecision(req.Method, "accept", "", 0, nil)
+		partial.forwarded = append(partial.forwarded, i)
+		allowed = append(allowed, raw)
+	}
+	if len(allowed) == len(raws) {
+		return msg, nil, nil
+	}
+	if len(allowed) == 0 {
+		return nil, partial.merge(nil), nil
+	}
+	forward, _ = json.Marshal(allowed)
+	return forward, nil, partial
+}
+
+// partialBatch is a batch frame some of whose calls the guards refused.
+type partialBatch struct {
+	reqs []RPCRequest
+	// replies holds the rejections by position, nil where the upstream
+	// answers or nobody does.
+	replies   []interface{}
+	forwarded []int
+}
+
+// awaited lists the compacted ids of the forwarded calls expecting a reply,
+// sorted, for matching the upstream's answer on a shared WebSocket.
+func (p *partialBatch) awaited() []string {
+	var ids []string
+	for _, i := range p.forwarded {
+		if !p.reqs[i].isNotification() {
+			ids = append(ids, idKey(p.reqs[i].ID))
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// merge fills in the upstream's answers from body, its reply to the
+// forwarded calls, and returns the batch's reply in request order, or nil
+// if nothing in it expects one. Like an HTTP batch, calls the upstream
+// didn't answer are left out.
+func (p *partialBatch) merge(body []byte) []byte {
+	var raws []json.RawMessage
+	if isBatch(body) {
+		json.Unmarshal(body, &raws)
+	} else if len(bytes.TrimSpace(body)) > 0 {
+		// Some nodes answer a batch of one with a bare reply.
+		raws = []json.RawMessage{body}
+	}
+	upstream := indexReplies(raws)
+	out := make([]interface{}, 0, len(p.replies))
+	for i, reply := range p.replies {
+		if reply == nil && !p.reqs[i].isNotification() {
+			if raw, ok := upstream.take(p.reqs[i].ID); ok {
+				reply = raw
+			}
+		}
+		if reply != nil {
+			out = append(out, reply)
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	reply, _ := json.Marshal(out)
+	return reply
+}
+
+// wsPartials holds a connection's partly rejected batches that went over
+// the upstream WebSocket until the upstream's reply to them comes back.
+type wsPartials struct {
+	mu      sync.Mutex
+	pending []*partialBatch
+}
+
+func (w *wsPartials) add(p *partialBatch) {
+	w.mu.Lock()
+	w.pending = append(w.pending, p)
+	w.mu.Unlock()
+}
+
+// take removes and returns the pending batch msg answers, matched on the
+// ids in it, or nil if msg isn't the reply to one.
+func (w *wsPartials) take(msg []byte) *partialBatch {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.pending) == 0 || !isBatch(msg) {
+		return nil
+	}
+	var heads []struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if json.Unmarshal(msg, &heads) != nil {
+		return nil
+	}
+	ids := make([]string, len(heads))
+	for i, h := range heads {
+		ids[i] = idKey(h.ID)
+	}
+	sort.Strings(ids)
+	for i, p := range w.pending {
+		if slices.Equal(p.awaited(), ids) {
+			w.pending = slices.Delete(w.pending, i, i+1)
+			return p
+		}
+	}
+	return nil
+}
+
+// frameCalls decodes the calls of an already guarded frame.
+func frameCalls(payload []byte) []RPCRequest {
+	if !isBatch(payload) {
+		var req RPCRequest
+		json.Unmarshal(payload, &req)
+		return []RPCRequest{req}
+	}
+	var reqs []RPCRequest
+	json.Unmarshal(payload, &reqs)
+	return reqs
+}
+
+// needsWS reports whether a frame has to go over the upstream WebSocket. A
+// batch mixing subscription and plain calls is kept whole and sent there.
+func needsWS(payload []byte) bool {
+	for _, req := range frameCalls(payload) {
+		if subscriptionMethods[req.Method] {
+			return true
+		}
+	}
+	return false
+}
+
+// wsCallHTTP forwards a frame over HTTP and returns the reply frame, or nil
+// when there is nothing to send back (only notifications, or the client is
+// gone). A call the upstream couldn't answer, or answered with a non-2xx
+// status, still gets an error reply with its id.
+func wsCallHTTP(ex *exchange, payload []byte) []byte {
+	cfg := ex.cfg
+	reqs := frameCalls(payload)
+	methods := make([]string, len(reqs))
+	route := methodRoute(cfg, reqs[0].Method)
+	for i, req := range reqs {
+		methods[i] = req.Method
+		if methodRoute(cfg, req.Method) != route {
+			route = "" // mixed routes: the default pool answers the batch
+		}
+	}
+	// Each frame out on HTTP holds a MaxConcurrentPerIP slot, like an HTTP
+	// request does.
+	if cfg.MaxConcurrentPerIP > 0 && !ex.allowlisted {
+		if !acquireSlot(ex.ip, cfg.MaxConcurrentPerIP) {
+			return wsErrorReply(payload, reqs, func(req RPCRequest) RPCResponse {
+				return ex.rejectResponse(req.ID, req.Method, tooManyConcurrent)
+			})
+		}
+		defer releaseSlot(ex.ip)
+	}
+	resp, err := forwardOrFallback(ex.ctx, withRoute(cfg, route), methods, payload, ex.header)
+	if isClientCancel(err) {
+		return nil
+	}
+	if err == nil && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		// An error page, not a reply: the socket only carries JSON-RPC.
+		resp.Body.Close()
+		err = fmt.Errorf("upstream status %d", resp.StatusCode)
+	}
+	var body []byte
+	if err == nil {
+		body, err = readUpstream(resp, cfg)
+	}
+	if err == nil {
+		if len(bytes.TrimSpace(body)) == 0 {
+			return nil
+		}
+		if cfg.CountUpstreamErrors {
+			label := "batch"
+			if !isBatch(payload) {
+				label = methodLabel(cfg, reqs[0].Method)
+			}
+			countRPCErrors(label, body)
+		}
+		return body
+	}
+
+	return wsErrorReply(payload, reqs, func(req RPCRequest) RPCResponse {
+		if errors.Is(err, errUpstreamBusy) {
+			return ex.rejectResponse(req.ID, req.Method, errBusyRejection)
+		}
+		return upstreamErrorResponse(req.ID, err)
+	})
+}
+
+// wsErrorReply builds the reply frame for a frame none of whose calls got an
+// answer: reply's error for each call expecting one, in the frame's shape.
+func wsErrorReply(payload []byte, reqs []RPCRequest, reply func(RPCRequest) RPCResponse) []byte {
+	var replies []RPCResponse
+	for _, req := range reqs {
+		if !req.isNotification() {
+			replies = append(replies, reply(req))
+		}
+	}
+	if len(replies) == 0 {
+		return nil
+	}
+	var out []byte
+	if isBatch(payload) {
+		out, _ = json.Marshal(replies)
+	} else {
+		out, _ = json.Marshal(replies[0])
+	}
+	return out
+}
+
+// readUpstream reads a whole upstream reply, decompressed, within
+// MaxResponseBytes.
+func readUpstream(resp *http.Response, cfg Config) ([]byte, error) {
+	defer resp.Body.Close()
+	if err := decodeUpstream(resp); err != nil {
+		return nil, err
+	}
+	var src io.Reader = resp.Body
+	if cfg.MaxResponseBytes > 0 {
+		src = io.LimitReader(resp.Body, cfg.MaxResponseBytes+1)
+	}
+	body, err := io.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxResponseBytes > 0 && int64(len(body)) > cfg.MaxResponseBytes {
+		return nil, errResponseTooLarge
+	}
+	return body, nil
+}
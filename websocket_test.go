@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsUpstream is a fake node WebSocket that echoes every frame back and
+// counts the connections made to it.
+func wsUpstream(t *testing.T, dials *atomic.Int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dials.Add(1)
+		c, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			mt, msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			c.WriteMessage(mt, msg)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func wsURL(httpURL string) string { return "ws" + strings.TrimPrefix(httpURL, "http") }
+
+func dialGuard(t *testing.T, guard *httptest.Server) *websocket.Conn {
+	t.Helper()
+	c, _, err := websocket.DefaultDialer.Dial(wsURL(guard.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestWSPlainGetDoesNotDialUpstream(t *testing.T) {
+	var dials atomic.Int32
+	up := wsUpstream(t, &dials)
+	cfg := testConfig(up.URL)
+	cfg.GethWS = wsURL(up.URL)
+	useConfig(t, cfg)
+
+	rec := httptest.NewRecorder()
+	handleWS(rec, httptest.NewRequest(http.MethodGet, "/ws", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", rec.Code)
+	}
+	if n := dials.Load(); n != 0 {
+		t.Errorf("upstream dialed %d times for a plain GET", n)
+	}
+}
+
+func TestWSFrameOverMaxRequestBytes(t *testing.T) {
+	var dials atomic.Int32
+	up := wsUpstream(t, &dials)
+	cfg := testConfig(up.URL)
+	cfg.GethWS = wsURL(up.URL)
+	cfg.MaxRequestBytes = 256
+	useConfig(t, cfg)
+	guard := httptest.NewServer(http.HandlerFunc(handleWS))
+	defer guard.Close()
+
+	c := dialGuard(t, guard)
+	big := fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["%s"]}`, strings.Repeat("a", 512))
+	c.WriteMessage(websocket.TextMessage, []byte(big))
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := c.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("got %v, want close 1009", err)
+	}
+}
+
+// slowRPC answers every call after a pause, recording the most calls it had
+// open at once.
+func slowRPC(t *testing.T, peak *atomic.Int32) *httptest.Server {
+	t.Helper()
+	var open atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := open.Add(1)
+		defer open.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		var req RPCRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%s,"result":"0x1"}`, req.ID)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// readReplies reads n frames and tallies them by error reason, "" for
+// results.
+func readReplies(t *testing.T, c *websocket.Conn, n int) map[string]int {
+	t.Helper()
+	got := map[string]int{}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < n; i++ {
+		_, msg, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("reply %d: %v", i, err)
+		}
+		var resp struct {
+			Error *RPCError `json:"error"`
+		}
+		json.Unmarshal(msg, &resp)
+		if resp.Error != nil {
+			reason, _ := resp.Error.Data.(string)
+			got[reason]++
+		} else {
+			got[""]++
+		}
+	}
+	return got
+}
+
+func TestWSBoundsInFlightFrames(t *testing.T) {
+	var dials, peak atomic.Int32
+	up := wsUpstream(t, &dials)
+	rpc := slowRPC(t, &peak)
+	cfg := testConfig(rpc.URL)
+	cfg.GethWS = wsURL(up.URL)
+	useConfig(t, cfg)
+	guard := httptest.NewServer(http.HandlerFunc(handleWS))
+	defer guard.Close()
+
+	c := dialGuard(t, guard)
+	const frames = 3 * wsMaxInFlight
+	for i := 0; i < frames; i++ {
+		c.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"eth_chainId","params":[]}`, i)))
+	}
+	if got := readReplies(t, c, frames); got[""] != frames {
+		t.Errorf("replies %v, want %d results", got, frames)
+	}
+	if p := peak.Load(); p > wsMaxInFlight {
+		t.Errorf("%d frames upstream at once, want at most %d", p, wsMaxInFlight)
+	}
+}
+
+func TestWSFramesCountAgainstMaxConcurrentPerIP(t *testing.T) {
+	var dials, peak atomic.Int32
+	up := wsUpstream(t, &dials)
+	rpc := slowRPC(t, &peak)
+	cfg := testConfig(rpc.URL)
+	cfg.GethWS = wsURL(up.URL)
+	cfg.MaxConcurrentPerIP = 2
+	useConfig(t, cfg)
+	guard := httptest.NewServer(http.HandlerFunc(handleWS))
+	defer guard.Close()
+
+	c := dialGuard(t, guard)
+	const frames = 10
+	for i := 0; i < frames; i++ {
+		c.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"eth_chainId","params":[]}`, i)))
+	}
+	got := readReplies(t, c, frames)
+	if got["too_many_concurrent"] == 0 || got[""]+got["too_many_concurrent"] != frames {
+		t.Errorf("replies %v, want results and too_many_concurrent only", got)
+	}
+	if p := peak.Load(); p > 2 {
+		t.Errorf("%d frames upstream at once, want at most 2", p)
+	}
+}
+
+// An upstream that hangs up mid-stream makes teardown write its close frame
+// while the read loop may be writing a frame; run with -race.
+func TestWSTeardownWhileForwarding(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c.ReadMessage()
+		c.Close()
+	}))
+	defer up.Close()
+	cfg := testConfig(up.URL)
+	cfg.GethWS = wsURL(up.URL)
+	useConfig(t, cfg)
+	guard := httptest.NewServer(http.HandlerFunc(handleWS))
+	defer guard.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, _, err := websocket.DefaultDialer.Dial(wsURL(guard.URL), nil)
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			for j := 0; j < 200; j++ {
+				if c.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["newHeads"]}`)) != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// readBatchReply reads one frame that must be a batch reply and returns its
+// ids and error reasons in order, then checks no second frame follows.
+func readBatchReply(t *testing.T, c *websocket.Conn) []string {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, msg, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replies []testReply
+	if err := json.Unmarshal(msg, &replies); err != nil {
+		t.Fatalf("reply %s is not one array: %v", msg, err)
+	}
+	var got []string
+	for _, r := range replies {
+		got = append(got, string(r.ID)+":"+r.reason())
+	}
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, extra, err := c.ReadMessage(); err == nil {
+		t.Errorf("second reply frame %s", extra)
+	}
+	return got
+}
+
+func TestWSPartlyRejectedBatchGetsOneReply(t *testing.T) {
+	resetLimiters(t)
+	var dials atomic.Int32
+	up := wsUpstream(t, &dials)
+	rpc := okUpstream(t)
+	cfg := testConfig(rpc.URL)
+	cfg.GethWS = wsURL(up.URL)
+	cfg.BlockedMethods = []string{"eth_sign"}
+	useConfig(t, cfg)
+	guard := httptest.NewServer(http.HandlerFunc(handleWS))
+	defer guard.Close()
+
+	cases := []struct {
+		name, batch string
+		want        string
+	}{
+		{"over http", `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"eth_sign"},{"jsonrpc":"2.0","method":"eth_sign"},{"jsonrpc":"2.0","id":3,"method":"eth_blockNumber"}]`,
+			"[1: 2:method_blocked 3:]"},
+		// The echoing upstream socket answers with the forwarded calls.
+		{"over the upstream socket", `[{"jsonrpc":"2.0","id":2,"method":"eth_sign"},{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["newHeads"]}]`,
+			"[2:method_blocked 1:]"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn := dialGuard(t, guard)
+			conn.WriteMessage(websocket.TextMessage, []byte(c.batch))
+			if got := fmt.Sprint(readBatchReply(t, conn)); got != c.want {
+				t.Errorf("reply %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestWSUpstreamErrorStatus(t *testing.T) {
+	resetLimiters(t)
+	var dials atomic.Int32
+	up := wsUpstream(t, &dials)
+	rpc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("<html>502 Bad Gateway</html>"))
+	}))
+	t.Cleanup(rpc.Close)
+	cfg := testConfig(rpc.URL)
+	cfg.GethWS = wsURL(up.URL)
+	useConfig(t, cfg)
+	guard := httptest.NewServer(http.HandlerFunc(handleWS))
+	defer guard.Close()
+
+	c := dialGuard(t, guard)
+	c.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","id":7,"method":"eth_chainId"}`))
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, msg, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply testReply
+	if err := json.Unmarshal(msg, &reply); err != nil || string(reply.ID) != "7" || reply.Error == nil || reply.Error.Code != -32000 {
+		t.Errorf("reply %s, want a -32000 error for id 7", msg)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// ===== SLIDING WINDOW LIMITER =====
+
+const defaultLimiterWindow = time.Second
+
+func limiterWindow(cfg Config) time.Duration {
+	if cfg.LimiterWindow > 0 {
+		return time.Duration(cfg.LimiterWindow) * time.Millisecond
+	}
+	return defaultLimiterWindow
+}
+
+// slidingWindow admits calls costing at most limit in any trailing window,
+// with no burst allowance beyond that. It keeps every admission in the
+// window, so the total is exact rather than interpolated.
+type slidingWindow struct {
+	mutex  sync.Mutex
+	window time.Duration
+	limit  int
+	hits   []windowHit // oldest first
+	used   float64     // sum of hits' cost
+	last   time.Time
+}
+
+type windowHit struct {
+	at   time.Time
+	cost float64
+}
+
+// newSlidingWindow allows rate_per_sec * window calls per window. For rates
+// too low to allow a whole call in window, the window is stretched to
+// 1/rate_per_sec so the long-run rate still matches. burst is not used.
+func newSlidingWindow(conf RateLimitConfig, window time.Duration) *slidingWindow {
+	window, limit := windowLimit(conf, window)
+	return &slidingWindow{window: window, limit: limit, last: time.Now()}
+}
+
+func windowLimit(conf RateLimitConfig, window time.Duration) (time.Duration, int) {
+	limit := int(math.Floor(conf.RatePerSec * window.Seconds()))
+	if limit < 1 {
+		limit = 1
+		if conf.RatePerSec > 0 {
+			window = time.Duration(float64(time.Second) / conf.RatePerSec)
+		}
+	}
+	return window, limit
+}
+
+func (sw *slidingWindow) allowN(cost float64) bool {
+	return sw.allowAt(time.Now(), cost)
+}
+
+func (sw *slidingWindow) allowAt(now time.Time, cost float64) bool {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	sw.last = now
+	sw.expire(now)
+	if sw.used+cost > float64(sw.limit) {
+		return false
+	}
+	sw.hits = append(sw.hits, windowHit{now, cost})
+	sw.used += cost
+	return true
+}
+
+// expire drops admissions that have left the window.
+func (sw *slidingWindow) expire(now time.Time) {
+	cutoff := now.Add(-sw.window)
+	i := 0
+	for i < len(sw.hits) && !sw.hits[i].at.After(cutoff) {
+		sw.used -= sw.hits[i].cost
+		i++
+	}
+	sw.hits = sw.hits[i:]
+	if len(sw.hits) == 0 {
+		sw.used = 0 // shed accumulated float error
+	}
+}
+
+// wait is the time until enough admissions expire to make room for cost.
+func (sw *slidingWindow) wait(cost float64) time.Duration {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	now := time.Now()
+	sw.expire(now)
+	if cost > float64(sw.limit) {
+		return time.Minute
+	}
+	used := sw.used
+	if used+cost <= float64(sw.limit) {
+		return 0
+	}
+	for _, h := range sw.hits {
+		used -= h.cost
+		if used+cost <= float64(sw.limit) {
+			return h.at.Add(sw.window).Sub(now)
+		}
+	}
+	return 0
+}
+
+func (sw *slidingWindow) algorithm() string { return algoSlidingWindow }
+
+func (sw *slidingWindow) lastUsed() time.Time {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	return sw.last
+}
+
+// full is true once every admission has left the window.
+func (sw *slidingWindow) full(now time.Time) bool {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	return len(sw.hits) == 0 || !sw.hits[len(sw.hits)-1].at.After(now.Add(-sw.window))
+}
+
+// retune keeps the admissions already in the window; they count against
+// the new limit and expire on the new window's schedule.
+func (sw *slidingWindow) retune(conf RateLimitConfig, window time.Duration) {
+	window, limit := windowLimit(conf, window)
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	sw.window, sw.limit = window, limit
+}
+
+func (sw *slidingWindow) remaining() float64 {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	sw.expire(time.Now())
+	return float64(sw.limit) - sw.used
+}
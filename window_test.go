@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// admittedAt counts how many of n calls at now lim lets through.
+func admittedAt(lim interface {
+	allowAt(time.Time, float64) bool
+}, now time.Time, n int) int {
+	got := 0
+	for i := 0; i < n; i++ {
+		if lim.allowAt(now, 1) {
+			got++
+		}
+	}
+	return got
+}
+
+func TestTokenBucketAndSlidingWindowBursts(t *testing.T) {
+	conf := RateLimitConfig{RatePerSec: 10, Burst: 10}
+	start := time.Unix(1_700_000_000, 0)
+	bucket := newRateLimiter(conf)
+	bucket.last = start
+	window := newSlidingWindow(conf, time.Second)
+
+	steps := []struct {
+		at             time.Duration
+		bucket, window int
+	}{
+		// Both start out allowing a full second's worth at once.
+		{0, 10, 10},
+		// The bucket refills continuously; the window only as calls age out.
+		{500 * time.Millisecond, 5, 0},
+		{999 * time.Millisecond, 4, 0},
+		{time.Second, 1, 10},
+		{1500 * time.Millisecond, 5, 0},
+	}
+	for _, s := range steps {
+		now := start.Add(s.at)
+		if got := admittedAt(bucket, now, 20); got != s.bucket {
+			t.Errorf("token bucket at %v: admitted %d, want %d", s.at, got, s.bucket)
+		}
+		if got := admittedAt(window, now, 20); got != s.window {
+			t.Errorf("sliding window at %v: admitted %d, want %d", s.at, got, s.window)
+		}
+	}
+}
+
+func TestSlidingWindowNeverExceedsLimit(t *testing.T) {
+	// Calls every 7ms for ten seconds; no trailing second may hold more than 5.
+	sw := newSlidingWindow(RateLimitConfig{RatePerSec: 5, Burst: 1}, time.Second)
+	start := time.Unix(1_700_000_000, 0)
+	var admitted []time.Time
+	for now := start; now.Before(start.Add(10 * time.Second)); now = now.Add(7 * time.Millisecond) {
+		if sw.allowAt(now, 1) {
+			admitted = append(admitted, now)
+		}
+	}
+	for i := 5; i < len(admitted); i++ {
+		if admitted[i].Sub(admitted[i-5]) <= time.Second {
+			t.Fatalf("6 calls within a second, ending at %v", admitted[i].Sub(start))
+		}
+	}
+	if len(admitted) < 45 {
+		t.Errorf("admitted %d in 10s, want about 50", len(admitted))
+	}
+}
+
+func TestSlowSlidingWindowStretches(t *testing.T) {
+	window, limit := windowLimit(RateLimitConfig{RatePerSec: 0.5}, time.Second)
+	if window != 2*time.Second || limit != 1 {
+		t.Errorf("window %v limit %d, want 2s and 1", window, limit)
+	}
+}
+
+func TestGetLimiterFollowsAlgorithm(t *testing.T) {
+	resetLimiters(t)
+	conf := RateLimitConfig{RatePerSec: 1, Burst: 1}
+	cases := []struct {
+		algorithm string
+		want      string
+	}{
+		{"", algoTokenBucket},
+		{algoSlidingWindow, algoSlidingWindow},
+		{algoTokenBucket, algoTokenBucket},
+	}
+	// The same key is reused, so each step also covers a reload switching it.
+	for _, c := range cases {
+		lim := getLimiter(Config{LimiterAlgorithm: c.algorithm}, "192.0.2.1", "eth_call", conf)
+		if lim.algorithm() != c.want {
+			t.Errorf("algorithm %q: got a %s limiter, want %s", c.algorithm, lim.algorithm(), c.want)
+		}
+	}
+}